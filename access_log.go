@@ -0,0 +1,107 @@
+package levee
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+type AccessLogConfig struct {
+	Output string `yaml:"output"`
+	Format string `yaml:"format"`
+}
+
+type accessLogEntry struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	User      string    `json:"user,omitempty"`
+	Method    string    `json:"method"`
+	URI       string    `json:"uri"`
+	Protocol  string    `json:"protocol"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"userAgent,omitempty"`
+	Duration  float64   `json:"durationSeconds"`
+}
+
+func openAccessLog(config AccessLogConfig) (io.Writer, error) {
+	switch config.Format {
+	case "", "combined", "common", "json":
+	default:
+		return nil, fmt.Errorf("unknown access log format %q, expected combined, common or json", config.Format)
+	}
+
+	switch config.Output {
+	case "":
+		return nil, nil
+	case "stdout":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	default:
+		return os.OpenFile(config.Output, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	}
+}
+
+func logFieldOrDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+
+	return value
+}
+
+func (entry accessLogEntry) format(format string) string {
+	switch format {
+	case "json":
+		line, _ := json.Marshal(entry)
+		return string(line) + "\n"
+	case "common":
+		return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %d\n",
+			entry.Client, logFieldOrDash(entry.User), entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			entry.Method, entry.URI, entry.Protocol, entry.Status, entry.Bytes)
+	default:
+		return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %d %q %q\n",
+			entry.Client, logFieldOrDash(entry.User), entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			entry.Method, entry.URI, entry.Protocol, entry.Status, entry.Bytes,
+			logFieldOrDash(entry.Referer), logFieldOrDash(entry.UserAgent))
+	}
+}
+
+func writeAccessLog(handler http.Handler, output io.Writer, format string) http.Handler {
+	if output == nil {
+		return handler
+	}
+
+	var mutex sync.Mutex
+
+	return http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: wr, statusCode: http.StatusOK}
+		handler.ServeHTTP(recorder, r)
+
+		user, _, _ := r.BasicAuth()
+		entry := accessLogEntry{
+			Time:      start,
+			Client:    clientIP(r).String(),
+			User:      user,
+			Method:    r.Method,
+			URI:       r.RequestURI,
+			Protocol:  r.Proto,
+			Status:    recorder.statusCode,
+			Bytes:     recorder.bytesWritten,
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+			Duration:  time.Since(start).Seconds(),
+		}
+
+		mutex.Lock()
+		io.WriteString(output, entry.format(format))
+		mutex.Unlock()
+	})
+}
@@ -0,0 +1,161 @@
+package levee
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+var adminListenAddress string
+
+func registerAdminRoutes(router *mux.Router) {
+	router.HandleFunc("/-/levee/cache/purge", requireAdminToken(purgePattern)).Methods("POST")
+	router.HandleFunc("/-/levee/cache/warm", requireAdminToken(warmPackages)).Methods("POST")
+	router.HandleFunc("/-/levee/cache/{scope:@[^/]+}/{package}", requireAdminToken(purgePackage)).Methods("DELETE")
+	router.HandleFunc("/-/levee/cache/{package}", requireAdminToken(purgePackage)).Methods("DELETE")
+	router.HandleFunc("/-/levee/downloads", requireAdminToken(queryDownloads)).Methods("GET")
+	router.HandleFunc("/-/levee/stats", requireAdminToken(cacheStats)).Methods("GET")
+	router.HandleFunc("/-/levee/upstreams", requireAdminToken(listUpstreams)).Methods("GET")
+	router.HandleFunc("/-/levee/requests", requireAdminToken(listRecentRequests)).Methods("GET")
+	router.HandleFunc("/-/levee/cache", requireAdminToken(listCachedDocuments)).Methods("GET")
+	router.HandleFunc("/-/levee/dashboard", dashboard).Methods("GET")
+	registerPprofRoutes(router)
+}
+
+func adminRouter() *mux.Router {
+	router := mux.NewRouter()
+	registerAdminRoutes(router)
+	registerProbeRoutes(router, "")
+
+	return router
+}
+
+func requireAdminToken(handler http.HandlerFunc) http.HandlerFunc {
+	return func(wr http.ResponseWriter, r *http.Request) {
+		if settings().adminToken == "" {
+			http.NotFound(wr, r)
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(settings().adminToken)) != 1 {
+			wr.Header().Set("WWW-Authenticate", `Bearer realm="levee"`)
+			http.Error(wr, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		handler(wr, r)
+	}
+}
+
+func writeJSON(wr http.ResponseWriter, statusCode int, body interface{}) {
+	wr.Header().Set("Content-Type", "application/json")
+	wr.WriteHeader(statusCode)
+	json.NewEncoder(wr).Encode(body)
+}
+
+func purgeKeys(keys []string) (int, error) {
+	for _, key := range keys {
+		if err := cacheStore.Delete(key); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(keys), nil
+}
+
+func purgePackage(wr http.ResponseWriter, r *http.Request) {
+	defer forgetCacheSizes()
+
+	packagePath := "/" + mux.Vars(r)["package"]
+	if scope := mux.Vars(r)["scope"]; scope != "" {
+		packagePath = "/" + scope + packagePath
+	}
+
+	keys, err := cacheStore.Keys(cacheKey(packagePath + "/"))
+	if err != nil {
+		writeJSON(wr, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	purged, err := purgeKeys(append(keys, cacheKey(packagePath), cacheKey(packagePath)+abbreviatedMetadataSuffix))
+	if err != nil {
+		writeJSON(wr, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	tarballKeys, err := blobStore.Keys(cacheKey(packagePath + "/-/"))
+	if err == nil {
+		for _, key := range tarballKeys {
+			if err := blobStore.Delete(key); err == nil {
+				purged++
+			}
+		}
+	}
+
+	adminLog.infof(r, "Purged %s and its versions from the cache", packagePath)
+	writeJSON(wr, http.StatusOK, map[string]int{"purged": purged})
+}
+
+func purgePattern(wr http.ResponseWriter, r *http.Request) {
+	var purgeRequest struct {
+		Pattern string `json:"pattern"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&purgeRequest); err != nil || purgeRequest.Pattern == "" {
+		writeJSON(wr, http.StatusBadRequest, map[string]string{"error": "a glob pattern is required"})
+		return
+	}
+	if _, err := path.Match(purgeRequest.Pattern, ""); err != nil {
+		writeJSON(wr, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	purged, err := purgeMatching(purgeRequest.Pattern)
+	if err != nil {
+		writeJSON(wr, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	adminLog.infof(r, "Purged %d cache entries matching %s", purged, purgeRequest.Pattern)
+	writeJSON(wr, http.StatusOK, map[string]int{"purged": purged})
+}
+
+func purgeMatching(pattern string) (int, error) {
+	defer forgetCacheSizes()
+
+	prefix := settings().cacheKeyPrefix
+	keys, err := cacheStore.Keys(prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	var matchingKeys []string
+	for _, key := range keys {
+		if matched, _ := path.Match(pattern, strings.TrimPrefix(key, prefix)); matched {
+			matchingKeys = append(matchingKeys, key)
+		}
+	}
+
+	purged, err := purgeKeys(matchingKeys)
+	if err != nil {
+		return 0, err
+	}
+
+	tarballKeys, err := blobStore.Keys(prefix)
+	if err == nil {
+		for _, key := range tarballKeys {
+			if matched, _ := path.Match(pattern, strings.TrimPrefix(key, prefix)); matched {
+				if err := blobStore.Delete(key); err == nil {
+					purged++
+				}
+			}
+		}
+	}
+
+	return purged, nil
+}
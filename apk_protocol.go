@@ -0,0 +1,51 @@
+package levee
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// apkProtocol serves Alpine Linux repositories to apk. APKINDEX.tar.gz lists
+// the packages of a repository and is cached for the metadata TTL, the .apk
+// packages never change and are kept for good.
+type apkProtocol struct {
+	*repository
+}
+
+func newAPKProtocol(repo *repository) RegistryProtocol {
+	return apkProtocol{repository: repo}
+}
+
+func (apkProtocol) Name() string {
+	return "apk"
+}
+
+func (protocol apkProtocol) RegisterRoutes(router *mux.Router) {
+	routes := protocol.routes(router, protocol)
+	metadata := protocol.metadataProxy(protocol)
+	files := protocol.artifactProxy(protocol)
+
+	routes.HandleFunc("/{file:.+}", func(wr http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".apk") {
+			files(wr, r)
+		} else {
+			metadata(wr, r)
+		}
+	}).Methods("GET", "HEAD")
+}
+
+func (protocol apkProtocol) CacheKey(r *http.Request) string {
+	return cacheKey(r.URL.Path)
+}
+
+func (protocol apkProtocol) Fetch(r *http.Request) (*http.Response, error) {
+	return protocol.fetch(r)
+}
+
+// RewriteResponse leaves the responses as they are, apk locates packages
+// relative to the repository and checks the signature of the index.
+func (apkProtocol) RewriteResponse(r *http.Request, resp *http.Response) error {
+	return nil
+}
@@ -0,0 +1,208 @@
+package levee
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// aptProtocol serves a Debian or Ubuntu archive to apt. The Release files of
+// a suite are cached for the metadata TTL, and its index files are cached by
+// the checksum the cached Release lists for them, so that apt is never
+// served indexes older or newer than the Release it verified. Files
+// requested by hash and the packages of the pool never change and are kept
+// for good.
+type aptProtocol struct {
+	*repository
+}
+
+// aptRelease is a cached Release file, its own checksum and the checksums it
+// lists for the index files of the suite.
+type aptRelease struct {
+	cachedAt  string
+	digest    string
+	checksums map[string]string
+}
+
+// aptReleases holds the cached Release of each suite, parsed once per Release.
+var aptReleases sync.Map
+
+var aptHashes = map[string]func() hash.Hash{
+	"MD5Sum": md5.New,
+	"SHA256": sha256.New,
+	"SHA512": sha512.New,
+}
+
+var errAptHashMismatch = errors.New("the file does not match the hash it is requested by")
+
+func newAptProtocol(repo *repository) RegistryProtocol {
+	return aptProtocol{repository: repo}
+}
+
+func (aptProtocol) Name() string {
+	return "apt"
+}
+
+func (protocol aptProtocol) RegisterRoutes(router *mux.Router) {
+	routes := protocol.routes(router, protocol)
+	metadata := protocol.metadataProxy(protocol)
+	files := protocol.artifactProxy(protocol)
+
+	routes.HandleFunc("/pool/{file:.+}", files).Methods("GET", "HEAD")
+	routes.HandleFunc("/{file:.+}", func(wr http.ResponseWriter, r *http.Request) {
+		if _, _, found := aptByHash(r.URL.Path); found {
+			files(wr, r)
+		} else {
+			metadata(wr, r)
+		}
+	}).Methods("GET", "HEAD")
+}
+
+// aptByHash splits a path like dists/stable/main/binary-amd64/by-hash/SHA256/
+// {checksum} into the name of the hash and the checksum.
+func aptByHash(requestPath string) (string, string, bool) {
+	directory := path.Dir(requestPath)
+	hashName := path.Base(directory)
+	if _, known := aptHashes[hashName]; !known || path.Base(path.Dir(directory)) != "by-hash" {
+		return "", "", false
+	}
+
+	return hashName, path.Base(requestPath), true
+}
+
+func isAptRelease(requestPath string) bool {
+	switch path.Base(requestPath) {
+	case "InRelease", "Release", "Release.gpg":
+		return true
+	default:
+		return false
+	}
+}
+
+// CacheKey adds the checksum the cached Release of the suite lists for an
+// index file to its key, a refreshed Release thus misses the indexes cached
+// for the previous one. Release.gpg is keyed by the checksum of the Release
+// it signs likewise.
+func (protocol aptProtocol) CacheKey(r *http.Request) string {
+	key := cacheKey(r.URL.Path)
+	if path.Base(r.URL.Path) == "Release.gpg" {
+		if release, found := cachedAptRelease(r, path.Dir(r.URL.Path)+"/Release"); found {
+			key += "@sha256:" + release.digest
+		}
+		return key
+	}
+	if !strings.Contains(r.URL.Path, "/dists/") || isAptRelease(r.URL.Path) {
+		return key
+	}
+	if _, _, found := aptByHash(r.URL.Path); found {
+		return key
+	}
+
+	if checksum := protocol.releaseChecksum(r); checksum != "" {
+		key += "@sha256:" + checksum
+	}
+
+	return key
+}
+
+// releaseChecksum looks the SHA256 checksum of the index file requested by r
+// up in the Release of its suite, the closest directory with a cached one.
+func (protocol aptProtocol) releaseChecksum(r *http.Request) string {
+	for suite := path.Dir(r.URL.Path); strings.Contains(suite, "/dists/"); suite = path.Dir(suite) {
+		for _, name := range []string{"InRelease", "Release"} {
+			if release, found := cachedAptRelease(r, suite+"/"+name); found {
+				return release.checksums[strings.TrimPrefix(r.URL.Path, suite+"/")]
+			}
+		}
+	}
+
+	return ""
+}
+
+func cachedAptRelease(r *http.Request, releasePath string) (aptRelease, bool) {
+	releaseKey := cacheKey(releasePath)
+	cached, err := cacheStoreFor(r.Context()).Get(releaseKey)
+	if err != nil || cached["wholeResponse"] == "" {
+		return aptRelease{}, false
+	}
+
+	if parsed, found := aptReleases.Load(releaseKey); found && parsed.(aptRelease).cachedAt == cached["cachedAt"] {
+		return parsed.(aptRelease), true
+	}
+
+	body, err := decodeCachedMetadata(cached)
+	if err != nil {
+		cacheLog.warnf(r, "Failed to read the cached %s: %s", releasePath, err)
+		return aptRelease{}, false
+	}
+
+	digest := sha256.Sum256(body)
+	release := aptRelease{cachedAt: cached["cachedAt"], digest: hex.EncodeToString(digest[:]), checksums: parseAptRelease(body)}
+	aptReleases.Store(releaseKey, release)
+
+	return release, true
+}
+
+// parseAptRelease reads the SHA256 field of a Release file, whose lines list
+// the checksum, size and path of each index file of the suite.
+func parseAptRelease(release []byte) map[string]string {
+	checksums := map[string]string{}
+
+	inSHA256 := false
+	lines := bufio.NewScanner(bytes.NewReader(release))
+	for lines.Scan() {
+		line := lines.Text()
+		if !strings.HasPrefix(line, " ") {
+			inSHA256 = strings.HasPrefix(line, "SHA256:")
+			continue
+		}
+
+		if fields := strings.Fields(line); inSHA256 && len(fields) == 3 {
+			checksums[fields[2]] = fields[0]
+		}
+	}
+
+	return checksums
+}
+
+func (protocol aptProtocol) Fetch(r *http.Request) (*http.Response, error) {
+	return protocol.fetch(r)
+}
+
+// RewriteResponse leaves the responses as they are, apt resolves every file
+// relative to the archive and checks the signature of the Release files.
+func (aptProtocol) RewriteResponse(r *http.Request, resp *http.Response) error {
+	return nil
+}
+
+// VerifyArtifact checks a file requested by hash against that hash. Packages
+// of the pool are checked by apt against the signed indexes.
+func (protocol aptProtocol) VerifyArtifact(r *http.Request, artifact io.Reader) error {
+	hashName, expected, found := aptByHash(r.URL.Path)
+	if !found {
+		return nil
+	}
+
+	actual := aptHashes[hashName]()
+	if _, err := io.Copy(actual, artifact); err != nil {
+		return err
+	}
+	if hex.EncodeToString(actual.Sum(nil)) != strings.ToLower(expected) {
+		return fmt.Errorf("%s: %s", r.URL.Path, errAptHashMismatch)
+	}
+
+	return nil
+}
@@ -0,0 +1,211 @@
+package levee
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type benchRequest struct {
+	Method string
+	URI    string
+}
+
+type benchResult struct {
+	latency    time.Duration
+	statusCode int
+	bytes      int64
+	err        error
+}
+
+// Matches the request line of combined and common access log lines.
+var accessLogRequest = regexp.MustCompile(`"(GET|HEAD) (\S+) HTTP/[0-9.]+"`)
+
+// readRequestMix reads the requests to replay, one per line, either as a bare
+// path or as a line of a levee access log in any of its formats. Requests
+// other than GET and HEAD are skipped, replaying publishes makes no sense.
+func readRequestMix(filename string) ([]benchRequest, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var requests []benchRequest
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		var entry accessLogEntry
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "/"):
+			requests = append(requests, benchRequest{Method: http.MethodGet, URI: line})
+		case strings.HasPrefix(line, "{") && json.Unmarshal([]byte(line), &entry) == nil:
+			if entry.Method == http.MethodGet || entry.Method == http.MethodHead {
+				requests = append(requests, benchRequest{Method: entry.Method, URI: entry.URI})
+			}
+		default:
+			if match := accessLogRequest.FindStringSubmatch(line); match != nil {
+				requests = append(requests, benchRequest{Method: match[1], URI: match[2]})
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(requests) == 0 {
+		return nil, fmt.Errorf("%s has no GET or HEAD requests to replay", filename)
+	}
+
+	return requests, nil
+}
+
+func replayRequest(client *http.Client, baseURL string, token string, request benchRequest) benchResult {
+	req, err := http.NewRequest(request.Method, baseURL+request.URI, nil)
+	if err != nil {
+		return benchResult{err: err}
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	startedAt := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return benchResult{latency: time.Since(startedAt), err: err}
+	}
+	written, err := io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	return benchResult{latency: time.Since(startedAt), statusCode: resp.StatusCode, bytes: written, err: err}
+}
+
+func replayRequestMix(baseURL string, token string, requests []benchRequest, total int, concurrency int) ([]benchResult, time.Duration) {
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: concurrency}}
+	results := make([]benchResult, total)
+
+	var workers sync.WaitGroup
+	next := make(chan int)
+	startedAt := time.Now()
+	for i := 0; i < concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for i := range next {
+				results[i] = replayRequest(client, baseURL, token, requests[i%len(requests)])
+			}
+		}()
+	}
+	for i := 0; i < total; i++ {
+		next <- i
+	}
+	close(next)
+	workers.Wait()
+
+	return results, time.Since(startedAt)
+}
+
+func latencyPercentile(latencies []time.Duration, percentile float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+
+	return latencies[int(float64(len(latencies)-1)*percentile/100)]
+}
+
+func statsCounter(stats map[string]interface{}, name string) float64 {
+	counter, _ := stats[name].(float64)
+	return counter
+}
+
+func bench(args []string) {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	leveeURL := flags.String("url", "", "the base URL of the levee to benchmark, by default its port on localhost")
+	statsURL := flags.String("stats-url", "", "the base URL of its admin API, by default its admin listener or port on localhost")
+	clientToken := flags.String("token", "", "the client token to send, when clientAuth is enabled")
+	concurrency := flags.Int("concurrency", 10, "how many requests are in flight at once")
+	total := flags.Int("requests", 0, "how many requests to send, cycling through the mix, by default each request of the mix once")
+	filename, overrides := configFlags(flags, args)
+
+	config, err := loadConfig(filename, overrides)
+	if err != nil {
+		exitWithError(err)
+	}
+	requests, err := readRequestMix(commandArgument(flags, "file of requests to replay"))
+	if err != nil {
+		exitWithError(err)
+	}
+
+	baseURL := strings.TrimSuffix(*leveeURL, "/")
+	if baseURL == "" {
+		baseURL = localBaseURL(config)
+	}
+	if *statsURL == "" {
+		*statsURL = adminBaseURL(config)
+	}
+	if *total <= 0 {
+		*total = len(requests)
+	}
+	if *concurrency <= 0 {
+		*concurrency = 1
+	}
+
+	statsBefore, statsErr := fetchStats(*statsURL, config.Admin.Token)
+	results, elapsed := replayRequestMix(baseURL, *clientToken, requests, *total, *concurrency)
+	statsAfter, err := fetchStats(*statsURL, config.Admin.Token)
+	if statsErr == nil {
+		statsErr = err
+	}
+
+	var latencies []time.Duration
+	var failures int
+	var transferred int64
+	statusCodes := map[int]int{}
+	for _, result := range results {
+		if result.err != nil {
+			failures++
+			continue
+		}
+		latencies = append(latencies, result.latency)
+		statusCodes[result.statusCode]++
+		transferred += result.bytes
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	fmt.Printf("requests:    %d in %s with %d in flight, %.1f requests/s\n", len(results), elapsed.Round(time.Millisecond), *concurrency, float64(len(results))/elapsed.Seconds())
+	fmt.Printf("transferred: %d bytes\n", transferred)
+	fmt.Printf("failures:    %d\n", failures)
+	var seenStatusCodes []int
+	for statusCode := range statusCodes {
+		seenStatusCodes = append(seenStatusCodes, statusCode)
+	}
+	sort.Ints(seenStatusCodes)
+	for _, statusCode := range seenStatusCodes {
+		fmt.Printf("status %d:  %d\n", statusCode, statusCodes[statusCode])
+	}
+	if len(latencies) > 0 {
+		fmt.Printf("latency:     p50 %s, p90 %s, p99 %s, max %s\n",
+			latencyPercentile(latencies, 50), latencyPercentile(latencies, 90), latencyPercentile(latencies, 99), latencies[len(latencies)-1])
+	}
+
+	if statsErr != nil {
+		fmt.Printf("hit ratio:   unknown, the stats of levee are unavailable: %s\n", statsErr)
+		return
+	}
+	hits := statsCounter(statsAfter, "hits") - statsCounter(statsBefore, "hits")
+	misses := statsCounter(statsAfter, "misses") - statsCounter(statsBefore, "misses")
+	if hits+misses > 0 {
+		fmt.Printf("hit ratio:   %.1f%% (%.0f hits, %.0f misses)\n", 100*hits/(hits+misses), hits, misses)
+	}
+}
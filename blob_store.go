@@ -0,0 +1,248 @@
+package levee
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type BlobStore interface {
+	Get(key string) (io.ReadCloser, BlobInfo, error)
+	Put(key string, blob io.Reader, info BlobInfo) error
+	Delete(key string) error
+	Keys(prefix string) ([]string, error)
+}
+
+// BlobInfo is what the upstream told about a blob, kept with it so that a
+// cached blob is validated by clients like the upstream one.
+type BlobInfo struct {
+	ETag         string    `json:"etag,omitempty"`
+	LastModified time.Time `json:"lastModified,omitempty"`
+}
+
+func blobInfo(header http.Header) BlobInfo {
+	lastModified, _ := http.ParseTime(header.Get("Last-Modified"))
+	return BlobInfo{ETag: header.Get("ETag"), LastModified: lastModified}
+}
+
+// fileBlobStore keeps each blob in a file of its own, next to a file holding
+// its BlobInfo. The last access of each blob is tracked in memory, the
+// modification times of the files stay those of the downloads.
+type fileBlobStore struct {
+	directory string
+	maxBytes  int64
+	mutex     sync.Mutex
+	accessed  map[string]time.Time
+}
+
+func newFileBlobStore(directory string, maxBytes int64) (*fileBlobStore, error) {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, err
+	}
+
+	return &fileBlobStore{directory: directory, maxBytes: maxBytes, accessed: map[string]time.Time{}}, nil
+}
+
+func newBlobStore(config Config) (BlobStore, error) {
+	directory := config.Cache.Blobs.Directory
+	if directory == "" {
+		directory = filepath.Join(os.TempDir(), "levee")
+	}
+
+	return newFileBlobStore(directory, config.Cache.Blobs.MaxBytes)
+}
+
+func (store *fileBlobStore) blobPath(key string) string {
+	return filepath.Join(store.directory, url.PathEscape(key))
+}
+
+// infoPath is where the BlobInfo of a blob is kept, the .levee- prefix keeps
+// it out of the keys of the store.
+func (store *fileBlobStore) infoPath(blobName string) string {
+	return filepath.Join(store.directory, ".levee-info-"+blobName)
+}
+
+func (store *fileBlobStore) Get(key string) (io.ReadCloser, BlobInfo, error) {
+	blob, err := os.Open(store.blobPath(key))
+	if os.IsNotExist(err) {
+		return nil, BlobInfo{}, ErrCacheMiss
+	} else if err != nil {
+		return nil, BlobInfo{}, err
+	}
+
+	var info BlobInfo
+	if encodedInfo, err := ioutil.ReadFile(store.infoPath(url.PathEscape(key))); err == nil {
+		json.Unmarshal(encodedInfo, &info)
+	}
+
+	store.mutex.Lock()
+	store.accessed[url.PathEscape(key)] = time.Now()
+	store.mutex.Unlock()
+
+	return blob, info, nil
+}
+
+// Put writes the blob and its BlobInfo to temporary files and renames them
+// into place, the blob first and its info last, so that neither is ever seen
+// half written. Nothing is left behind when a step fails.
+func (store *fileBlobStore) Put(key string, blob io.Reader, info BlobInfo) error {
+	encodedInfo, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	blobFile, err := store.writeTempFile(blob)
+	if err != nil {
+		return err
+	}
+	infoFile, err := store.writeTempFile(bytes.NewReader(encodedInfo))
+	if err != nil {
+		os.Remove(blobFile)
+		return err
+	}
+
+	if err := os.Rename(blobFile, store.blobPath(key)); err != nil {
+		os.Remove(blobFile)
+		os.Remove(infoFile)
+		return err
+	}
+	if err := os.Rename(infoFile, store.infoPath(url.PathEscape(key))); err != nil {
+		os.Remove(infoFile)
+		os.Remove(store.blobPath(key))
+		return err
+	}
+
+	return store.enforceSizeCap()
+}
+
+// writeTempFile writes contents to a temporary file of the store, which the
+// .levee- prefix keeps out of its keys, and returns its path.
+func (store *fileBlobStore) writeTempFile(contents io.Reader) (string, error) {
+	tempFile, err := ioutil.TempFile(store.directory, ".levee-")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(tempFile, contents)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return "", err
+	}
+
+	return tempFile.Name(), nil
+}
+
+func (store *fileBlobStore) Delete(key string) error {
+	if err := store.remove(url.PathEscape(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// remove deletes a blob together with its BlobInfo.
+func (store *fileBlobStore) remove(blobName string) error {
+	os.Remove(store.infoPath(blobName))
+
+	store.mutex.Lock()
+	delete(store.accessed, blobName)
+	store.mutex.Unlock()
+
+	return os.Remove(filepath.Join(store.directory, blobName))
+}
+
+func (store *fileBlobStore) Keys(prefix string) ([]string, error) {
+	files, err := ioutil.ReadDir(store.directory)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, file := range files {
+		key, err := url.PathUnescape(file.Name())
+		if err != nil || file.IsDir() || strings.HasPrefix(file.Name(), ".levee-") {
+			continue
+		}
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+func (store *fileBlobStore) enforceSizeCap() error {
+	if store.maxBytes <= 0 {
+		return nil
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	files, err := ioutil.ReadDir(store.directory)
+	if err != nil {
+		return err
+	}
+
+	var totalBytes int64
+	blobs := files[:0]
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".levee-") {
+			continue
+		}
+		totalBytes += file.Size()
+		blobs = append(blobs, file)
+	}
+
+	lastAccess := func(blob os.FileInfo) time.Time {
+		if accessed := store.accessed[blob.Name()]; accessed.After(blob.ModTime()) {
+			return accessed
+		}
+		return blob.ModTime()
+	}
+	sort.Slice(blobs, func(i, j int) bool {
+		return lastAccess(blobs[i]).Before(lastAccess(blobs[j]))
+	})
+
+	for _, blob := range blobs {
+		if totalBytes <= store.maxBytes {
+			break
+		}
+		os.Remove(store.infoPath(blob.Name()))
+		delete(store.accessed, blob.Name())
+		if err := os.Remove(filepath.Join(store.directory, blob.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		totalBytes -= blob.Size()
+	}
+
+	return nil
+}
+
+func (store *fileBlobStore) Size() (int64, error) {
+	files, err := ioutil.ReadDir(store.directory)
+	if err != nil {
+		return 0, err
+	}
+
+	var totalBytes int64
+	for _, file := range files {
+		if !file.IsDir() && !strings.HasPrefix(file.Name(), ".levee-") {
+			totalBytes += file.Size()
+		}
+	}
+
+	return totalBytes, nil
+}
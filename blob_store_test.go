@@ -0,0 +1,46 @@
+package levee
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("the download broke off")
+}
+
+func TestFileBlobStorePut(t *testing.T) {
+	directory := t.TempDir()
+	store, err := newFileBlobStore(directory, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Put("lodash/-/lodash-1.0.0.tgz", failingReader{}, BlobInfo{ETag: `"v1"`}); err == nil {
+		t.Fatal("Put of a failing reader succeeded")
+	}
+	if files, _ := ioutil.ReadDir(directory); len(files) != 0 {
+		t.Fatalf("The failed Put left %d files behind", len(files))
+	}
+
+	info := BlobInfo{ETag: `"v1"`, LastModified: time.Now().UTC().Truncate(time.Second)}
+	if err := store.Put("lodash/-/lodash-1.0.0.tgz", strings.NewReader("the tarball"), info); err != nil {
+		t.Fatalf("Put failed: %s", err)
+	}
+	blob, storedInfo, err := store.Get("lodash/-/lodash-1.0.0.tgz")
+	if err != nil {
+		t.Fatalf("Get failed: %s", err)
+	}
+	defer blob.Close()
+	if contents, _ := ioutil.ReadAll(blob); string(contents) != "the tarball" || storedInfo != info {
+		t.Errorf("Get returned %q and %+v, expected the tarball and %+v", contents, storedInfo, info)
+	}
+	if files, _ := ioutil.ReadDir(directory); len(files) != 2 {
+		t.Errorf("The store holds %d files, expected the blob and its info", len(files))
+	}
+}
@@ -0,0 +1,335 @@
+package levee
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// CacheStore keeps the cached documents, each a set of string fields under a
+// key. Set merges the given fields into those of the key, Expire removes the
+// key once expiration has passed and does nothing for missing keys, and Get
+// returns ErrCacheMiss for missing or expired keys. The cachetest package
+// checks an implementation against this contract.
+type CacheStore interface {
+	Get(key string) (map[string]string, error)
+	Set(key string, fields map[string]string) error
+	Expire(key string, expiration time.Duration) error
+	Delete(key string) error
+	Keys(prefix string) ([]string, error)
+}
+
+// ErrCacheMiss is returned by CacheStore.Get when the key is not cached.
+var ErrCacheMiss = errors.New("levee: cache miss")
+
+// contextCacheStore is implemented by stores whose calls can be cancelled,
+// WithContext returns a view of the store bound to ctx.
+type contextCacheStore interface {
+	WithContext(ctx context.Context) CacheStore
+}
+
+// cacheStoreFor returns the cache store bound to ctx, so a lookup made for a
+// client that went away is abandoned.
+func cacheStoreFor(ctx context.Context) CacheStore {
+	if store, ok := cacheStore.(contextCacheStore); ok {
+		return store.WithContext(ctx)
+	}
+
+	return cacheStore
+}
+
+// batchCacheStore is implemented by stores that can write an entry together
+// with its expiry, or read several entries, in a single round trip.
+// SetWithExpiry merges the fields into the entry like Set does.
+type batchCacheStore interface {
+	SetWithExpiry(key string, fields map[string]string, expiration time.Duration) error
+	GetMany(keys []string) ([]map[string]string, error)
+}
+
+// expiringCacheStore is implemented by stores that can tell how long the
+// entries they return have left, GetManyWithTTL returns a negative duration
+// for entries without an expiry. The tiered store keeps entries in memory no
+// longer than that.
+type expiringCacheStore interface {
+	GetManyWithTTL(keys []string) ([]map[string]string, []time.Duration, error)
+}
+
+// sizedCacheStore is implemented by stores that can add up the size of the
+// responses cached below prefix without reading them.
+type sizedCacheStore interface {
+	DocumentsSize(prefix string) (int, int64, error)
+}
+
+// setCacheEntry writes the fields of key and, unless expiration is negative,
+// its expiry.
+func setCacheEntry(store CacheStore, key string, fields map[string]string, expiration time.Duration) error {
+	if batchStore, ok := store.(batchCacheStore); ok {
+		return batchStore.SetWithExpiry(key, fields, expiration)
+	}
+
+	if err := store.Set(key, fields); err != nil {
+		return err
+	}
+	if expiration > -1 {
+		return store.Expire(key, expiration)
+	}
+
+	return nil
+}
+
+// getCacheEntries reads several keys at once, missing keys are left nil.
+func getCacheEntries(store CacheStore, keys []string) ([]map[string]string, error) {
+	if batchStore, ok := store.(batchCacheStore); ok {
+		return batchStore.GetMany(keys)
+	}
+
+	entries := make([]map[string]string, len(keys))
+	for i, key := range keys {
+		fields, err := store.Get(key)
+		if err != nil && err != ErrCacheMiss {
+			return nil, err
+		}
+		entries[i] = fields
+	}
+
+	return entries, nil
+}
+
+type redisCacheStore struct {
+	client redis.UniversalClient
+}
+
+func newRedisClient(config Config) redis.UniversalClient {
+	switch {
+	case config.Redis.MasterName != "":
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    config.Redis.MasterName,
+			SentinelAddrs: config.Redis.SentinelAddresses,
+			Password:      config.Redis.Password,
+			DB:            config.Redis.DB,
+		})
+	case len(config.Redis.ClusterAddresses) > 0:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:    config.Redis.ClusterAddresses,
+			Password: config.Redis.Password,
+		})
+	default:
+		return redis.NewClient(&redis.Options{
+			Addr:     config.Redis.Address,
+			Password: config.Redis.Password,
+			DB:       config.Redis.DB,
+		})
+	}
+}
+
+func newRedisCacheStore(config Config) *redisCacheStore {
+	return &redisCacheStore{client: newRedisClient(config)}
+}
+
+func (store *redisCacheStore) WithContext(ctx context.Context) CacheStore {
+	switch client := store.client.(type) {
+	case *redis.Client:
+		return &redisCacheStore{client: client.WithContext(ctx)}
+	case *redis.ClusterClient:
+		return &redisCacheStore{client: client.WithContext(ctx)}
+	}
+
+	return store
+}
+
+func (store *redisCacheStore) Get(key string) (map[string]string, error) {
+	fields, err := store.client.HGetAll(key).Result()
+	if err == redis.Nil || (err == nil && len(fields) == 0) {
+		return nil, ErrCacheMiss
+	}
+
+	return fields, err
+}
+
+func (store *redisCacheStore) Set(key string, fields map[string]string) error {
+	values := make(map[string]interface{}, len(fields))
+	for field, value := range fields {
+		values[field] = value
+	}
+
+	return store.client.HMSet(key, values).Err()
+}
+
+func (store *redisCacheStore) SetWithExpiry(key string, fields map[string]string, expiration time.Duration) error {
+	values := make(map[string]interface{}, len(fields))
+	for field, value := range fields {
+		values[field] = value
+	}
+
+	_, err := store.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HMSet(key, values)
+		if expiration > -1 {
+			pipe.Expire(key, expiration)
+		}
+		return nil
+	})
+	return err
+}
+
+func (store *redisCacheStore) GetMany(keys []string) ([]map[string]string, error) {
+	commands := make([]*redis.StringStringMapCmd, len(keys))
+
+	_, err := store.client.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			commands[i] = pipe.HGetAll(key)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	entries := make([]map[string]string, len(keys))
+	for i, command := range commands {
+		if fields, err := command.Result(); err == nil && len(fields) > 0 {
+			entries[i] = fields
+		}
+	}
+
+	return entries, nil
+}
+
+// DocumentsSize asks Redis for the length of the responses, a whole cache
+// of them is too large to fetch.
+func (store *redisCacheStore) DocumentsSize(prefix string) (int, int64, error) {
+	keys, err := store.Keys(prefix)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var totalBytes int64
+	for start := 0; start < len(keys); start += 1000 {
+		batch := keys[start:]
+		if len(batch) > 1000 {
+			batch = batch[:1000]
+		}
+
+		commands := make([]*redis.IntCmd, len(batch))
+		_, err := store.client.Pipelined(func(pipe redis.Pipeliner) error {
+			for i, key := range batch {
+				commands[i] = redis.NewIntCmd("hstrlen", key, "wholeResponse")
+				pipe.Process(commands[i])
+			}
+			return nil
+		})
+		if err != nil && err != redis.Nil {
+			return 0, 0, err
+		}
+
+		for _, command := range commands {
+			totalBytes += command.Val()
+		}
+	}
+
+	return len(keys), totalBytes, nil
+}
+
+func (store *redisCacheStore) GetManyWithTTL(keys []string) ([]map[string]string, []time.Duration, error) {
+	commands := make([]*redis.StringStringMapCmd, len(keys))
+	ttlCommands := make([]*redis.DurationCmd, len(keys))
+
+	_, err := store.client.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			commands[i] = pipe.HGetAll(key)
+			ttlCommands[i] = pipe.PTTL(key)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, nil, err
+	}
+
+	entries := make([]map[string]string, len(keys))
+	ttls := make([]time.Duration, len(keys))
+	for i, command := range commands {
+		if fields, err := command.Result(); err == nil && len(fields) > 0 {
+			entries[i] = fields
+			ttls[i] = ttlCommands[i].Val()
+		}
+	}
+
+	return entries, ttls, nil
+}
+
+func (store *redisCacheStore) Expire(key string, expiration time.Duration) error {
+	return store.client.Expire(key, expiration).Err()
+}
+
+func (store *redisCacheStore) Delete(key string) error {
+	return store.client.Del(key).Err()
+}
+
+func (store *redisCacheStore) Close() error {
+	return store.client.Close()
+}
+
+// Keys scans every master of a cluster, a scan of the cluster client only
+// covers the keys of a single node.
+func (store *redisCacheStore) Keys(prefix string) ([]string, error) {
+	pattern := escapeRedisPattern(prefix) + "*"
+
+	cluster, ok := store.client.(*redis.ClusterClient)
+	if !ok {
+		return scanRedisKeys(store.client, pattern)
+	}
+
+	var keys []string
+	var keysLock sync.Mutex
+	err := cluster.ForEachMaster(func(master *redis.Client) error {
+		masterKeys, err := scanRedisKeys(master, pattern)
+		keysLock.Lock()
+		keys = append(keys, masterKeys...)
+		keysLock.Unlock()
+		return err
+	})
+
+	return keys, err
+}
+
+func scanRedisKeys(client redis.Cmdable, pattern string) ([]string, error) {
+	var keys []string
+
+	iterator := client.Scan(0, pattern, 1000).Iterator()
+	for iterator.Next() {
+		keys = append(keys, iterator.Val())
+	}
+
+	return keys, iterator.Err()
+}
+
+func escapeRedisPattern(pattern string) string {
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`).Replace(pattern)
+}
+
+func newCacheStore(config Config) (CacheStore, error) {
+	var store CacheStore
+
+	switch config.Cache.Type {
+	case "", "redis":
+		store = newRedisCacheStore(config)
+	case "memory":
+		store = newMemoryCacheStore(config.Cache.MaxEntries)
+	case "tiered":
+		store = newTieredCacheStore(newRedisCacheStore(config), config.Cache.MaxEntries, config.Cache.MemoryTTL)
+	case "s3":
+		s3Store, err := newS3CacheStore(config)
+		if err != nil {
+			return nil, err
+		}
+		store = s3Store
+	default:
+		return nil, fmt.Errorf("unknown cache type %q", config.Cache.Type)
+	}
+
+	return store, nil
+}
@@ -0,0 +1,146 @@
+package levee
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type CachePolicy struct {
+	Pattern string        `yaml:"pattern"`
+	TTL     time.Duration `yaml:"ttl"`
+	SoftTTL time.Duration `yaml:"softTTL"`
+}
+
+var defaultCachePolicies = []CachePolicy{
+	{Pattern: "/npm", TTL: 24 * time.Hour},
+}
+
+func cachePolicyFor(requestPath string) CachePolicy {
+	var matchedPolicy CachePolicy
+
+	for _, policy := range settings().cachePolicies {
+		if matched, _ := path.Match(policy.Pattern, requestPath); matched {
+			matchedPolicy = policy
+			break
+		}
+	}
+
+	if ttl, found := packageTTLFor(packageNameFromPath(requestPath)); found {
+		matchedPolicy.TTL = ttl
+	}
+
+	return matchedPolicy
+}
+
+func packageTTLFor(packageName string) (time.Duration, bool) {
+	ttls := settings().packageTTLs
+	if ttl, found := ttls[packageName]; found {
+		return ttl, true
+	}
+
+	var longestPattern string
+	for pattern := range ttls {
+		if matched, _ := path.Match(pattern, packageName); matched && len(pattern) > len(longestPattern) {
+			longestPattern = pattern
+		}
+	}
+	if longestPattern == "" {
+		return 0, false
+	}
+
+	return ttls[longestPattern], true
+}
+
+func parsePackageTTLs(rawTTLs map[string]string) (map[string]time.Duration, error) {
+	ttls := make(map[string]time.Duration, len(rawTTLs))
+
+	for pattern, rawTTL := range rawTTLs {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid package pattern %q: %s", pattern, err)
+		}
+
+		ttl, err := parseTTL(rawTTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TTL for %q: %s", pattern, err)
+		}
+		ttls[pattern] = ttl
+	}
+
+	return ttls, nil
+}
+
+func parseTTL(rawTTL string) (time.Duration, error) {
+	if strings.HasSuffix(rawTTL, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(rawTTL, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+
+	return time.ParseDuration(rawTTL)
+}
+
+func isCacheableStatus(statusCode int) bool {
+	return settings().cacheableStatuses[statusCode]
+}
+
+func (policy CachePolicy) cachingPeriod() time.Duration {
+	if policy.TTL <= 0 {
+		return -1
+	}
+
+	return policy.TTL
+}
+
+func upstreamCachingPeriod(header http.Header, cachingPeriod time.Duration) time.Duration {
+	current := settings()
+	if !current.respectCacheControl {
+		return cachingPeriod
+	}
+
+	upstreamPeriod, found := cacheControlMaxAge(header.Get("Cache-Control"))
+	if !found {
+		expires, err := http.ParseTime(header.Get("Expires"))
+		if err != nil {
+			return cachingPeriod
+		}
+		upstreamPeriod = time.Until(expires)
+	}
+
+	if upstreamPeriod < current.minCachingPeriod {
+		upstreamPeriod = current.minCachingPeriod
+	}
+	if current.maxCachingPeriod > 0 && upstreamPeriod > current.maxCachingPeriod {
+		upstreamPeriod = current.maxCachingPeriod
+	}
+	if upstreamPeriod < 0 {
+		upstreamPeriod = 0
+	}
+
+	return upstreamPeriod
+}
+
+func cacheControlMaxAge(cacheControl string) (time.Duration, bool) {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+
+		if directive == "no-store" || directive == "no-cache" {
+			return 0, true
+		}
+
+		if strings.HasPrefix(directive, "max-age=") {
+			seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+			if err != nil {
+				return 0, false
+			}
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+
+	return 0, false
+}
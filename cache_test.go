@@ -0,0 +1,77 @@
+package levee_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/kareem-abdelsalam/levee"
+	"github.com/kareem-abdelsalam/levee/cachetest"
+)
+
+func TestMemoryCache(t *testing.T) {
+	cachetest.TestCacheStore(t, func() levee.CacheStore {
+		return levee.NewMemoryCache(0)
+	})
+}
+
+func TestTieredCache(t *testing.T) {
+	cachetest.TestCacheStore(t, func() levee.CacheStore {
+		return levee.NewTieredCache(levee.NewMemoryCache(0), time.Minute)
+	})
+}
+
+// TestRedisCache runs against the Redis at LEVEE_TEST_REDIS, e.g.
+// localhost:6379, and is skipped without one.
+func TestRedisCache(t *testing.T) {
+	address := os.Getenv("LEVEE_TEST_REDIS")
+	if address == "" {
+		t.Skip("LEVEE_TEST_REDIS is not set to the address of a Redis")
+	}
+
+	for _, cacheType := range []string{"redis", "tiered"} {
+		t.Run(cacheType, func(t *testing.T) {
+			var config levee.Config
+			config.Cache.Type = cacheType
+			config.Cache.MemoryTTL = time.Minute
+			config.Redis.Address = address
+
+			cachetest.TestCacheStore(t, func() levee.CacheStore {
+				return newCacheStore(t, config)
+			})
+		})
+	}
+}
+
+// TestS3Cache runs against the bucket LEVEE_TEST_S3_BUCKET, at the endpoint
+// LEVEE_TEST_S3_ENDPOINT when it isn't AWS, e.g. a MinIO. The credentials
+// are taken from the environment like the AWS CLI does.
+func TestS3Cache(t *testing.T) {
+	bucket := os.Getenv("LEVEE_TEST_S3_BUCKET")
+	if bucket == "" {
+		t.Skip("LEVEE_TEST_S3_BUCKET is not set to a bucket to test in")
+	}
+
+	var config levee.Config
+	config.Cache.Type = "s3"
+	config.Cache.Bucket = bucket
+	config.Cache.Endpoint = os.Getenv("LEVEE_TEST_S3_ENDPOINT")
+	config.Cache.ForcePathStyle = config.Cache.Endpoint != ""
+	config.Cache.Region = os.Getenv("AWS_REGION")
+	if config.Cache.Region == "" {
+		config.Cache.Region = "us-east-1"
+	}
+
+	cachetest.TestCacheStore(t, func() levee.CacheStore {
+		return newCacheStore(t, config)
+	})
+}
+
+func newCacheStore(t *testing.T, config levee.Config) levee.CacheStore {
+	store, err := levee.NewCacheStore(config)
+	if err != nil {
+		t.Fatalf("Failed to create the %s cache: %s", config.Cache.Type, err)
+	}
+
+	return store
+}
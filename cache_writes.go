@@ -0,0 +1,160 @@
+package levee
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+type CacheWritesConfig struct {
+	Workers   int `yaml:"workers"`
+	QueueSize int `yaml:"queueSize"`
+}
+
+// cacheWriteQueue is the queue of the running Server. Its channel is never
+// closed, writes queued while it stops may still be on their way.
+type cacheWriteQueue struct {
+	writes  chan func()
+	done    chan struct{}
+	workers sync.WaitGroup
+
+	mutex sync.RWMutex
+	// stopping is set once the queue is drained, later writes run inline.
+	stopping bool
+}
+
+var cacheWrites atomic.Value
+
+var cacheWriteStats struct {
+	queued   uint64
+	inline   uint64
+	finished uint64
+}
+
+func currentCacheWriteQueue() *cacheWriteQueue {
+	queue, _ := cacheWrites.Load().(*cacheWriteQueue)
+	return queue
+}
+
+// startCacheWriters fills the cache in the background once the client has
+// its response, so the latency of the cache never adds to an install. Until
+// it is called, e.g. by the CLI commands, cache writes happen inline.
+func startCacheWriters(config CacheWritesConfig) {
+	workers := config.Workers
+	if workers <= 0 {
+		workers = 4
+	}
+	queueSize := config.QueueSize
+	if queueSize <= 0 {
+		queueSize = 1000
+	}
+
+	queue := &cacheWriteQueue{writes: make(chan func(), queueSize), done: make(chan struct{})}
+	for i := 0; i < workers; i++ {
+		queue.workers.Add(1)
+		go queue.work()
+	}
+	cacheWrites.Store(queue)
+}
+
+// work runs queued writes till the queue is drained, and then finishes
+// those still in it.
+func (queue *cacheWriteQueue) work() {
+	defer queue.workers.Done()
+
+	for {
+		select {
+		case write := <-queue.writes:
+			queue.run(write)
+		case <-queue.done:
+			for {
+				select {
+				case write := <-queue.writes:
+					queue.run(write)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (queue *cacheWriteQueue) run(write func()) {
+	write()
+	atomic.AddUint64(&cacheWriteStats.finished, 1)
+}
+
+// enqueue queues write unless the queue is full or stopping.
+func (queue *cacheWriteQueue) enqueue(write func()) bool {
+	queue.mutex.RLock()
+	defer queue.mutex.RUnlock()
+
+	if queue.stopping {
+		return false
+	}
+	select {
+	case queue.writes <- write:
+		return true
+	default:
+		return false
+	}
+}
+
+// queueCacheWrite runs write in the background, or inline when the queue is
+// full so a slow cache pushes back instead of piling up responses in memory.
+// Requests still running after a shutdown timed out write inline as well.
+func queueCacheWrite(write func()) {
+	if queue := currentCacheWriteQueue(); queue != nil && queue.enqueue(write) {
+		atomic.AddUint64(&cacheWriteStats.queued, 1)
+		return
+	}
+
+	atomic.AddUint64(&cacheWriteStats.inline, 1)
+	write()
+}
+
+// drainCacheWrites finishes the queued writes, giving up when ctx is done.
+func drainCacheWrites(ctx context.Context) error {
+	queue := currentCacheWriteQueue()
+	if queue == nil {
+		return nil
+	}
+
+	queue.mutex.Lock()
+	stopped := queue.stopping
+	queue.stopping = true
+	queue.mutex.Unlock()
+	if !stopped {
+		close(queue.done)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		queue.workers.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func currentCacheWriteStats() map[string]uint64 {
+	return map[string]uint64{
+		"queued":   atomic.LoadUint64(&cacheWriteStats.queued),
+		"inline":   atomic.LoadUint64(&cacheWriteStats.inline),
+		"finished": atomic.LoadUint64(&cacheWriteStats.finished),
+		"pending":  pendingCacheWrites(),
+	}
+}
+
+func pendingCacheWrites() uint64 {
+	if queue := currentCacheWriteQueue(); queue != nil {
+		return uint64(len(queue.writes))
+	}
+
+	return 0
+}
@@ -0,0 +1,30 @@
+package levee
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCacheWritesAfterDrain(t *testing.T) {
+	startCacheWriters(CacheWritesConfig{Workers: 1, QueueSize: 10})
+
+	queued := make(chan bool, 1)
+	queueCacheWrite(func() { queued <- true })
+	if err := drainCacheWrites(context.Background()); err != nil {
+		t.Fatalf("drainCacheWrites failed: %s", err)
+	}
+	select {
+	case <-queued:
+	default:
+		t.Error("The write queued before the drain was not finished")
+	}
+
+	written := false
+	queueCacheWrite(func() { written = true })
+	if !written {
+		t.Error("A write after the drain was not run inline")
+	}
+	if err := drainCacheWrites(context.Background()); err != nil {
+		t.Errorf("Draining twice failed: %s", err)
+	}
+}
@@ -0,0 +1,276 @@
+// Package cachetest checks implementations of levee.CacheStore against the
+// contract levee relies on, and provides an in-memory mock of one.
+//
+// A backend is verified from a test in its own package:
+//
+//	func TestMyCache(t *testing.T) {
+//		cachetest.TestCacheStore(t, func() levee.CacheStore {
+//			return newMyCache()
+//		})
+//	}
+package cachetest
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kareem-abdelsalam/levee"
+)
+
+// expiryTimeout is how long an expired key may still be returned, since
+// stores like Redis expire keys with a granularity of up to a second.
+const expiryTimeout = 3 * time.Second
+
+var storeCount int64
+
+// TestCacheStore runs the conformance suite against the stores returned by
+// newStore. Every subtest gets a store of its own and uses keys unique to
+// it, so stores sharing a backend can be tested too.
+func TestCacheStore(t *testing.T, newStore func() levee.CacheStore) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, store levee.CacheStore, key func(string) string)
+	}{
+		{"GetMissing", testGetMissing},
+		{"SetAndGet", testSetAndGet},
+		{"SetMergesFields", testSetMergesFields},
+		{"GetReturnsCopy", testGetReturnsCopy},
+		{"Expire", testExpire},
+		{"ExpireMissing", testExpireMissing},
+		{"SetAfterExpiry", testSetAfterExpiry},
+		{"Delete", testDelete},
+		{"Keys", testKeys},
+		{"Batch", testBatch},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			prefix := fmt.Sprintf("cachetest:%d:%d:", time.Now().UnixNano(), atomic.AddInt64(&storeCount, 1))
+			test.test(t, newStore(), func(name string) string {
+				return prefix + name
+			})
+		})
+	}
+}
+
+func mustGet(t *testing.T, store levee.CacheStore, key string) map[string]string {
+	t.Helper()
+
+	fields, err := store.Get(key)
+	if err != nil {
+		t.Fatalf("Get(%q) failed: %s", key, err)
+	}
+
+	return fields
+}
+
+func mustSet(t *testing.T, store levee.CacheStore, key string, fields map[string]string) {
+	t.Helper()
+
+	if err := store.Set(key, fields); err != nil {
+		t.Fatalf("Set(%q) failed: %s", key, err)
+	}
+}
+
+func expectMiss(t *testing.T, store levee.CacheStore, key string) {
+	t.Helper()
+
+	if fields, err := store.Get(key); err != levee.ErrCacheMiss {
+		t.Fatalf("Get(%q) returned %v, %v, expected levee.ErrCacheMiss", key, fields, err)
+	}
+}
+
+func expectFields(t *testing.T, store levee.CacheStore, key string, expected map[string]string) {
+	t.Helper()
+
+	fields := mustGet(t, store, key)
+	if len(fields) != len(expected) {
+		t.Fatalf("Get(%q) returned %v, expected %v", key, fields, expected)
+	}
+	for field, value := range expected {
+		if fields[field] != value {
+			t.Fatalf("Get(%q) returned %v, expected %v", key, fields, expected)
+		}
+	}
+}
+
+// waitForMiss polls key until it has expired, failing once expiryTimeout
+// has passed.
+func waitForMiss(t *testing.T, store levee.CacheStore, key string) {
+	t.Helper()
+
+	deadline := time.Now().Add(expiryTimeout)
+	for {
+		_, err := store.Get(key)
+		if err == levee.ErrCacheMiss {
+			return
+		} else if err != nil {
+			t.Fatalf("Get(%q) failed: %s", key, err)
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("%q was still cached %s after it expired", key, expiryTimeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func testGetMissing(t *testing.T, store levee.CacheStore, key func(string) string) {
+	expectMiss(t, store, key("missing"))
+}
+
+func testSetAndGet(t *testing.T, store levee.CacheStore, key func(string) string) {
+	fields := map[string]string{"wholeResponse": "HTTP/1.1 200 OK\r\n\r\n{}", "Etag": `"abc"`, "empty": ""}
+	mustSet(t, store, key("document"), fields)
+
+	expectFields(t, store, key("document"), fields)
+}
+
+func testSetMergesFields(t *testing.T, store levee.CacheStore, key func(string) string) {
+	mustSet(t, store, key("document"), map[string]string{"a": "1", "b": "2"})
+	mustSet(t, store, key("document"), map[string]string{"b": "3", "c": "4"})
+
+	expectFields(t, store, key("document"), map[string]string{"a": "1", "b": "3", "c": "4"})
+}
+
+func testGetReturnsCopy(t *testing.T, store levee.CacheStore, key func(string) string) {
+	mustSet(t, store, key("document"), map[string]string{"a": "1"})
+
+	fields := mustGet(t, store, key("document"))
+	fields["a"] = "changed"
+	fields["b"] = "added"
+
+	expectFields(t, store, key("document"), map[string]string{"a": "1"})
+}
+
+func testExpire(t *testing.T, store levee.CacheStore, key func(string) string) {
+	mustSet(t, store, key("expiring"), map[string]string{"a": "1"})
+	mustSet(t, store, key("lasting"), map[string]string{"a": "1"})
+
+	if err := store.Expire(key("expiring"), 100*time.Millisecond); err != nil {
+		t.Fatalf("Expire failed: %s", err)
+	}
+	if err := store.Expire(key("lasting"), time.Hour); err != nil {
+		t.Fatalf("Expire failed: %s", err)
+	}
+
+	waitForMiss(t, store, key("expiring"))
+	expectFields(t, store, key("lasting"), map[string]string{"a": "1"})
+
+	keys, err := store.Keys(key(""))
+	if err != nil {
+		t.Fatalf("Keys failed: %s", err)
+	}
+	if len(keys) != 1 || keys[0] != key("lasting") {
+		t.Fatalf("Keys returned %v, expected only %q", keys, key("lasting"))
+	}
+}
+
+func testExpireMissing(t *testing.T, store levee.CacheStore, key func(string) string) {
+	if err := store.Expire(key("missing"), time.Hour); err != nil {
+		t.Fatalf("Expire of a missing key failed: %s", err)
+	}
+
+	expectMiss(t, store, key("missing"))
+}
+
+func testSetAfterExpiry(t *testing.T, store levee.CacheStore, key func(string) string) {
+	mustSet(t, store, key("document"), map[string]string{"a": "1"})
+	if err := store.Expire(key("document"), 100*time.Millisecond); err != nil {
+		t.Fatalf("Expire failed: %s", err)
+	}
+	waitForMiss(t, store, key("document"))
+
+	mustSet(t, store, key("document"), map[string]string{"b": "2"})
+
+	expectFields(t, store, key("document"), map[string]string{"b": "2"})
+}
+
+func testDelete(t *testing.T, store levee.CacheStore, key func(string) string) {
+	mustSet(t, store, key("document"), map[string]string{"a": "1"})
+
+	if err := store.Delete(key("document")); err != nil {
+		t.Fatalf("Delete failed: %s", err)
+	}
+	expectMiss(t, store, key("document"))
+
+	if err := store.Delete(key("missing")); err != nil {
+		t.Fatalf("Delete of a missing key failed: %s", err)
+	}
+}
+
+func testKeys(t *testing.T, store levee.CacheStore, key func(string) string) {
+	for _, name := range []string{"lodash", "lodash/-/lodash-4.17.21.tgz", "@types/node", "left-pad", "a*b?[c]"} {
+		mustSet(t, store, key(name), map[string]string{"a": "1"})
+	}
+	if err := store.Delete(key("left-pad")); err != nil {
+		t.Fatalf("Delete failed: %s", err)
+	}
+
+	expectKeys := func(prefix string, expected ...string) {
+		t.Helper()
+
+		keys, err := store.Keys(key(prefix))
+		if err != nil {
+			t.Fatalf("Keys(%q) failed: %s", key(prefix), err)
+		}
+		sort.Strings(keys)
+
+		for i := range expected {
+			expected[i] = key(expected[i])
+		}
+		sort.Strings(expected)
+
+		if fmt.Sprint(keys) != fmt.Sprint(expected) {
+			t.Fatalf("Keys(%q) returned %v, expected %v", key(prefix), keys, expected)
+		}
+	}
+
+	expectKeys("", "lodash", "lodash/-/lodash-4.17.21.tgz", "@types/node", "a*b?[c]")
+	expectKeys("lodash", "lodash", "lodash/-/lodash-4.17.21.tgz")
+	expectKeys("@types/", "@types/node")
+	expectKeys("a*", "a*b?[c]")
+	expectKeys("a?")
+	expectKeys("left-pad")
+}
+
+// batchStore is the optional interface of stores writing an entry with its
+// expiry, or reading several entries, in one round trip.
+type batchStore interface {
+	SetWithExpiry(key string, fields map[string]string, expiration time.Duration) error
+	GetMany(keys []string) ([]map[string]string, error)
+}
+
+func testBatch(t *testing.T, store levee.CacheStore, key func(string) string) {
+	batch, ok := store.(batchStore)
+	if !ok {
+		t.Skip("the store does not implement SetWithExpiry and GetMany")
+	}
+
+	if err := batch.SetWithExpiry(key("expiring"), map[string]string{"a": "1"}, 100*time.Millisecond); err != nil {
+		t.Fatalf("SetWithExpiry failed: %s", err)
+	}
+	if err := batch.SetWithExpiry(key("lasting"), map[string]string{"b": "2"}, -1); err != nil {
+		t.Fatalf("SetWithExpiry without an expiry failed: %s", err)
+	}
+
+	entries, err := batch.GetMany([]string{key("lasting"), key("missing")})
+	if err != nil {
+		t.Fatalf("GetMany failed: %s", err)
+	}
+	if len(entries) != 2 || entries[0]["b"] != "2" || entries[1] != nil {
+		t.Fatalf("GetMany returned %v, expected the lasting entry and nil for the missing one", entries)
+	}
+
+	waitForMiss(t, store, key("expiring"))
+	expectFields(t, store, key("lasting"), map[string]string{"b": "2"})
+
+	if err := batch.SetWithExpiry(key("lasting"), map[string]string{"c": "3"}, time.Hour); err != nil {
+		t.Fatalf("SetWithExpiry of a stored entry failed: %s", err)
+	}
+	expectFields(t, store, key("lasting"), map[string]string{"b": "2", "c": "3"})
+}
@@ -0,0 +1,149 @@
+package cachetest
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kareem-abdelsalam/levee"
+)
+
+// MockCache is an in-memory levee.CacheStore for tests. Unlike the memory
+// cache of levee it never evicts, counts the calls made to it and can be
+// made to fail, e.g. to simulate a cache outage.
+type MockCache struct {
+	mutex   sync.Mutex
+	entries map[string]mockEntry
+	calls   map[string]int
+	err     error
+}
+
+type mockEntry struct {
+	fields    map[string]string
+	expiresAt time.Time
+}
+
+// NewMockCache returns an empty MockCache.
+func NewMockCache() *MockCache {
+	return &MockCache{entries: map[string]mockEntry{}, calls: map[string]int{}}
+}
+
+// Fail makes every following call return err, a nil err restores the cache.
+func (cache *MockCache) Fail(err error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.err = err
+}
+
+// Calls returns how often method, e.g. "Get", has been called.
+func (cache *MockCache) Calls(method string) int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	return cache.calls[method]
+}
+
+// call records a call of method and returns the error it has to fail with.
+func (cache *MockCache) call(method string) error {
+	cache.calls[method]++
+	return cache.err
+}
+
+// entry returns the entry of key unless it is missing or expired.
+func (cache *MockCache) entry(key string) (mockEntry, bool) {
+	entry, found := cache.entries[key]
+	if found && !entry.expiresAt.IsZero() && !time.Now().Before(entry.expiresAt) {
+		delete(cache.entries, key)
+		return mockEntry{}, false
+	}
+
+	return entry, found
+}
+
+func (cache *MockCache) Get(key string) (map[string]string, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if err := cache.call("Get"); err != nil {
+		return nil, err
+	}
+
+	entry, found := cache.entry(key)
+	if !found {
+		return nil, levee.ErrCacheMiss
+	}
+
+	fields := make(map[string]string, len(entry.fields))
+	for field, value := range entry.fields {
+		fields[field] = value
+	}
+
+	return fields, nil
+}
+
+func (cache *MockCache) Set(key string, fields map[string]string) error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if err := cache.call("Set"); err != nil {
+		return err
+	}
+
+	entry, found := cache.entry(key)
+	if !found {
+		entry = mockEntry{fields: make(map[string]string, len(fields))}
+	}
+	for field, value := range fields {
+		entry.fields[field] = value
+	}
+	cache.entries[key] = entry
+
+	return nil
+}
+
+func (cache *MockCache) Expire(key string, expiration time.Duration) error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if err := cache.call("Expire"); err != nil {
+		return err
+	}
+
+	if entry, found := cache.entry(key); found {
+		entry.expiresAt = time.Now().Add(expiration)
+		cache.entries[key] = entry
+	}
+
+	return nil
+}
+
+func (cache *MockCache) Delete(key string) error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if err := cache.call("Delete"); err != nil {
+		return err
+	}
+
+	delete(cache.entries, key)
+	return nil
+}
+
+func (cache *MockCache) Keys(prefix string) ([]string, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if err := cache.call("Keys"); err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for key := range cache.entries {
+		if _, found := cache.entry(key); found && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,36 @@
+package cachetest_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/kareem-abdelsalam/levee"
+	"github.com/kareem-abdelsalam/levee/cachetest"
+)
+
+func TestMockCache(t *testing.T) {
+	cachetest.TestCacheStore(t, func() levee.CacheStore {
+		return cachetest.NewMockCache()
+	})
+}
+
+func TestMockCacheFail(t *testing.T) {
+	cache := cachetest.NewMockCache()
+	if err := cache.Set("key", map[string]string{"field": "value"}); err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	outage := errors.New("outage")
+	cache.Fail(outage)
+	if _, err := cache.Get("key"); err != outage {
+		t.Errorf("Get of a failing cache returned %v, expected %v", err, outage)
+	}
+
+	cache.Fail(nil)
+	if fields, err := cache.Get("key"); err != nil || fields["field"] != "value" {
+		t.Errorf("Get of a restored cache returned %v, %v", fields, err)
+	}
+	if calls := cache.Calls("Get"); calls != 2 {
+		t.Errorf("Calls(\"Get\") returned %d, expected 2", calls)
+	}
+}
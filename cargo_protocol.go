@@ -0,0 +1,130 @@
+package levee
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// cargoProtocol serves a sparse crates index. config.json is rewritten so
+// that cargo downloads the crates through levee, where they are kept for
+// good once they match the checksum the index lists for them.
+type cargoProtocol struct {
+	*repository
+}
+
+var errCrateChecksumMismatch = errors.New("the crate does not match the checksum of the index")
+
+func newCargoProtocol(repo *repository) RegistryProtocol {
+	return cargoProtocol{repository: repo}
+}
+
+func (cargoProtocol) Name() string {
+	return "cargo"
+}
+
+func (protocol cargoProtocol) RegisterRoutes(router *mux.Router) {
+	routes := protocol.routes(router, protocol)
+	routes.HandleFunc("/{file:.+}", protocol.metadataProxy(protocol)).Methods("GET", "HEAD")
+}
+
+func (protocol cargoProtocol) CacheKey(r *http.Request) string {
+	return cacheKey(r.URL.Path)
+}
+
+func (protocol cargoProtocol) Fetch(r *http.Request) (*http.Response, error) {
+	return protocol.fetch(r)
+}
+
+// RewriteResponse points the download URL of config.json at levee, the index
+// files only hold names and checksums.
+func (protocol cargoProtocol) RewriteResponse(r *http.Request, resp *http.Response) error {
+	if !strings.HasSuffix(r.URL.Path, "/config.json") {
+		return nil
+	}
+
+	return protocol.rewriteLinks(r, resp)
+}
+
+// VerifyArtifact checks a crate downloaded as {crate}/{version}/download
+// against the checksum its index file lists for the version.
+func (protocol cargoProtocol) VerifyArtifact(r *http.Request, artifact io.Reader) error {
+	segments := strings.Split(r.URL.Path, "/")
+	if len(segments) < 3 || segments[len(segments)-1] != "download" {
+		policyLog.debugf(r, "Cannot tell the crate of %s, not verifying it", r.URL.Path)
+		return nil
+	}
+	crate, version := segments[len(segments)-3], segments[len(segments)-2]
+
+	expected, err := protocol.crateChecksum(r, crate, version)
+	if err != nil {
+		return err
+	} else if expected == "" {
+		policyLog.debugf(r, "No checksum to verify %s@%s against", crate, version)
+		return nil
+	}
+
+	sum := sha256.New()
+	if _, err := io.Copy(sum, artifact); err != nil {
+		return err
+	}
+	if hex.EncodeToString(sum.Sum(nil)) != expected {
+		return fmt.Errorf("%s@%s: %s", crate, version, errCrateChecksumMismatch)
+	}
+
+	return nil
+}
+
+// crateChecksum looks the checksum of a crate version up in the index, whose
+// files hold a JSON document per version and line.
+func (protocol cargoProtocol) crateChecksum(r *http.Request, crate string, version string) (string, error) {
+	req, _ := http.NewRequestWithContext(r.Context(), http.MethodGet, protocol.prefix+"/"+crateIndexPath(crate), nil)
+	req.Host = r.Host
+
+	resp, err := protocol.fetch(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil
+	}
+
+	lines := bufio.NewScanner(resp.Body)
+	lines.Buffer(nil, 1024*1024)
+	for lines.Scan() {
+		var entry struct {
+			Version  string `json:"vers"`
+			Checksum string `json:"cksum"`
+		}
+		if json.Unmarshal(lines.Bytes(), &entry) == nil && entry.Version == version {
+			return entry.Checksum, nil
+		}
+	}
+
+	return "", lines.Err()
+}
+
+// crateIndexPath is the path of the index file of crate, e.g. se/rd/serde.
+func crateIndexPath(crate string) string {
+	crate = strings.ToLower(crate)
+
+	switch len(crate) {
+	case 1:
+		return "1/" + crate
+	case 2:
+		return "2/" + crate
+	case 3:
+		return "3/" + crate[:1] + "/" + crate
+	default:
+		return crate[:2] + "/" + crate[2:4] + "/" + crate
+	}
+}
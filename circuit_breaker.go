@@ -0,0 +1,82 @@
+package levee
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var circuitBreakers sync.Map
+
+var errCircuitOpen = errors.New("upstream circuit breaker is open")
+
+type circuitBreaker struct {
+	mutex       sync.Mutex
+	registryURL string
+	failures    int
+	openedAt    time.Time
+	trialActive bool
+}
+
+func upstreamCircuitBreaker(registryURL string) *circuitBreaker {
+	breaker, _ := circuitBreakers.LoadOrStore(registryURL, &circuitBreaker{registryURL: registryURL})
+	return breaker.(*circuitBreaker)
+}
+
+func (breaker *circuitBreaker) allow() bool {
+	current := settings()
+	if current.circuitBreakerThreshold <= 0 {
+		return true
+	}
+
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	if breaker.failures < current.circuitBreakerThreshold {
+		return true
+	}
+
+	if !breaker.trialActive && time.Since(breaker.openedAt) >= current.circuitBreakerCooldown {
+		upstreamLog.infof(nil, "Circuit breaker of %s is half-open, trying a request", breaker.registryURL)
+		breaker.trialActive = true
+		return true
+	}
+
+	return false
+}
+
+func (breaker *circuitBreaker) record(success bool) {
+	threshold := settings().circuitBreakerThreshold
+	if threshold <= 0 {
+		return
+	}
+
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	wasOpen := breaker.failures >= threshold
+	breaker.trialActive = false
+
+	if success {
+		if wasOpen {
+			upstreamLog.infof(nil, "Circuit breaker of %s is closed again", breaker.registryURL)
+		}
+		breaker.failures = 0
+		return
+	}
+
+	breaker.failures++
+	if breaker.failures >= threshold {
+		if !wasOpen {
+			upstreamLog.warnf(nil, "Circuit breaker of %s is open after %d consecutive failures", breaker.registryURL, breaker.failures)
+		}
+		breaker.openedAt = time.Now()
+	}
+}
+
+func (breaker *circuitBreaker) abandon() {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	breaker.trialActive = false
+}
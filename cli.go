@@ -0,0 +1,250 @@
+package levee
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const usage = `usage: levee <command> [flags] [config file]
+
+commands:
+  serve         run the proxy (the default when the arguments start with a flag)
+  check-config  validate the config and exit
+  purge         purge cached documents and tarballs matching a glob pattern
+  stats         print the statistics of a running levee
+  warm          cache the packages listed in a file, one per line
+  bench         replay requests, e.g. from an access log, and report latencies and the hit ratio
+
+flags shared by all commands:
+  -c file       the config file, also accepted as the last argument
+  -set key=val  override a config value (repeatable)
+`
+
+// Run runs the levee command line with args, the arguments after the name of
+// the program.
+func Run(args []string) {
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	command, args := args[0], args[1:]
+	switch command {
+	case "serve":
+		serve(args)
+	case "check-config":
+		checkConfig(args)
+	case "purge":
+		purge(args)
+	case "stats":
+		printStats(args)
+	case "warm":
+		warm(args)
+	case "bench":
+		bench(args)
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+	default:
+		if !strings.HasPrefix(command, "-") {
+			fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", command, usage)
+			os.Exit(2)
+		}
+		serve(append([]string{command}, args...))
+	}
+}
+
+func configFlags(flags *flag.FlagSet, args []string) (string, []string) {
+	var overrides configOverrides
+	flags.Var(&overrides, "set", "override a config value, e.g. -set redis.address=localhost:6379 (repeatable)")
+	configFile := flags.String("c", "", "the config file")
+	flags.Parse(args)
+
+	filename := *configFile
+	if filename == "" && flags.NArg() > 0 {
+		filename = flags.Arg(flags.NArg() - 1)
+	}
+	if filename != "" {
+		filename, _ = filepath.Abs(filename)
+	}
+
+	return filename, overrides
+}
+
+// setUp connects levee to its stores, the cache store is created from config
+// unless store is given.
+func setUp(config Config, store CacheStore) error {
+	var err error
+
+	// The audit log of a previous Server is closed already.
+	downloadAuditLog = nil
+	if store != nil {
+		cacheStore = store
+	} else if cacheStore, err = newCacheStore(config); err != nil {
+		return err
+	}
+	if blobStore, err = newBlobStore(config); err != nil {
+		return err
+	}
+	if downloadAuditLog, err = newDownloadAuditLog(config); err != nil {
+		return err
+	}
+	if registryProtocols, err = configureRepositories(config.Repositories); err != nil {
+		return err
+	}
+
+	return applyRuntimeConfig(config)
+}
+
+// tearDown closes the connections opened by setUp, those of the cache store
+// only when closeCache is set.
+func tearDown(closeCache bool) {
+	if closer, ok := cacheStore.(io.Closer); ok && closeCache {
+		if err := closer.Close(); err != nil {
+			serverLog.errorf(nil, "Failed to close the cache store: %s", err)
+		}
+	}
+	if closer, ok := downloadAuditLog.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			serverLog.errorf(nil, "Failed to close the download audit log: %s", err)
+		}
+	}
+}
+
+func loadAndSetUp(flags *flag.FlagSet, args []string) Config {
+	filename, overrides := configFlags(flags, args)
+
+	config, err := loadConfig(filename, overrides)
+	if err != nil {
+		exitWithError(err)
+	}
+	if err := configureLogging(config.Logging, nil); err != nil {
+		exitWithError(err)
+	}
+	if err := setUp(config, nil); err != nil {
+		exitWithError(err)
+	}
+
+	return config
+}
+
+func commandArgument(flags *flag.FlagSet, name string) string {
+	argumentCount := flags.NArg()
+	if flags.Lookup("c").Value.String() == "" {
+		argumentCount--
+	}
+	if argumentCount < 1 {
+		exitWithError(fmt.Errorf("%s requires a %s", flags.Name(), name))
+	}
+
+	return flags.Arg(0)
+}
+
+func checkConfig(args []string) {
+	flags := flag.NewFlagSet("check-config", flag.ExitOnError)
+	filename, overrides := configFlags(flags, args)
+
+	config, err := loadConfig(filename, overrides)
+	if err == nil {
+		err = applyRuntimeConfig(config)
+	}
+	if err != nil {
+		exitWithError(err)
+	}
+
+	fmt.Printf("%s is valid\n", filename)
+}
+
+func purge(args []string) {
+	flags := flag.NewFlagSet("purge", flag.ExitOnError)
+	loadAndSetUp(flags, args)
+	pattern := commandArgument(flags, "glob pattern")
+
+	purged, err := purgeMatching(pattern)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	fmt.Printf("purged %d cache entries matching %s\n", purged, pattern)
+}
+
+func warm(args []string) {
+	flags := flag.NewFlagSet("warm", flag.ExitOnError)
+	loadAndSetUp(flags, args)
+	packagesFile := commandArgument(flags, "file listing the packages")
+
+	packages, err := readPackageList(packagesFile)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	warmCache(packages)
+}
+
+func printStats(args []string) {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	leveeURL := flags.String("url", "", "the base URL of the running levee, by default its admin listener or port on localhost")
+	filename, overrides := configFlags(flags, args)
+
+	config, err := loadConfig(filename, overrides)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	baseURL := *leveeURL
+	if baseURL == "" {
+		baseURL = adminBaseURL(config)
+	}
+
+	stats, err := fetchStats(baseURL, config.Admin.Token)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	prettyStats, _ := json.MarshalIndent(stats, "", "  ")
+	fmt.Println(string(prettyStats))
+}
+
+func localBaseURL(config Config) string {
+	return "http://localhost:" + config.LeveePort
+}
+
+func adminBaseURL(config Config) string {
+	if config.Admin.Listen != "" {
+		return "http://localhost:" + config.Admin.Listen[strings.LastIndex(config.Admin.Listen, ":")+1:]
+	}
+
+	return localBaseURL(config)
+}
+
+func fetchStats(baseURL string, token string) (map[string]interface{}, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(baseURL, "/")+"/-/levee/stats", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s responded with %d: %s", req.URL, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var stats map[string]interface{}
+	if err := json.Unmarshal(body, &stats); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
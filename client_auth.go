@@ -0,0 +1,73 @@
+package levee
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// clientTokenHeader carries the levee client token, which leaves the
+// Authorization header to the npm tokens of the clients, e.g. for publishing.
+const clientTokenHeader = "X-Levee-Token"
+
+func loadClientTokens(tokens []string, tokensFile string) ([]string, error) {
+	if tokensFile == "" {
+		return tokens, nil
+	}
+
+	fileTokens, err := readPackageList(tokensFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(tokens, fileTokens...), nil
+}
+
+func isClientTokenValid(token string) bool {
+	valid := false
+	for _, clientToken := range settings().clientTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(clientToken)) == 1 {
+			valid = true
+		}
+	}
+
+	return valid
+}
+
+// clientToken returns the levee client token of r, taken from
+// clientTokenHeader or else from a bearer Authorization header.
+func clientToken(r *http.Request) string {
+	if token := r.Header.Get(clientTokenHeader); token != "" {
+		return token
+	}
+
+	return bearerToken(r)
+}
+
+func bearerToken(r *http.Request) string {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return ""
+	}
+
+	return strings.TrimPrefix(authorization, "Bearer ")
+}
+
+// requireClientToken checks the client tokens on every request, so that a
+// reload can turn them on or off.
+func requireClientToken(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
+		if len(settings().clientTokens) == 0 || strings.HasPrefix(r.URL.Path, "/-/levee/") || r.URL.Path == "/-/healthz" || r.URL.Path == "/-/readyz" {
+			handler.ServeHTTP(wr, r)
+			return
+		}
+
+		if token := clientToken(r); token == "" || !isClientTokenValid(token) {
+			wr.Header().Set("WWW-Authenticate", `Bearer realm="levee"`)
+			writeJSON(wr, http.StatusUnauthorized, map[string]string{"error": "authentication required"})
+			return
+		}
+
+		handler.ServeHTTP(wr, r)
+	})
+}
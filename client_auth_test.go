@@ -0,0 +1,29 @@
+package levee
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireClientTokenAfterReload(t *testing.T) {
+	defer currentSettings.Store(&defaultRuntimeSettings)
+
+	handler := requireClientToken(http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {}))
+	get := func() int {
+		wr := httptest.NewRecorder()
+		handler.ServeHTTP(wr, httptest.NewRequest(http.MethodGet, "/lodash", nil))
+		return wr.Code
+	}
+
+	if code := get(); code != http.StatusOK {
+		t.Errorf("Without client tokens the request returned %d", code)
+	}
+
+	withTokens := defaultRuntimeSettings
+	withTokens.clientTokens = []string{"secret"}
+	currentSettings.Store(&withTokens)
+	if code := get(); code != http.StatusUnauthorized {
+		t.Errorf("After client tokens were configured the request returned %d, expected %d", code, http.StatusUnauthorized)
+	}
+}
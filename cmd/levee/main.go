@@ -0,0 +1,11 @@
+package main
+
+import (
+	"os"
+
+	"github.com/kareem-abdelsalam/levee"
+)
+
+func main() {
+	levee.Run(os.Args[1:])
+}
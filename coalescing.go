@@ -0,0 +1,70 @@
+package levee
+
+import (
+	"net/http"
+	"sync"
+)
+
+var cacheFills sync.Map
+
+// cacheFill is the fetch of a key that requests missing the key meanwhile
+// wait for.
+type cacheFill struct {
+	key     string
+	fetched chan struct{}
+	once    sync.Once
+	// shared is what the fetch handed to the waiting requests, nil leaves
+	// them to read the cache.
+	shared interface{}
+}
+
+// share ends the wait of the requests waiting for the fetch as soon as it has
+// read the upstream, rather than after it served its client and filled the
+// cache. They are handed shared, requests missing the key until the fill is
+// released get it right away.
+func (fill *cacheFill) share(shared interface{}) {
+	fill.once.Do(func() {
+		fill.shared = shared
+		if fill.fetched != nil {
+			close(fill.fetched)
+		}
+	})
+}
+
+// release ends the fill once the cache holds what it fetched, or once there
+// is nothing to cache.
+func (fill *cacheFill) release() {
+	fill.share(nil)
+	if fill.key != "" {
+		cacheFills.Delete(fill.key)
+	}
+}
+
+// joinCacheFill coalesces concurrent cache misses of the same key. The first
+// request to miss gets the fill and has to fetch the package, fill the cache
+// and release it. Requests missing the key meanwhile wait for it and are
+// then handed what it shared or read the filled cache, a nil fill means
+// there is nothing left to fetch. They fetch on their own only when the fill
+// left nothing to read, e.g. because the upstream failed or the response is
+// not cacheable.
+func joinCacheFill(r *http.Request, key string, filled func(shared interface{}) bool) (fill *cacheFill, waited bool) {
+	fill = &cacheFill{key: key, fetched: make(chan struct{})}
+	inFlight, loaded := cacheFills.LoadOrStore(key, fill)
+	if !loaded {
+		return fill, false
+	}
+
+	cacheLog.debugf(r, "Waiting for the in-flight fetch of %s", r.URL.Path)
+	leader := inFlight.(*cacheFill)
+	select {
+	case <-leader.fetched:
+	case <-r.Context().Done():
+		return &cacheFill{}, true
+	}
+
+	if filled(leader.shared) {
+		return nil, true
+	}
+
+	return &cacheFill{}, true
+}
@@ -0,0 +1,29 @@
+package levee
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCacheFillSharesBeforeRelease(t *testing.T) {
+	r := httptest.NewRequest("GET", "/lodash", nil)
+	fill, _ := joinCacheFill(r, "lodash", nil)
+	defer fill.release()
+
+	handed := make(chan interface{}, 1)
+	go joinCacheFill(r, "lodash", func(shared interface{}) bool {
+		handed <- shared
+		return true
+	})
+
+	fill.share("the document")
+	select {
+	case shared := <-handed:
+		if shared != "the document" {
+			t.Errorf("The waiting request was handed %v", shared)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The waiting request wasn't handed the document before the fill was released")
+	}
+}
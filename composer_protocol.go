@@ -0,0 +1,105 @@
+package levee
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// composerProtocol serves a Composer repository like Packagist: packages.json,
+// the Composer 2 metadata below /p2/ and the Composer 1 provider files. The
+// dist URLs of the metadata are rewritten to go through levee, so that the
+// archives of a version are kept for good.
+type composerProtocol struct {
+	*repository
+}
+
+func newComposerProtocol(repo *repository) RegistryProtocol {
+	return composerProtocol{repository: repo}
+}
+
+func (composerProtocol) Name() string {
+	return "composer"
+}
+
+func (protocol composerProtocol) RegisterRoutes(router *mux.Router) {
+	routes := protocol.routes(router, protocol)
+	metadata := protocol.metadataProxy(protocol)
+	// Provider files are named by the hash of their content.
+	providers := withProtocol(protocol, func(wr http.ResponseWriter, r *http.Request) {
+		cachedProxy(wr, r, CachePolicy{Pattern: protocol.prefix})
+	})
+
+	routes.HandleFunc("/packages.json", metadata).Methods("GET", "HEAD")
+	routes.HandleFunc("/p2/{vendor}/{package}.json", metadata).Methods("GET", "HEAD")
+	routes.HandleFunc("/{file:.+}", func(wr http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "$") {
+			providers(wr, r)
+		} else {
+			metadata(wr, r)
+		}
+	}).Methods("GET", "HEAD")
+}
+
+func (protocol composerProtocol) CacheKey(r *http.Request) string {
+	return cacheKey(r.URL.Path)
+}
+
+func (protocol composerProtocol) Fetch(r *http.Request) (*http.Response, error) {
+	return protocol.fetch(r)
+}
+
+// RewriteResponse points the URLs of packages.json and the dist URLs of the
+// Composer 2 metadata at levee. Provider files are left as they are, Composer
+// 1 checks them against the hashes of the provider includes.
+func (protocol composerProtocol) RewriteResponse(r *http.Request, resp *http.Response) error {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/packages.json"):
+		if err := protocol.rewriteRootURLs(resp); err != nil {
+			return err
+		}
+		return protocol.rewriteLinks(r, resp)
+	case strings.Contains(r.URL.Path, "/p2/"):
+		return protocol.rewriteLinks(r, resp)
+	default:
+		return nil
+	}
+}
+
+// rewriteRootURLs prefixes the URLs of packages.json relative to the root of
+// the upstream host, like metadata-url, with the prefix of the repository,
+// Composer would look for them at the root of levee otherwise.
+func (protocol composerProtocol) rewriteRootURLs(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	var rewriteErr error
+	err := rewriteBody(resp, func(body []byte) []byte {
+		var document map[string]json.RawMessage
+		if rewriteErr = json.Unmarshal(body, &document); rewriteErr != nil {
+			return body
+		}
+
+		for name, value := range document {
+			var url string
+			if !strings.HasSuffix(name, "-url") || json.Unmarshal(value, &url) != nil || !strings.HasPrefix(url, "/") || strings.HasPrefix(url, "//") {
+				continue
+			}
+			document[name], _ = json.Marshal(protocol.prefix + url)
+		}
+
+		var rewritten []byte
+		if rewritten, rewriteErr = json.Marshal(document); rewriteErr != nil {
+			return body
+		}
+		return rewritten
+	})
+	if err != nil {
+		return err
+	}
+
+	return rewriteErr
+}
@@ -0,0 +1,50 @@
+package levee
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func newCacheCompressor(cached io.Writer) (io.WriteCloser, string, error) {
+	switch settings().cacheCompression {
+	case "", "none":
+		return nopWriteCloser{cached}, "", nil
+	case "gzip":
+		return gzip.NewWriter(cached), "gzip", nil
+	default:
+		return nil, "", fmt.Errorf("unknown cache compression %q", settings().cacheCompression)
+	}
+}
+
+func decompressCachedBody(body string, encoding string) (string, error) {
+	switch encoding {
+	case "":
+		return body, nil
+	case "gzip":
+		reader, err := gzip.NewReader(bytes.NewReader([]byte(body)))
+		if err != nil {
+			return "", err
+		}
+		defer reader.Close()
+
+		decompressed, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return "", err
+		}
+
+		return string(decompressed), nil
+	default:
+		return "", fmt.Errorf("unknown cached body encoding %q", encoding)
+	}
+}
@@ -0,0 +1,438 @@
+package levee
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+func loadConfig(filename string, overrides []string) (Config, error) {
+	var config Config
+
+	if filename == "" {
+		return config, errors.New("no config file given, usage: levee serve -c config.yml|config.json|config.toml")
+	}
+
+	document, err := readConfigDocument(filename, map[string]bool{})
+	if err != nil {
+		return config, err
+	}
+
+	yamlDocument, err := yaml.Marshal(document)
+	if err != nil {
+		return config, err
+	}
+	if err := yaml.UnmarshalStrict(yamlDocument, &config); err != nil {
+		return config, fmt.Errorf("invalid config in %s or its includes: %s", filename, err)
+	}
+
+	if err := applyConfigOverrides(&config, overrides); err != nil {
+		return config, err
+	}
+
+	if err := config.readSecretFiles(); err != nil {
+		return config, err
+	}
+
+	config.applyDefaults()
+	return config, config.validate()
+}
+
+func readConfigDocument(filename string, included map[string]bool) (map[string]interface{}, error) {
+	if included[filename] {
+		return nil, fmt.Errorf("%s includes itself", filename)
+	}
+	included[filename] = true
+	defer delete(included, filename)
+
+	configFile, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the config file: %s", err)
+	}
+
+	document, err := decodeConfigDocument(filename, configFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse the config file %s: %s", filename, err)
+	}
+
+	if err := interpolateEnv(document); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+
+	var includes []string
+	switch include := document["include"].(type) {
+	case nil:
+	case string:
+		includes = []string{include}
+	case []interface{}:
+		for _, includeFile := range include {
+			includes = append(includes, fmt.Sprint(includeFile))
+		}
+	default:
+		return nil, fmt.Errorf("%s: include must be a file name or a list of file names", filename)
+	}
+	delete(document, "include")
+
+	merged := map[string]interface{}{}
+	for _, includeFile := range includes {
+		if !filepath.IsAbs(includeFile) {
+			includeFile = filepath.Join(filepath.Dir(filename), includeFile)
+		}
+
+		includedDocument, err := readConfigDocument(includeFile, included)
+		if err != nil {
+			return nil, err
+		}
+		merged = mergeConfigDocuments(merged, includedDocument)
+	}
+
+	return mergeConfigDocuments(merged, document), nil
+}
+
+// mergeConfigDocuments merges override into base: maps are merged key by
+// key, lists are concatenated and any other value in override replaces the
+// one in base.
+func mergeConfigDocuments(base map[string]interface{}, override map[string]interface{}) map[string]interface{} {
+	for key, value := range override {
+		switch value := value.(type) {
+		case map[string]interface{}:
+			if baseValue, ok := base[key].(map[string]interface{}); ok {
+				base[key] = mergeConfigDocuments(baseValue, value)
+				continue
+			}
+		case []interface{}:
+			if baseValue, ok := base[key].([]interface{}); ok {
+				base[key] = append(baseValue, value...)
+				continue
+			}
+		}
+
+		base[key] = value
+	}
+
+	return base
+}
+
+// envReference matches ${NAME}, and $${NAME} which stands for the literal
+// ${NAME}.
+var envReference = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// interpolateEnv replaces the references to environment variables in the
+// string values of a parsed config document. Interpolating the parsed values
+// instead of the file keeps a variable from changing the structure of the
+// document, whatever characters its value contains.
+func interpolateEnv(document map[string]interface{}) error {
+	var missing []string
+	interpolateEnvValues(document, &missing)
+
+	if len(missing) > 0 {
+		return fmt.Errorf("the config references unset environment variables: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+func interpolateEnvValues(value interface{}, missing *[]string) interface{} {
+	switch value := value.(type) {
+	case string:
+		return envReference.ReplaceAllStringFunc(value, func(reference string) string {
+			if strings.HasPrefix(reference, "$$") {
+				return reference[1:]
+			}
+
+			name := envReference.FindStringSubmatch(reference)[1]
+			envValue, found := os.LookupEnv(name)
+			if !found {
+				*missing = append(*missing, name)
+			}
+			return envValue
+		})
+	case map[string]interface{}:
+		for key, item := range value {
+			value[key] = interpolateEnvValues(item, missing)
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = interpolateEnvValues(item, missing)
+		}
+	case []map[string]interface{}:
+		for _, item := range value {
+			interpolateEnvValues(item, missing)
+		}
+	}
+
+	return value
+}
+
+func readSecretFile(field string, filename string) (string, error) {
+	secret, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", field, err)
+	}
+
+	return strings.TrimSpace(string(secret)), nil
+}
+
+func (config *Config) readSecretFiles() error {
+	var err error
+
+	if config.Redis.PasswordFile != "" {
+		if config.Redis.Password, err = readSecretFile("redis.passwordFile", config.Redis.PasswordFile); err != nil {
+			return err
+		}
+	}
+
+	registryLists := map[string][]Registry{"internalRegistries": config.InternalRegistries, "externalRegistries": config.ExternalRegistries}
+	for i, group := range config.UpstreamGroups {
+		registryLists[fmt.Sprintf("upstreamGroups[%d].registries", i)] = group.Registries
+	}
+
+	for field, registries := range registryLists {
+		for i := range registries {
+			if registries[i].TokenFile == "" {
+				continue
+			}
+			if registries[i].Token, err = readSecretFile(fmt.Sprintf("%s[%d].tokenFile", field, i), registries[i].TokenFile); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func decodeConfigDocument(filename string, configFile []byte) (map[string]interface{}, error) {
+	var document map[string]interface{}
+
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".toml":
+		if err := toml.Unmarshal(configFile, &document); err != nil {
+			return nil, err
+		}
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(configFile))
+		decoder.UseNumber()
+
+		if err := decoder.Decode(&document); err != nil {
+			return nil, err
+		}
+		normalizeJSONNumbers(document)
+	default:
+		var yamlDocument map[interface{}]interface{}
+		if err := yaml.Unmarshal(configFile, &yamlDocument); err != nil {
+			return nil, err
+		}
+		document, _ = normalizeYAMLMaps(yamlDocument).(map[string]interface{})
+	}
+
+	if document == nil {
+		document = map[string]interface{}{}
+	}
+
+	return document, nil
+}
+
+func normalizeYAMLMaps(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		normalized := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			normalized[fmt.Sprint(key)] = normalizeYAMLMaps(item)
+		}
+		return normalized
+	case []interface{}:
+		for i, item := range value {
+			value[i] = normalizeYAMLMaps(item)
+		}
+	}
+
+	return value
+}
+
+func normalizeJSONNumbers(value interface{}) interface{} {
+	switch value := value.(type) {
+	case json.Number:
+		if integer, err := value.Int64(); err == nil {
+			return integer
+		}
+		float, _ := value.Float64()
+		return float
+	case map[string]interface{}:
+		for key, item := range value {
+			value[key] = normalizeJSONNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = normalizeJSONNumbers(item)
+		}
+	}
+
+	return value
+}
+
+func (config *Config) applyDefaults() {
+	if config.LeveePort == "" {
+		config.LeveePort = "1971"
+	}
+	if config.ShutdownTimeout <= 0 {
+		config.ShutdownTimeout = 30 * time.Second
+	}
+	if config.Server.ReadHeaderTimeout <= 0 {
+		config.Server.ReadHeaderTimeout = 10 * time.Second
+	}
+	if config.CircuitBreaker.Cooldown <= 0 {
+		config.CircuitBreaker.Cooldown = 30 * time.Second
+	}
+	if config.HealthCheck.Path == "" {
+		config.HealthCheck.Path = "/-/ping"
+	}
+	if config.HealthCheck.Timeout <= 0 {
+		config.HealthCheck.Timeout = 5 * time.Second
+	}
+}
+
+func validateURL(field string, rawURL string) error {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("%s: %q is not a valid URL: %s", field, rawURL, err)
+	}
+	if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" || parsedURL.Host == "" {
+		return fmt.Errorf("%s: %q must be an absolute http or https URL, e.g. https://registry.npmjs.org", field, rawURL)
+	}
+
+	return nil
+}
+
+// validateRegistryTLS loads the CA bundle and client certificate of a
+// registry, so that a registry that can't be reached over TLS fails the
+// config instead of its requests.
+func validateRegistryTLS(field string, registry Registry) error {
+	if _, err := registry.tlsConfig(); err != nil {
+		return fmt.Errorf("%s.tls: %s", field, err)
+	}
+
+	return nil
+}
+
+func (config Config) validate() error {
+	var problems []string
+	check := func(err error) {
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if port, err := strconv.Atoi(config.LeveePort); err != nil || port < 1 || port > 65535 {
+		check(fmt.Errorf("leveePort: %q must be a port number between 1 and 65535", config.LeveePort))
+	}
+
+	if len(config.InternalRegistries) == 0 && len(config.ExternalRegistries) == 0 && len(config.UpstreamGroups) == 0 && len(config.Repositories) == 0 && !config.Offline {
+		check(errors.New("internalRegistries, externalRegistries: at least one registry is required unless levee runs offline or serves repositories"))
+	}
+	for i, registry := range config.InternalRegistries {
+		check(validateURL(fmt.Sprintf("internalRegistries[%d]", i), registry.URL))
+		check(validateRegistryTLS(fmt.Sprintf("internalRegistries[%d]", i), registry))
+	}
+	for i, registry := range config.ExternalRegistries {
+		check(validateURL(fmt.Sprintf("externalRegistries[%d]", i), registry.URL))
+		check(validateRegistryTLS(fmt.Sprintf("externalRegistries[%d]", i), registry))
+	}
+	for i, group := range config.UpstreamGroups {
+		for j, registry := range group.Registries {
+			check(validateURL(fmt.Sprintf("upstreamGroups[%d].registries[%d]", i, j), registry.URL))
+			check(validateRegistryTLS(fmt.Sprintf("upstreamGroups[%d].registries[%d]", i, j), registry))
+		}
+	}
+	if config.ExternalProxy != "" {
+		check(validateURL("externalProxy", config.ExternalProxy))
+	}
+	if config.PublicURL != "" {
+		check(validateURL("publicURL", config.PublicURL))
+	}
+
+	for _, err := range validateRepositories(config.Repositories) {
+		check(err)
+	}
+
+	if (config.TLS.CertFile == "") != (config.TLS.KeyFile == "") {
+		check(errors.New("tls: certFile and keyFile must be set together"))
+	}
+
+	switch config.Cache.Type {
+	case "", "redis", "memory", "tiered":
+	case "s3":
+		if config.Cache.Bucket == "" {
+			check(errors.New("cache.bucket: required by the s3 cache"))
+		}
+	default:
+		check(fmt.Errorf("cache.type: %q is unknown, expected redis, memory, tiered or s3", config.Cache.Type))
+	}
+
+	switch config.Cache.Compression {
+	case "", "none", "gzip":
+	default:
+		check(fmt.Errorf("cache.compression: %q is unknown, expected none or gzip", config.Cache.Compression))
+	}
+
+	if config.Cache.MinTTL < 0 || config.Cache.MaxTTL < 0 {
+		check(errors.New("cache.minTTL, cache.maxTTL: must not be negative"))
+	}
+	if config.Cache.MinTTL > 0 && config.Cache.MaxTTL > 0 && config.Cache.MinTTL > config.Cache.MaxTTL {
+		check(fmt.Errorf("cache.minTTL: %s is longer than cache.maxTTL %s", config.Cache.MinTTL, config.Cache.MaxTTL))
+	}
+	for i, policy := range config.CachePolicies {
+		if policy.Pattern == "" {
+			check(fmt.Errorf("cachePolicies[%d].pattern: required", i))
+		}
+		if policy.TTL < 0 || policy.SoftTTL < 0 {
+			check(fmt.Errorf("cachePolicies[%d]: ttl and softTTL must not be negative", i))
+		}
+	}
+
+	for _, statusCode := range config.Cache.CacheableStatuses {
+		if statusCode < 200 || statusCode >= 500 || statusCode == http.StatusNotModified {
+			check(fmt.Errorf("cache.cacheableStatuses: %d cannot be cached, only 2xx, 3xx and 4xx responses other than 304 can", statusCode))
+		}
+	}
+
+	if config.Cache.MaxObjectSize < 0 || config.Cache.Blobs.MaxObjectSize < 0 {
+		check(errors.New("cache.maxObjectSize, cache.blobs.maxObjectSize: must not be negative"))
+	}
+
+	if config.UpstreamConnections.MaxConcurrent < 0 {
+		check(errors.New("upstreamConnections.maxConcurrent: must not be negative"))
+	}
+
+	check(validateMiddlewareOrder(config.Middlewares))
+
+	if config.Retry.MaxAttempts < 0 {
+		check(errors.New("retry.maxAttempts: must not be negative"))
+	}
+	if config.RateLimit.RequestsPerSecond < 0 {
+		check(errors.New("rateLimit.requestsPerSecond: must not be negative"))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  - %s", strings.Join(problems, "\n  - "))
+	}
+
+	return nil
+}
+
+func exitWithError(err error) {
+	fmt.Fprintf(os.Stderr, "levee: %s\n", err)
+	os.Exit(1)
+}
@@ -0,0 +1,137 @@
+package levee
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"gopkg.in/yaml.v2"
+)
+
+const envPrefix = "LEVEE_"
+
+type configOverrides []string
+
+func (overrides *configOverrides) String() string {
+	return strings.Join(*overrides, ",")
+}
+
+func (overrides *configOverrides) Set(override string) error {
+	if !strings.Contains(override, "=") {
+		return fmt.Errorf("expected key=value, got %q", override)
+	}
+
+	*overrides = append(*overrides, override)
+	return nil
+}
+
+func yamlFieldName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+	if name == "" || name == "-" {
+		return ""
+	}
+
+	return name
+}
+
+func envName(key string) string {
+	var name strings.Builder
+	name.WriteString(envPrefix)
+
+	for i, character := range key {
+		switch {
+		case character == '.':
+			name.WriteRune('_')
+		case unicode.IsUpper(character) && i > 0 && key[i-1] != '.' && !unicode.IsUpper(rune(key[i-1])):
+			name.WriteRune('_')
+			name.WriteRune(character)
+		default:
+			name.WriteRune(unicode.ToUpper(character))
+		}
+	}
+
+	return name.String()
+}
+
+func configKeys(configType reflect.Type, prefix string) []string {
+	var keys []string
+
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		name := yamlFieldName(field)
+		if name == "" {
+			continue
+		}
+
+		if field.Type.Kind() == reflect.Struct {
+			keys = append(keys, configKeys(field.Type, prefix+name+".")...)
+		} else {
+			keys = append(keys, prefix+name)
+		}
+	}
+
+	return keys
+}
+
+func configField(config reflect.Value, key string) (reflect.Value, bool) {
+	for _, name := range strings.Split(key, ".") {
+		if config.Kind() != reflect.Struct {
+			return reflect.Value{}, false
+		}
+
+		found := false
+		for i := 0; i < config.NumField(); i++ {
+			if yamlFieldName(config.Type().Field(i)) == name {
+				config = config.Field(i)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return reflect.Value{}, false
+		}
+	}
+
+	return config, true
+}
+
+func setConfigValue(config *Config, key string, value string) error {
+	field, found := configField(reflect.ValueOf(config).Elem(), key)
+	if !found {
+		return fmt.Errorf("unknown config key %q", key)
+	}
+
+	if field.Kind() == reflect.String {
+		field.SetString(value)
+		return nil
+	}
+
+	if err := yaml.Unmarshal([]byte(value), field.Addr().Interface()); err != nil {
+		return fmt.Errorf("invalid value for %s: %s", key, err)
+	}
+
+	return nil
+}
+
+// applyConfigOverrides layers LEVEE_* environment variables and then -set
+// flags over the values read from the config file.
+func applyConfigOverrides(config *Config, flagOverrides []string) error {
+	for _, key := range configKeys(reflect.TypeOf(*config), "") {
+		if value, found := os.LookupEnv(envName(key)); found {
+			if err := setConfigValue(config, key, value); err != nil {
+				return fmt.Errorf("%s: %s", envName(key), err)
+			}
+		}
+	}
+
+	for _, override := range flagOverrides {
+		keyValue := strings.SplitN(override, "=", 2)
+		if err := setConfigValue(config, keyValue[0], keyValue[1]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
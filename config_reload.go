@@ -0,0 +1,77 @@
+package levee
+
+import (
+	"crypto/sha256"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+type ReloadConfig struct {
+	Interval time.Duration `yaml:"interval"`
+}
+
+func configFingerprint(filename string) ([32]byte, error) {
+	document, err := readConfigDocument(filename, map[string]bool{})
+	if err != nil {
+		return [32]byte{}, err
+	}
+
+	yamlDocument, err := yaml.Marshal(document)
+	if err != nil {
+		return [32]byte{}, err
+	}
+
+	return sha256.Sum256(yamlDocument), nil
+}
+
+func reloadConfig(filename string, overrides []string) {
+	config, err := loadConfig(filename, overrides)
+	if err == nil {
+		err = applyRuntimeConfig(config)
+	}
+	if err != nil {
+		serverLog.errorf(nil, "Keeping the current config, the new one is invalid: %s", err)
+		return
+	}
+
+	resetRegistryClients()
+	resetUpstreamSlots()
+
+	serverLog.infof(nil, "Reloaded the config from %s, listener, TLS, cache backend, logging, address filter, CORS and rate limit changes apply after a restart", filename)
+}
+
+// watchConfig reloads the config on SIGHUP and, when an interval is given,
+// whenever the content behind the config file changes. Polling the content
+// instead of watching the file catches the symlink swaps Kubernetes does
+// when a mounted ConfigMap is updated.
+func watchConfig(filename string, overrides []string, interval time.Duration) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	var ticks <-chan time.Time
+	if interval > 0 {
+		ticks = time.NewTicker(interval).C
+	}
+
+	fingerprint, _ := configFingerprint(filename)
+
+	for {
+		select {
+		case <-hangups:
+			serverLog.infof(nil, "Received SIGHUP, reloading the config")
+		case <-ticks:
+			newFingerprint, err := configFingerprint(filename)
+			if err != nil || newFingerprint == fingerprint {
+				continue
+			}
+			serverLog.infof(nil, "The config file %s has changed, reloading it", filename)
+		}
+
+		fingerprint, _ = configFingerprint(filename)
+		reloadConfig(filename, overrides)
+	}
+}
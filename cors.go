@@ -0,0 +1,63 @@
+package levee
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type CORSConfig struct {
+	AllowedOrigins []string      `yaml:"allowedOrigins"`
+	AllowedHeaders []string      `yaml:"allowedHeaders"`
+	AllowedMethods []string      `yaml:"allowedMethods"`
+	MaxAge         time.Duration `yaml:"maxAge"`
+}
+
+func (cors CORSConfig) allowsOrigin(origin string) bool {
+	for _, allowedOrigin := range cors.AllowedOrigins {
+		if allowedOrigin == "*" || strings.EqualFold(allowedOrigin, origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func handleCORS(handler http.Handler, cors CORSConfig) http.Handler {
+	if len(cors.AllowedOrigins) == 0 {
+		return handler
+	}
+
+	allowedMethods := cors.AllowedMethods
+	if len(allowedMethods) == 0 {
+		allowedMethods = []string{http.MethodGet, http.MethodHead}
+	}
+
+	return http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !cors.allowsOrigin(origin) {
+			handler.ServeHTTP(wr, r)
+			return
+		}
+
+		wr.Header().Set("Access-Control-Allow-Origin", origin)
+		wr.Header().Add("Vary", "Origin")
+
+		if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+			handler.ServeHTTP(wr, r)
+			return
+		}
+
+		wr.Header().Set("Access-Control-Allow-Methods", strings.Join(allowedMethods, ", "))
+		if len(cors.AllowedHeaders) > 0 {
+			wr.Header().Set("Access-Control-Allow-Headers", strings.Join(cors.AllowedHeaders, ", "))
+		} else if requestedHeaders := r.Header.Get("Access-Control-Request-Headers"); requestedHeaders != "" {
+			wr.Header().Set("Access-Control-Allow-Headers", requestedHeaders)
+		}
+		if cors.MaxAge > 0 {
+			wr.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(cors.MaxAge.Seconds())))
+		}
+		wr.WriteHeader(http.StatusNoContent)
+	})
+}
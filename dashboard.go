@@ -0,0 +1,125 @@
+package levee
+
+import (
+	_ "embed"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed dashboard/index.html
+var dashboardHTML []byte
+
+type recentRequest struct {
+	Time     string `json:"time"`
+	Method   string `json:"method"`
+	Path     string `json:"path"`
+	Status   int    `json:"status"`
+	Cache    string `json:"cache,omitempty"`
+	Duration string `json:"duration"`
+}
+
+const recentRequestsSize = 100
+
+var recentRequests = struct {
+	sync.Mutex
+	requests []recentRequest
+	next     int
+}{}
+
+func recordRecentRequest(request recentRequest) {
+	recentRequests.Lock()
+	defer recentRequests.Unlock()
+
+	if len(recentRequests.requests) < recentRequestsSize {
+		recentRequests.requests = append(recentRequests.requests, request)
+		return
+	}
+
+	recentRequests.requests[recentRequests.next] = request
+	recentRequests.next = (recentRequests.next + 1) % recentRequestsSize
+}
+
+func dashboard(wr http.ResponseWriter, r *http.Request) {
+	if settings().adminToken == "" {
+		http.NotFound(wr, r)
+		return
+	}
+
+	wr.Header().Set("Content-Type", "text/html; charset=utf-8")
+	wr.Write(dashboardHTML)
+}
+
+func listRecentRequests(wr http.ResponseWriter, r *http.Request) {
+	recentRequests.Lock()
+	requests := make([]recentRequest, 0, len(recentRequests.requests))
+	for i := range recentRequests.requests {
+		index := (recentRequests.next - 1 - i + 2*len(recentRequests.requests)) % len(recentRequests.requests)
+		requests = append(requests, recentRequests.requests[index])
+	}
+	recentRequests.Unlock()
+
+	writeJSON(wr, http.StatusOK, map[string]interface{}{"requests": requests})
+}
+
+func listUpstreams(wr http.ResponseWriter, r *http.Request) {
+	current := settings()
+	type upstreamStatus struct {
+		URL      string `json:"url"`
+		External bool   `json:"external"`
+		Healthy  bool   `json:"healthy"`
+		upstreamCounters
+	}
+
+	proxyStats.Lock()
+	upstreams := make([]upstreamStatus, 0, len(current.internalRegistries)+len(current.externalRegistries))
+	for _, registry := range allRegistries() {
+		status := upstreamStatus{URL: registry.URL, External: registry.external, Healthy: isUpstreamHealthy(registry.URL)}
+		if counters, ok := proxyStats.upstreams[registry.URL]; ok {
+			status.upstreamCounters = *counters
+		}
+		upstreams = append(upstreams, status)
+	}
+	proxyStats.Unlock()
+
+	writeJSON(wr, http.StatusOK, map[string]interface{}{"upstreams": upstreams})
+}
+
+func listCachedDocuments(wr http.ResponseWriter, r *http.Request) {
+	keys, err := cacheStore.Keys(cacheKey("/" + strings.TrimPrefix(r.URL.Query().Get("prefix"), "/")))
+	if err != nil {
+		writeJSON(wr, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	documents := make([]string, 0, len(keys))
+	for _, key := range keys {
+		documents = append(documents, strings.TrimPrefix(key, settings().cacheKeyPrefix))
+	}
+	sort.Strings(documents)
+	if len(documents) > 500 {
+		documents = documents[:500]
+	}
+
+	writeJSON(wr, http.StatusOK, map[string]interface{}{"documents": documents, "total": len(keys)})
+}
+
+func recentRequestFrom(r *http.Request, start time.Time, statusCode int) recentRequest {
+	request := recentRequest{
+		Time:     start.UTC().Format(time.RFC3339),
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Status:   statusCode,
+		Duration: time.Since(start).Round(time.Millisecond).String(),
+	}
+
+	for _, attr := range requestLogAttrs(r) {
+		if attr.Key == "cache" {
+			request.Cache = attr.Value.String()
+		}
+	}
+
+	return request
+}
@@ -0,0 +1,67 @@
+package levee
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+func invalidatePackageMetadata(packageName string) {
+	packagePath := "/" + packageName
+
+	cacheStore.Delete(cacheKey(packagePath))
+	cacheStore.Delete(cacheKey(packagePath) + abbreviatedMetadataSuffix)
+	cacheLog.infof(nil, "Invalidated the cached metadata of %s", packageName)
+}
+
+func packageNameFromVars(r *http.Request) string {
+	vars := mux.Vars(r)
+	if vars["scope"] != "" {
+		return vars["scope"] + "/" + vars["package"]
+	}
+
+	return vars["package"]
+}
+
+func distTagsProxy(wr http.ResponseWriter, r *http.Request) {
+	proxyLog.debugf(r, "A dist-tags request handling for %s %s", r.Method, r.URL.Path)
+
+	if r.Method == http.MethodGet {
+		distTags(wr, r)
+		return
+	}
+
+	statusCode := passthrough(wr, r, settings().internalRegistries)
+	if statusCode >= 200 && statusCode < 300 {
+		invalidatePackageMetadata(packageNameFromVars(r))
+	}
+}
+
+// distTags reads the dist-tags of a package from the registries it is routed
+// to, an internal registry without the package leaves them to the next one.
+func distTags(wr http.ResponseWriter, r *http.Request) {
+	resp, err := fetchRoutedPackage(r, packageNameFromVars(r))
+	if err == errOffline {
+		http.Error(wr, err.Error(), http.StatusGatewayTimeout)
+		return
+	} else if err == errPackageNotFound {
+		writeJSON(wr, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	} else if err == errUpstreamBusy {
+		wr.Header().Set("Retry-After", "1")
+		http.Error(wr, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		upstreamLog.errorf(r, "All registries failed to respond to %s %s: %s", r.Method, r.URL.Path, err)
+		http.Error(wr, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for k, v := range resp.Header {
+		wr.Header().Set(k, v[0])
+	}
+	wr.WriteHeader(resp.StatusCode)
+	io.Copy(wr, resp.Body)
+}
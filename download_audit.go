@@ -0,0 +1,295 @@
+package levee
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+type DownloadAuditConfig struct {
+	Type      string `yaml:"type"`
+	File      string `yaml:"file"`
+	Stream    string `yaml:"stream"`
+	MaxLength int64  `yaml:"maxLength"`
+}
+
+type downloadRecord struct {
+	Time     time.Time `json:"time"`
+	Package  string    `json:"package"`
+	Version  string    `json:"version"`
+	Client   string    `json:"client"`
+	Identity string    `json:"identity,omitempty"`
+	Status   int       `json:"status"`
+}
+
+type downloadQuery struct {
+	Package  string
+	Version  string
+	Identity string
+	Since    time.Time
+	Limit    int
+}
+
+type DownloadAuditLog interface {
+	Record(record downloadRecord) error
+	Query(query downloadQuery) ([]downloadRecord, error)
+}
+
+var downloadAuditLog DownloadAuditLog
+
+func newDownloadAuditLog(config Config) (DownloadAuditLog, error) {
+	switch config.DownloadAudit.Type {
+	case "":
+		return nil, nil
+	case "file":
+		if config.DownloadAudit.File == "" {
+			return nil, fmt.Errorf("the file download audit log requires a file")
+		}
+		return &fileDownloadAuditLog{filename: config.DownloadAudit.File}, nil
+	case "redis":
+		stream := config.DownloadAudit.Stream
+		if stream == "" {
+			stream = config.CacheKeyPrefix + "downloads"
+		}
+		return &redisDownloadAuditLog{client: newRedisClient(config), stream: stream, maxLength: config.DownloadAudit.MaxLength}, nil
+	default:
+		return nil, fmt.Errorf("unknown download audit log type %q", config.DownloadAudit.Type)
+	}
+}
+
+func (query downloadQuery) matches(record downloadRecord) bool {
+	return (query.Package == "" || query.Package == record.Package) &&
+		(query.Version == "" || query.Version == record.Version) &&
+		(query.Identity == "" || query.Identity == record.Identity) &&
+		!record.Time.Before(query.Since)
+}
+
+type fileDownloadAuditLog struct {
+	mutex    sync.Mutex
+	filename string
+}
+
+func (auditLog *fileDownloadAuditLog) Record(record downloadRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	auditLog.mutex.Lock()
+	defer auditLog.mutex.Unlock()
+
+	file, err := os.OpenFile(auditLog.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// Query scans the file without holding off Record, only up to the size it
+// had when it was opened, so it never reads a record being appended.
+func (auditLog *fileDownloadAuditLog) Query(query downloadQuery) ([]downloadRecord, error) {
+	file, err := os.Open(auditLog.filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var records []downloadRecord
+	scanner := bufio.NewScanner(io.LimitReader(file, info.Size()))
+	for scanner.Scan() {
+		var record downloadRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err == nil && query.matches(record) {
+			records = append(records, record)
+		}
+	}
+
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	if len(records) > query.Limit {
+		records = records[:query.Limit]
+	}
+
+	return records, scanner.Err()
+}
+
+type redisDownloadAuditLog struct {
+	client    redis.UniversalClient
+	stream    string
+	maxLength int64
+}
+
+func (auditLog *redisDownloadAuditLog) Record(record downloadRecord) error {
+	return auditLog.client.XAdd(&redis.XAddArgs{
+		Stream:       auditLog.stream,
+		MaxLenApprox: auditLog.maxLength,
+		Values: map[string]interface{}{
+			"time":     record.Time.Format(time.RFC3339Nano),
+			"package":  record.Package,
+			"version":  record.Version,
+			"client":   record.Client,
+			"identity": record.Identity,
+			"status":   record.Status,
+		},
+	}).Err()
+}
+
+func (auditLog *redisDownloadAuditLog) Close() error {
+	return auditLog.client.Close()
+}
+
+func (auditLog *redisDownloadAuditLog) Query(query downloadQuery) ([]downloadRecord, error) {
+	start := "-"
+	if !query.Since.IsZero() {
+		start = strconv.FormatInt(query.Since.UnixNano()/int64(time.Millisecond), 10)
+	}
+
+	messages, err := auditLog.client.XRevRangeN(auditLog.stream, "+", start, 10000).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var records []downloadRecord
+	for _, message := range messages {
+		record := downloadRecord{
+			Package:  fmt.Sprint(message.Values["package"]),
+			Version:  fmt.Sprint(message.Values["version"]),
+			Client:   fmt.Sprint(message.Values["client"]),
+			Identity: fmt.Sprint(message.Values["identity"]),
+		}
+		record.Time, _ = time.Parse(time.RFC3339Nano, fmt.Sprint(message.Values["time"]))
+		record.Status, _ = strconv.Atoi(fmt.Sprint(message.Values["status"]))
+
+		if query.matches(record) {
+			records = append(records, record)
+		}
+		if len(records) == query.Limit {
+			break
+		}
+	}
+
+	return records, nil
+}
+
+func clientIdentity(r *http.Request) string {
+	if username, _, ok := r.BasicAuth(); ok {
+		return "user:" + username
+	}
+
+	if token := clientToken(r); token != "" {
+		tokenHash := sha256.Sum256([]byte(token))
+		return "token:" + hex.EncodeToString(tokenHash[:])[:16]
+	}
+
+	return ""
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode   int
+	bytesWritten int64
+}
+
+func (recorder *statusRecorder) WriteHeader(statusCode int) {
+	recorder.statusCode = statusCode
+	recorder.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (recorder *statusRecorder) Write(body []byte) (int, error) {
+	written, err := recorder.ResponseWriter.Write(body)
+	recorder.bytesWritten += int64(written)
+	return written, err
+}
+
+// Flush lets tarballs be streamed through the recorder.
+func (recorder *statusRecorder) Flush() {
+	if flusher, ok := recorder.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the writer of the server.
+func (recorder *statusRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
+
+func recordDownloads(handler http.HandlerFunc) http.HandlerFunc {
+	return func(wr http.ResponseWriter, r *http.Request) {
+		if downloadAuditLog == nil || r.Method != http.MethodGet {
+			handler(wr, r)
+			return
+		}
+
+		recorder := &statusRecorder{ResponseWriter: wr, statusCode: http.StatusOK}
+		handler(recorder, r)
+
+		record := downloadRecord{
+			Time:     time.Now().UTC(),
+			Package:  packageNameFromVars(r),
+			Version:  tarballVersion(r),
+			Client:   clientIP(r).String(),
+			Identity: clientIdentity(r),
+			Status:   recorder.statusCode,
+		}
+		if err := downloadAuditLog.Record(record); err != nil {
+			adminLog.warnf(r, "Failed to record the download of %s: %s", r.URL.Path, err)
+		}
+	}
+}
+
+func queryDownloads(wr http.ResponseWriter, r *http.Request) {
+	if downloadAuditLog == nil {
+		writeJSON(wr, http.StatusNotFound, map[string]string{"error": "download auditing is not enabled"})
+		return
+	}
+
+	query := downloadQuery{
+		Package:  r.URL.Query().Get("package"),
+		Version:  r.URL.Query().Get("version"),
+		Identity: r.URL.Query().Get("identity"),
+		Limit:    100,
+	}
+	if since := r.URL.Query().Get("since"); since != "" {
+		sinceTime, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			writeJSON(wr, http.StatusBadRequest, map[string]string{"error": "since must be an RFC 3339 timestamp"})
+			return
+		}
+		query.Since = sinceTime
+	}
+	if limit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && limit > 0 {
+		query.Limit = limit
+	}
+
+	records, err := downloadAuditLog.Query(query)
+	if err != nil {
+		adminLog.errorf(r, "Failed to query the download audit log: %s", err)
+		writeJSON(wr, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if records == nil {
+		records = []downloadRecord{}
+	}
+
+	writeJSON(wr, http.StatusOK, map[string]interface{}{"downloads": records})
+}
@@ -0,0 +1,48 @@
+package levee
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileDownloadAuditLogQueryDuringRecord(t *testing.T) {
+	auditLog := &fileDownloadAuditLog{filename: filepath.Join(t.TempDir(), "downloads.jsonl")}
+	if err := auditLog.Record(downloadRecord{Time: time.Now(), Package: "lodash", Version: "1.0.0", Status: http.StatusOK}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A Record in progress holds the mutex.
+	auditLog.mutex.Lock()
+	defer auditLog.mutex.Unlock()
+
+	queried := make(chan []downloadRecord, 1)
+	go func() {
+		records, _ := auditLog.Query(downloadQuery{Package: "lodash", Limit: 10})
+		queried <- records
+	}()
+	select {
+	case records := <-queried:
+		if len(records) != 1 {
+			t.Errorf("Query returned %v, expected the recorded download", records)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Query waited for Record")
+	}
+}
+
+func TestStatusRecorderFlushes(t *testing.T) {
+	wr := httptest.NewRecorder()
+	var recorder http.ResponseWriter = &statusRecorder{ResponseWriter: wr, statusCode: http.StatusOK}
+
+	flusher, ok := recorder.(http.Flusher)
+	if !ok {
+		t.Fatal("statusRecorder is no http.Flusher")
+	}
+	flusher.Flush()
+	if !wr.Flushed {
+		t.Error("Flush didn't reach the underlying writer")
+	}
+}
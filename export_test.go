@@ -0,0 +1,12 @@
+package levee
+
+import "time"
+
+// NewTieredCache puts the tiered cache in front of backing, so that the
+// conformance suite can run against it without a Redis.
+func NewTieredCache(backing CacheStore, memoryTTL time.Duration) CacheStore {
+	return newTieredCacheStore(backing, 0, memoryTTL)
+}
+
+// NewCacheStore creates the cache store selected by cache.type.
+var NewCacheStore = newCacheStore
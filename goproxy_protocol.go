@@ -0,0 +1,59 @@
+package levee
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/gorilla/mux"
+)
+
+// goProxyProtocol serves a Go module proxy as the go command expects it in
+// GOPROXY. The .mod and .zip files of a version never change and are kept
+// for good, the version lists are cached for the metadata TTL.
+type goProxyProtocol struct {
+	*repository
+}
+
+// semanticVersion matches the canonical versions the go command asks for,
+// other version queries like a branch name resolve to different versions
+// over time.
+var semanticVersion = regexp.MustCompile(`^v[0-9]+\.[0-9]+\.[0-9]+(-[0-9A-Za-z.-]+)?(\+[0-9A-Za-z.-]+)?$`)
+
+func newGoProxyProtocol(repo *repository) RegistryProtocol {
+	return goProxyProtocol{repository: repo}
+}
+
+func (goProxyProtocol) Name() string {
+	return "go"
+}
+
+func (protocol goProxyProtocol) RegisterRoutes(router *mux.Router) {
+	routes := protocol.routes(router, protocol)
+	metadata := protocol.metadataProxy(protocol)
+	files := protocol.artifactProxy(protocol)
+
+	routes.HandleFunc("/{module:.+}/@v/list", metadata).Methods("GET", "HEAD")
+	routes.HandleFunc("/{module:.+}/@latest", metadata).Methods("GET", "HEAD")
+	routes.HandleFunc("/{module:.+}/@v/{version}.info", func(wr http.ResponseWriter, r *http.Request) {
+		if semanticVersion.MatchString(mux.Vars(r)["version"]) {
+			files(wr, r)
+		} else {
+			metadata(wr, r)
+		}
+	}).Methods("GET", "HEAD")
+	routes.HandleFunc("/{module:.+}/@v/{version}.mod", files).Methods("GET", "HEAD")
+	routes.HandleFunc("/{module:.+}/@v/{version}.zip", files).Methods("GET", "HEAD")
+}
+
+func (protocol goProxyProtocol) CacheKey(r *http.Request) string {
+	return cacheKey(r.URL.Path)
+}
+
+func (protocol goProxyProtocol) Fetch(r *http.Request) (*http.Response, error) {
+	return protocol.fetch(r)
+}
+
+// RewriteResponse leaves the responses as they are, they hold no links.
+func (goProxyProtocol) RewriteResponse(r *http.Request, resp *http.Response) error {
+	return nil
+}
@@ -0,0 +1,66 @@
+package levee
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var unhealthyUpstreams sync.Map
+
+func isUpstreamHealthy(registryURL string) bool {
+	_, unhealthy := unhealthyUpstreams.Load(registryURL)
+	return !unhealthy
+}
+
+func probeUpstream(registry Registry, path string, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, registry.URL+path, nil)
+	if err != nil {
+		return false
+	}
+	registry.authorize(req)
+
+	resp, err := registry.client().Do(req)
+	if err != nil {
+		return false
+	}
+	discardResponse(resp)
+
+	return resp.StatusCode < http.StatusInternalServerError
+}
+
+func checkUpstreamsHealth(registries []Registry, path string, timeout time.Duration) {
+	for _, registry := range registries {
+		registryURL := registry.URL
+		healthy := probeUpstream(registry, path, timeout)
+
+		if healthy && !isUpstreamHealthy(registryURL) {
+			upstreamLog.infof(nil, "Registry %s is healthy again", registryURL)
+			notify(webhookEvent{Event: eventUpstreamHealthy, Registry: registryURL})
+			unhealthyUpstreams.Delete(registryURL)
+		} else if !healthy && isUpstreamHealthy(registryURL) {
+			upstreamLog.warnf(nil, "Registry %s is unhealthy, skipping it till it recovers", registryURL)
+			notify(webhookEvent{Event: eventUpstreamUnhealthy, Registry: registryURL})
+			unhealthyUpstreams.Store(registryURL, true)
+		}
+	}
+}
+
+func watchUpstreamsHealth(interval time.Duration, path string, timeout time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		checkUpstreamsHealth(allRegistries(), path, timeout)
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
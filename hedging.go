@@ -0,0 +1,112 @@
+package levee
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+type raceResult struct {
+	index    int
+	resp     *http.Response
+	registry Registry
+	err      error
+}
+
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body cancelOnCloseBody) Close() error {
+	defer body.cancel()
+	return body.ReadCloser.Close()
+}
+
+func raceRegistries(registries []Registry, r *http.Request, accept func(*http.Response) bool) (*http.Response, Registry, error) {
+	results := make(chan raceResult, len(registries))
+	cancels := make([]context.CancelFunc, len(registries))
+	won := make(chan struct{})
+
+	for i, registry := range registries {
+		ctx, cancel := context.WithCancel(r.Context())
+		cancels[i] = cancel
+
+		go func(index int, registry Registry, ctx context.Context) {
+			select {
+			case <-time.After(time.Duration(index) * settings().hedgingDelay):
+			case <-won:
+				results <- raceResult{index: index, err: context.Canceled}
+				return
+			}
+
+			resp, err := proxyRequest(registry, r.WithContext(ctx))
+			results <- raceResult{index: index, resp: resp, registry: registry, err: err}
+		}(i, registry, ctx)
+	}
+
+	responseError := fmt.Errorf("no registry responded to %s %s", r.Method, r.URL.Path)
+	// fallback is the last acceptable response that isn't a success, returned
+	// when no registry succeeds, so a quick 404 or 500 can't win the race.
+	var fallback *raceResult
+	notFound := false
+
+	for pending := len(registries); pending > 0; pending-- {
+		result := <-results
+
+		if result.err == nil && accept(result.resp) && isRaceWinner(result.resp) {
+			close(won)
+			for i, cancel := range cancels {
+				if i != result.index {
+					cancel()
+				}
+			}
+			go discardRaceResults(results, pending-1)
+			if fallback != nil {
+				fallback.resp.Body.Close()
+			}
+
+			upstreamLog.debugf(r, "Registry %s won the race for %s %s", result.registry.URL, r.Method, r.URL.Path)
+			result.resp.Body = cancelOnCloseBody{ReadCloser: result.resp.Body, cancel: cancels[result.index]}
+			return result.resp, result.registry, nil
+		}
+
+		if result.err != nil {
+			responseError = result.err
+		} else if accept(result.resp) {
+			if fallback != nil {
+				fallback.resp.Body.Close()
+			}
+			result.resp.Body = cancelOnCloseBody{ReadCloser: result.resp.Body, cancel: cancels[result.index]}
+			fallback = &result
+			continue
+		} else {
+			notFound = notFound || result.resp.StatusCode == http.StatusNotFound
+			result.resp.Body.Close()
+		}
+		cancels[result.index]()
+	}
+
+	if fallback != nil {
+		return fallback.resp, fallback.registry, nil
+	}
+	if notFound {
+		return nil, Registry{}, errPackageNotFound
+	}
+
+	return nil, Registry{}, responseError
+}
+
+func isRaceWinner(resp *http.Response) bool {
+	return (resp.StatusCode >= 200 && resp.StatusCode < 300) || resp.StatusCode == http.StatusNotModified
+}
+
+func discardRaceResults(results chan raceResult, pending int) {
+	for ; pending > 0; pending-- {
+		if result := <-results; result.resp != nil {
+			result.resp.Body.Close()
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package levee
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type AccessConfig struct {
+	Allow          []string `yaml:"allow"`
+	Deny           []string `yaml:"deny"`
+	AdminAllow     []string `yaml:"adminAllow"`
+	AdminDeny      []string `yaml:"adminDeny"`
+	TrustedProxies []string `yaml:"trustedProxies"`
+}
+
+type ipFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address or CIDR %q", cidr)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+func newIPFilter(allow []string, deny []string) (ipFilter, error) {
+	allowedNetworks, err := parseCIDRs(allow)
+	if err != nil {
+		return ipFilter{}, err
+	}
+
+	deniedNetworks, err := parseCIDRs(deny)
+	if err != nil {
+		return ipFilter{}, err
+	}
+
+	return ipFilter{allow: allowedNetworks, deny: deniedNetworks}, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (filter ipFilter) allows(ip net.IP) bool {
+	if ip == nil {
+		return len(filter.allow) == 0 && len(filter.deny) == 0
+	}
+	if containsIP(filter.deny, ip) {
+		return false
+	}
+
+	return len(filter.allow) == 0 || containsIP(filter.allow, ip)
+}
+
+func peerIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return net.ParseIP(host)
+}
+
+// isTrustedProxy tells whether r was sent by one of the trusted proxies, whose
+// X-Forwarded headers are believed.
+func isTrustedProxy(r *http.Request) bool {
+	ip := peerIP(r)
+	return ip != nil && containsIP(settings().trustedProxies, ip)
+}
+
+func clientIP(r *http.Request) net.IP {
+	ip := peerIP(r)
+
+	if ip == nil || !containsIP(settings().trustedProxies, ip) {
+		return ip
+	}
+
+	forwardedFor := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		forwardedIP := net.ParseIP(strings.TrimSpace(forwardedFor[i]))
+		if forwardedIP == nil {
+			break
+		}
+
+		ip = forwardedIP
+		if !containsIP(settings().trustedProxies, ip) {
+			break
+		}
+	}
+
+	return ip
+}
+
+func restrictAddresses(handler http.Handler, filter ipFilter, adminFilter ipFilter) http.Handler {
+	return http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+
+		allowed := filter.allows(ip)
+		if allowed && strings.HasPrefix(r.URL.Path, "/-/levee/") {
+			allowed = adminFilter.allows(ip)
+		}
+
+		if !allowed {
+			policyLog.warnf(r, "Refusing %s %s from %s", r.Method, r.URL.Path, ip)
+			writeJSON(wr, http.StatusForbidden, map[string]string{"error": "forbidden"})
+			return
+		}
+
+		handler.ServeHTTP(wr, r)
+	})
+}
@@ -1,239 +1,764 @@
-package main
+package levee
 
 import (
 	"bufio"
-	"bytes"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
 	"net/http"
-	"net/http/httputil"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/go-redis/redis"
 	"github.com/gorilla/mux"
-	"gopkg.in/yaml.v2"
 )
 
-var redisClient *redis.Client
-var internalRegistries []string
-var externalRegistries []string
+var cacheStore CacheStore
+var offline bool
 
-func cachelessProxy(wr http.ResponseWriter, r *http.Request) {
-	log.Printf("A cachless request handling for %s", r.URL.Path)
+const abbreviatedMetadataType = "application/vnd.npm.install-v1+json"
+const abbreviatedMetadataSuffix = ":install-v1"
 
-	var responseError error
+var errOffline = errors.New("levee is offline and the requested document is not cached")
 
-	for _, internalRegistryURL := range internalRegistries {
-		proxiedURL := fmt.Sprintf("%s%s", internalRegistryURL, r.URL.Path)
+func cachelessProxy(wr http.ResponseWriter, r *http.Request) {
+	proxyLog.debugf(r, "A cachless request handling for %s", r.URL.Path)
 
-		client := &http.Client{}
-		req, _ := http.NewRequest(r.Method, proxiedURL, r.Body)
-		for name, value := range r.Header {
-			req.Header.Set(name, value[0])
-		}
-		resp, responseError := client.Do(req)
-		r.Body.Close()
+	if offline {
+		http.Error(wr, errOffline.Error(), http.StatusGatewayTimeout)
+		return
+	}
 
-		if responseError == nil {
-			log.Printf("Internal registry %s responded to %s request of %s", internalRegistryURL, r.Method, r.URL.Path)
+	responseError := fmt.Errorf("no internal registry responded to %s %s", r.Method, r.URL.Path)
 
-			for k, v := range resp.Header {
-				wr.Header().Set(k, v[0])
-			}
-			wr.WriteHeader(resp.StatusCode)
-			io.Copy(wr, resp.Body)
-			resp.Body.Close()
+	for _, internalRegistry := range settings().internalRegistries {
+		var transportError error
+		registryReverseProxy(internalRegistry, &transportError).ServeHTTP(wr, r)
+
+		if transportError == nil {
+			upstreamLog.debugf(r, "Internal registry %s responded to %s request of %s", internalRegistry.URL, r.Method, r.URL.Path)
+			setLogField(r, "upstream", internalRegistry.URL)
 			return
 		}
+		responseError = transportError
+
+		if r.ContentLength != 0 {
+			break
+		}
 	}
 
-	log.Printf("All internal registries failed to response to %s %s with no errors", r.Method, r.URL.Path)
-	http.Error(wr, responseError.Error(), http.StatusInternalServerError)
-	return
+	upstreamLog.errorf(r, "All internal registries failed to response to %s %s: %s", r.Method, r.URL.Path, responseError)
+	http.Error(wr, responseError.Error(), http.StatusBadGateway)
 }
 
-func cachedProxy(wr http.ResponseWriter, r *http.Request, cachingPeriod time.Duration) {
+func proxyRequest(registry Registry, r *http.Request) (*http.Response, error) {
+	attempts := 1
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		attempts = registry.maxAttempts()
+	}
 
-	npmResponse, err := redisClient.HGetAll(r.URL.Path).Result()
-	if err == redis.Nil || err != nil || len(npmResponse) == 0 {
-		var responseError error
+	for attempt := 1; ; attempt++ {
+		resp, err := proxyRequestOnce(registry, r)
+		if attempt >= attempts || r.Context().Err() != nil || !isRetryable(resp, err) {
+			return resp, err
+		}
 
-		for _, internalRegistryURL := range internalRegistries {
-			proxiedURL := fmt.Sprintf("%s%s", internalRegistryURL, r.URL.Path)
+		if err == nil {
+			upstreamLog.warnf(r, "Registry %s responded to %s %s with %d, retrying", registry.URL, r.Method, r.URL.Path, resp.StatusCode)
+			discardResponse(resp)
+		} else {
+			upstreamLog.warnf(r, "Registry %s failed to respond to %s %s: %s, retrying", registry.URL, r.Method, r.URL.Path, err)
+		}
 
-			client := &http.Client{}
-			req, _ := http.NewRequest(r.Method, proxiedURL, r.Body)
-			for name, value := range r.Header {
-				req.Header.Set(name, value[0])
-			}
-			resp, responseError := client.Do(req)
-			r.Body.Close()
-
-			if responseError == nil && resp.StatusCode == http.StatusOK {
-				log.Printf("Internal registry %s responded to %s request of %s", internalRegistryURL, r.Method, r.URL.Path)
-
-				for k, v := range resp.Header {
-					wr.Header().Set(k, v[0])
-				}
-				wr.WriteHeader(resp.StatusCode)
-				bytesBody, _ := httputil.DumpResponse(resp, true)
-				io.Copy(wr, resp.Body)
-				resp.Body.Close()
-
-				writePackageInfo(r.URL.Path, resp, string(bytesBody), cachingPeriod)
-				return
-			}
+		select {
+		case <-time.After(retryBackoff(attempt)):
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
 		}
+	}
+}
 
-		for _, externalRegistryURL := range externalRegistries {
-			proxiedURL := fmt.Sprintf("%s%s", externalRegistryURL, r.URL.Path)
+func proxyRequestOnce(registry Registry, r *http.Request) (*http.Response, error) {
+	releaseSlot, err := acquireUpstreamSlot(r, registry)
+	if err != nil {
+		return nil, err
+	}
 
-			client := &http.Client{}
-			req, _ := http.NewRequest(r.Method, proxiedURL, r.Body)
-			for name, value := range r.Header {
-				req.Header.Set(name, value[0])
-			}
-			resp, responseError := client.Do(req)
-			r.Body.Close()
-
-			if responseError == nil {
-				log.Printf("External registry %s responded to %s request of %s", externalRegistryURL, r.Method, r.URL.Path)
-
-				for k, v := range resp.Header {
-					wr.Header().Set(k, v[0])
-				}
-				wr.WriteHeader(resp.StatusCode)
-				bytesBody, _ := httputil.DumpResponse(resp, true)
-				io.Copy(wr, resp.Body)
-				resp.Body.Close()
-
-				writePackageInfo(r.URL.Path, resp, string(bytesBody), cachingPeriod)
-				return
-			}
+	breaker := upstreamCircuitBreaker(registry.URL)
+	if !breaker.allow() {
+		releaseSlot()
+		return nil, errCircuitOpen
+	}
+
+	proxiedURL := fmt.Sprintf("%s%s", registry.URL, upstreamPath(r.URL.Path))
+	if r.URL.RawQuery != "" {
+		proxiedURL = fmt.Sprintf("%s?%s", proxiedURL, r.URL.RawQuery)
+	}
+
+	client := registry.client()
+	req, _ := http.NewRequestWithContext(r.Context(), r.Method, proxiedURL, r.Body)
+	req.ContentLength = r.ContentLength
+	for name, value := range r.Header {
+		if registry.forwardsHeader(r, name) {
+			req.Header.Set(name, value[0])
 		}
+	}
+	registry.authorize(req)
 
-		log.Printf("All internal registries failed to response to %s %s with no errors", r.Method, r.URL.Path)
-		http.Error(wr, responseError.Error(), http.StatusInternalServerError)
+	resp, err := client.Do(req)
+	if r.Context().Err() != nil {
+		breaker.abandon()
 	} else {
-		if npmResponse["Etag"] == r.Header.Get("If-None-Match") {
-			log.Printf("Found the tag")
-			wr.Header().Set("Etag", npmResponse["Etag"])
-			wr.WriteHeader(304)
+		success := err == nil && resp.StatusCode < http.StatusInternalServerError
+		breaker.record(success)
+		recordUpstreamResult(registry.URL, success)
+	}
+
+	if err != nil {
+		releaseSlot()
+		return nil, err
+	}
+	resp.Body = slotBody{ReadCloser: resp.Body, release: releaseSlot}
+	registry.transformResponse(resp)
+
+	return resp, nil
+}
+
+func asGetRequest(r *http.Request) *http.Request {
+	if r.Method != http.MethodHead {
+		return r
+	}
+
+	getRequest := r.Clone(r.Context())
+	getRequest.Method = http.MethodGet
+	return getRequest
+}
+
+func isInternalHit(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusNotModified
+}
+
+func isAnyResponse(resp *http.Response) bool {
+	return true
+}
+
+func fetchFromRegistries(registries []Registry, r *http.Request, accept func(*http.Response) bool) (*http.Response, Registry, error) {
+	var candidates []Registry
+	for _, registry := range orderRegistries(registries) {
+		if isUpstreamHealthy(registry.URL) {
+			candidates = append(candidates, registry)
+		}
+	}
+	candidates = runBeforeUpstreamHooks(r, candidates)
+
+	if settings().hedgedRequests && len(candidates) > 1 {
+		return raceRegistries(candidates, r, accept)
+	}
+
+	responseError := fmt.Errorf("no registry responded to %s %s", r.Method, r.URL.Path)
+	// A registry answering that it doesn't have the package outweighs
+	// the others failing to answer.
+	notFound := false
+
+	for _, registry := range candidates {
+		if r.Context().Err() != nil {
+			return nil, Registry{}, r.Context().Err()
+		}
+
+		resp, err := proxyRequest(registry, r)
+		if err == nil && accept(resp) {
+			return resp, registry, nil
+		}
+
+		if err != nil {
+			responseError = err
 		} else {
-			log.Printf("Found tag but it is now different")
-			responseBuffer := bufio.NewReader(bytes.NewReader([]byte(npmResponse["wholeResponse"])))
+			notFound = notFound || resp.StatusCode == http.StatusNotFound
+			discardResponse(resp)
+		}
+	}
 
-			resp, _ := http.ReadResponse(responseBuffer, r)
+	if notFound {
+		return nil, Registry{}, errPackageNotFound
+	}
 
-			for k, v := range resp.Header {
-				wr.Header().Set(k, v[0])
+	return nil, Registry{}, responseError
+}
+
+func fetchPackage(r *http.Request) (*http.Response, error) {
+	return fetchRoutedPackage(r, packageNameFromPath(r.URL.Path))
+}
+
+// fetchRoutedPackage fetches r from the registries packageName is routed to,
+// for requests whose path doesn't start with the name of the package.
+func fetchRoutedPackage(r *http.Request, packageName string) (*http.Response, error) {
+	if offline {
+		return nil, errOffline
+	}
+
+	current := settings()
+	rule := routingRuleFor(packageName)
+	if len(rule.Groups) > 0 {
+		return fetchFromGroups(r, rule.Groups)
+	}
+
+	if rule.Upstreams != "external" {
+		resp, internalRegistry, err := fetchFromRegistries(current.internalRegistries, r, isInternalHit)
+		if err == nil {
+			upstreamLog.debugf(r, "Internal registry %s responded to %s request of %s", internalRegistry.URL, r.Method, r.URL.Path)
+			setLogField(r, "upstream", internalRegistry.URL)
+			return resp, nil
+		}
+
+		if rule.Upstreams == "internal" && err == errPackageNotFound {
+			upstreamLog.infof(r, "%s is routed to internal registries only, none of them has it", r.URL.Path)
+			return nil, err
+		} else if rule.Upstreams == "internal" {
+			upstreamLog.warnf(r, "%s is routed to internal registries only, none of them answered: %s", r.URL.Path, err)
+			return nil, err
+		}
+	}
+
+	resp, externalRegistry, err := fetchFromRegistries(current.externalRegistries, r, isAnyResponse)
+	if err == nil {
+		upstreamLog.debugf(r, "External registry %s responded to %s request of %s", externalRegistry.URL, r.Method, r.URL.Path)
+		setLogField(r, "upstream", externalRegistry.URL)
+		return resp, nil
+	}
+
+	return nil, err
+}
+
+func isCachedResponse(npmResponse map[string]string, err error) bool {
+	return err == nil && npmResponse["wholeResponse"] != "" && !isExpired(npmResponse)
+}
+
+func cachedProxy(wr http.ResponseWriter, r *http.Request, policy CachePolicy) {
+	key := requestCacheKey(r)
+
+	requestCache := cacheStoreFor(r.Context())
+
+	npmResponse, err := requestCache.Get(key)
+	if !isCachedResponse(npmResponse, err) {
+		setLogField(r, "cache", "miss")
+		recordCacheMiss()
+
+		fill, waited := joinCacheFill(r, key, func(shared interface{}) bool {
+			if document, ok := shared.(map[string]string); ok && document["wholeResponse"] != "" {
+				npmResponse = document
+				return true
 			}
-			wr.WriteHeader(resp.StatusCode)
+			npmResponse, err = requestCache.Get(key)
+			return isCachedResponse(npmResponse, err)
+		})
+		if fill == nil {
+			setLogField(r, "cache", "coalesced")
+			serveCachedResponse(wr, r, npmResponse)
+			return
+		}
+		defer func() {
+			if fill != nil {
+				fill.release()
+			}
+		}()
+		if waited && r.Context().Err() != nil {
+			return
+		}
 
-			io.Copy(wr, resp.Body)
+		// An expired entry is revalidated with its ETag rather than
+		// downloaded again when it has not changed upstream.
+		upstreamRequest := asGetRequest(r)
+		revalidating := err == nil && npmResponse["wholeResponse"] != "" && npmResponse["Etag"] != ""
+		if revalidating {
+			upstreamRequest = conditionalRequest(upstreamRequest, npmResponse["Etag"])
+		}
+
+		resp, responseError := protocolOf(r).Fetch(upstreamRequest)
+		r.Body.Close()
+
+		if responseError != nil && r.Context().Err() != nil {
+			proxyLog.debugf(r, "The client went away, abandoned fetching %s", r.URL.Path)
+			return
+		} else if responseError == errOffline {
+			cacheLog.infof(r, "Offline cache miss for %s", r.URL.Path)
+			http.Error(wr, responseError.Error(), http.StatusGatewayTimeout)
+			return
+		} else if responseError == errPackageNotFound {
+			writeJSON(wr, http.StatusNotFound, map[string]string{"error": responseError.Error()})
+			return
+		} else if responseError == errUpstreamBusy {
+			wr.Header().Set("Retry-After", "1")
+			http.Error(wr, responseError.Error(), http.StatusServiceUnavailable)
+			return
+		} else if responseError != nil {
+			upstreamLog.errorf(r, "All registries failed to response to %s %s: %s", r.Method, r.URL.Path, responseError)
+			http.Error(wr, responseError.Error(), http.StatusBadGateway)
+			return
+		}
 
+		if revalidating && resp.StatusCode == http.StatusNotModified {
 			resp.Body.Close()
+			setLogField(r, "cache", "revalidated")
+			cacheLog.debugf(r, "%s has not changed upstream, re-arming the cached copy", r.URL.Path)
+
+			fill.share(npmResponse)
+			releaseFill := fill
+			fill = nil
+			queueCacheWrite(func() {
+				writePackageInfo(key, resp, nil, npmResponse, policy)
+				releaseFill.release()
+			})
+			serveCachedResponse(wr, r, npmResponse)
+			return
+		}
+
+		if err := protocolOf(r).RewriteResponse(r, resp); err != nil {
+			proxyLog.warnf(r, "Failed to rewrite the response of %s: %s", r.URL.Path, err)
+		}
+
+		// The body is downloaded before it is served, so that the requests
+		// waiting for this fetch are handed it without waiting for a slow
+		// client or for the cache write.
+		body := &spillBuffer{}
+		defer body.Close()
+		entry, err := teeResponse(body, resp)
+		resp.Body.Close()
+		if err != nil {
+			upstreamLog.errorf(r, "Failed to download %s: %s", r.URL.Path, err)
+			http.Error(wr, err.Error(), http.StatusBadGateway)
+			return
+		}
+		fill.share(sharedDocument(resp, entry))
+
+		if _, err = body.Seek(0, io.SeekStart); err == nil {
+			err = serveResponse(wr, r, resp, body)
 		}
+		if err != nil {
+			proxyLog.warnf(r, "Failed to stream %s to the client: %s", r.URL.Path, err)
+		}
+
+		// The fill is released once the cache holds the document.
+		releaseFill := fill
+		fill = nil
+		queueCacheWrite(func() {
+			writePackageInfo(key, resp, entry, nil, policy)
+			releaseFill.release()
+		})
+		return
 	}
-}
 
-func getPackageEtag(packageURL string, requestEtag string) bool {
-	packageEtag := fmt.Sprintf("%s/Etag", packageURL)
-	log.Printf("Looking for %s", packageEtag)
+	setLogField(r, "cache", "hit")
+	recordCacheHit(packageNameFromPath(r.URL.Path), isStale(npmResponse))
+	if isStale(npmResponse) && !offline {
+		setLogField(r, "cache", "stale")
+		cacheLog.infof(r, "Serving stale %s while revalidating it", r.URL.Path)
+		revalidateInBackground(r, npmResponse, policy)
+	}
 
-	cachedEtag, err := redisClient.Get(packageEtag).Result()
-	if err == redis.Nil {
-		return false
-	} else if err != nil {
-		return false
-	} else {
-		log.Printf("Cached etag is %s", cachedEtag)
-		return cachedEtag == requestEtag
+	serveCachedResponse(wr, r, npmResponse)
+}
+
+// sharedDocument is the cached form of a downloaded document, which a cache
+// fill hands to the requests waiting for it. It is nil when the document
+// isn't cached.
+func sharedDocument(resp *http.Response, entry *cacheEntry) map[string]string {
+	if !isCacheableStatus(resp.StatusCode) || entry == nil {
+		return nil
+	}
+	wholeResponse, encoding, err := entry.finish()
+	if err != nil {
+		return nil
 	}
+
+	return map[string]string{"Etag": resp.Header.Get("Etag"), "wholeResponse": wholeResponse, "encoding": encoding}
 }
 
-func writePackageInfo(packageURL string, npmRegisteryResponse *http.Response, npmRegisteryBody string, cachingPeriod time.Duration) {
-	switch npmRegisteryResponse.StatusCode {
-	case 200:
-		npmResponse := make(map[string]interface{})
+func serveCachedResponse(wr http.ResponseWriter, r *http.Request, npmResponse map[string]string) {
+	if npmResponse["Etag"] != "" && npmResponse["Etag"] == r.Header.Get("If-None-Match") {
+		cacheLog.debugf(r, "Found the tag")
+		wr.Header().Set("Etag", npmResponse["Etag"])
+		wr.WriteHeader(304)
+	} else {
+		cacheLog.debugf(r, "Found tag but it is now different")
+		wholeResponse, err := decompressCachedBody(npmResponse["wholeResponse"], npmResponse["encoding"])
+		if err != nil {
+			cacheLog.errorf(r, "Failed to decompress the cached response of %s: %s", r.URL.Path, err)
+			http.Error(wr, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		responseBuffer := bufio.NewReader(strings.NewReader(localizeCachedResponse(r, wholeResponse)))
 
-		npmResponse["Etag"] = npmRegisteryResponse.Header.Get("Etag")
-		npmResponse["wholeResponse"] = npmRegisteryBody
-		redisClient.HMSet(packageURL, npmResponse)
-	case 304:
-		redisClient.HSet(packageURL, "Etag", npmRegisteryResponse.Header.Get("Etag"))
-	}
+		resp, _ := http.ReadResponse(responseBuffer, r)
+
+		for k, v := range resp.Header {
+			wr.Header().Set(k, v[0])
+		}
+		wr.WriteHeader(resp.StatusCode)
 
-	if cachingPeriod > -1 {
-		redisClient.Expire(packageURL, cachingPeriod)
+		io.Copy(wr, resp.Body)
+
+		resp.Body.Close()
 	}
 }
 
-func longTermCachfulProxy(wr http.ResponseWriter, r *http.Request) {
-	log.Printf("A long term cached request handling for %s", r.URL.Path)
+func cacheKey(packageURL string) string {
+	return settings().cacheKeyPrefix + packageURL
+}
+
+func requestCacheKey(r *http.Request) string {
+	return protocolOf(r).CacheKey(r)
+}
+
+// writePackageInfo caches the response of an upstream. A 304 re-arms the
+// cached entry it revalidated, which is written back whole with its new
+// expiry.
+func writePackageInfo(key string, npmRegisteryResponse *http.Response, entry *cacheEntry, cached map[string]string, policy CachePolicy) {
+	cachingPeriod := upstreamCachingPeriod(npmRegisteryResponse.Header, policy.cachingPeriod())
+	expiryFields := entryExpiryFields(cachingPeriod, policy.SoftTTL)
+
+	switch {
+	case npmRegisteryResponse.StatusCode == http.StatusNotModified && cached != nil:
+		npmResponse := make(map[string]string, len(cached)+len(expiryFields)+1)
+		for field, value := range cached {
+			npmResponse[field] = value
+		}
+		npmResponse["cachedAt"] = strconv.FormatInt(time.Now().Unix(), 10)
+		for field, value := range expiryFields {
+			npmResponse[field] = value
+		}
+		if etag := npmRegisteryResponse.Header.Get("Etag"); etag != "" {
+			npmResponse["Etag"] = etag
+		}
+		setCacheEntry(cacheStore, key, npmResponse, retentionPeriod(cachingPeriod))
+	case isCacheableStatus(npmRegisteryResponse.StatusCode) && entry != nil:
+		if !runBeforeCacheWriteHooks(key, npmRegisteryResponse) {
+			cacheLog.debugf(nil, "A plugin kept %s out of the cache", key)
+			return
+		}
+		wholeResponse, encoding, err := entry.finish()
+		if err == errObjectTooLarge {
+			cacheLog.infof(nil, "Not caching %s, it is larger than cache.maxObjectSize", key)
+			return
+		} else if err != nil {
+			cacheLog.warnf(nil, "Failed to compress the response of %s: %s", key, err)
+			return
+		}
+
+		npmResponse := make(map[string]string)
 
-	cachedProxy(wr, r, -1)
+		npmResponse["Etag"] = npmRegisteryResponse.Header.Get("Etag")
+		npmResponse["wholeResponse"] = wholeResponse
+		npmResponse["encoding"] = encoding
+		npmResponse["cachedAt"] = strconv.FormatInt(time.Now().Unix(), 10)
+		for field, value := range expiryFields {
+			npmResponse[field] = value
+		}
+		setCacheEntry(cacheStore, key, npmResponse, retentionPeriod(cachingPeriod))
+	}
 }
 
-func shortTermCachfulProxy(wr http.ResponseWriter, r *http.Request) {
-	log.Printf("A short term cached request handling for %s", r.URL.Path)
+func cachfulProxy(wr http.ResponseWriter, r *http.Request) {
+	policy := cachePolicyFor(r.URL.Path)
+	proxyLog.debugf(r, "A cached request handling for %s with a caching period of %s", r.URL.Path, policy.cachingPeriod())
 
-	cachedProxy(wr, r, 24*time.Hour)
+	cachedProxy(wr, r, policy)
 }
 
 func leveeRouter() *mux.Router {
 	router := mux.NewRouter()
 
-	router.HandleFunc("/npm", shortTermCachfulProxy).Methods("GET")
-	router.HandleFunc("/{package}", longTermCachfulProxy).Methods("GET")
-	router.HandleFunc("/{package}/{version}", longTermCachfulProxy).Methods("GET")
-	router.HandleFunc("/", cachelessProxy)
+	if adminListenAddress == "" {
+		registerAdminRoutes(router)
+	}
+	registerProbeRoutes(router, "/-")
+	for _, protocol := range registryProtocols {
+		protocol.RegisterRoutes(router)
+	}
 
 	return router
 }
 
 type Config struct {
-	LeveePort string `yaml:"leveePort"`
-	Redis     struct {
-		Address  string `yaml:"address"`
-		Password string `yaml:"password"`
-		DB       int    `yaml:"db"`
-	} `yaml:redis`
-	InternalRegistries []string `yaml:"internalRegistries"`
-	ExternalRegistries []string `yaml:"externalRegistries"`
+	LeveePort       string          `yaml:"leveePort"`
+	PublicURL       string          `yaml:"publicURL"`
+	CacheKeyPrefix  string          `yaml:"cacheKeyPrefix"`
+	Logging         LoggingConfig   `yaml:"logging"`
+	Reload          ReloadConfig    `yaml:"reload"`
+	AccessLog       AccessLogConfig `yaml:"accessLog"`
+	Offline         bool            `yaml:"offline"`
+	ShutdownTimeout time.Duration   `yaml:"shutdownTimeout"`
+	Middlewares     []string        `yaml:"middlewares"`
+	Plugins         []PluginConfig  `yaml:"plugins"`
+	Server          struct {
+		ReadTimeout       time.Duration `yaml:"readTimeout"`
+		ReadHeaderTimeout time.Duration `yaml:"readHeaderTimeout"`
+		WriteTimeout      time.Duration `yaml:"writeTimeout"`
+		IdleTimeout       time.Duration `yaml:"idleTimeout"`
+		MaxHeaderBytes    int           `yaml:"maxHeaderBytes"`
+		MaxBodyBytes      int64         `yaml:"maxBodyBytes"`
+		Compression       bool          `yaml:"compression"`
+		SpillThreshold    int64         `yaml:"spillThreshold"`
+	} `yaml:"server"`
+	TLS struct {
+		CertFile string `yaml:"certFile"`
+		KeyFile  string `yaml:"keyFile"`
+	} `yaml:"tls"`
+	Redis struct {
+		Address           string   `yaml:"address"`
+		Password          string   `yaml:"password"`
+		PasswordFile      string   `yaml:"passwordFile"`
+		DB                int      `yaml:"db"`
+		MasterName        string   `yaml:"masterName"`
+		SentinelAddresses []string `yaml:"sentinelAddresses"`
+		ClusterAddresses  []string `yaml:"clusterAddresses"`
+	} `yaml:"redis"`
+	Cache struct {
+		Type                 string        `yaml:"type"`
+		MaxEntries           int           `yaml:"maxEntries"`
+		Compression          string        `yaml:"compression"`
+		CacheableStatuses    []int         `yaml:"cacheableStatuses"`
+		RevalidationWindow   time.Duration `yaml:"revalidationWindow"`
+		MaxObjectSize        int64         `yaml:"maxObjectSize"`
+		RespectCacheControl  bool          `yaml:"respectCacheControl"`
+		MinTTL               time.Duration `yaml:"minTTL"`
+		MaxTTL               time.Duration `yaml:"maxTTL"`
+		MemoryTTL            time.Duration `yaml:"memoryTTL"`
+		Bucket               string        `yaml:"bucket"`
+		Endpoint             string        `yaml:"endpoint"`
+		Region               string        `yaml:"region"`
+		ForcePathStyle       bool          `yaml:"forcePathStyle"`
+		AccessKeyID          string        `yaml:"accessKeyId"`
+		SecretAccessKey      string        `yaml:"secretAccessKey"`
+		KeyPrefix            string        `yaml:"keyPrefix"`
+		ServerSideEncryption string        `yaml:"serverSideEncryption"`
+		KMSKeyID             string        `yaml:"kmsKeyId"`
+		Blobs                struct {
+			Directory     string `yaml:"directory"`
+			MaxBytes      int64  `yaml:"maxBytes"`
+			MaxObjectSize int64  `yaml:"maxObjectSize"`
+		} `yaml:"blobs"`
+		Writes CacheWritesConfig `yaml:"writes"`
+	} `yaml:"cache"`
+	InternalRegistries []Registry              `yaml:"internalRegistries"`
+	ExternalRegistries []Registry              `yaml:"externalRegistries"`
+	ExternalProxy      string                  `yaml:"externalProxy"`
+	Repositories       []RepositoryConfig      `yaml:"repositories"`
+	CachePolicies      []CachePolicy           `yaml:"cachePolicies"`
+	PackageTTLs        map[string]string       `yaml:"packageTTLs"`
+	UpstreamGroups     []UpstreamGroup         `yaml:"upstreamGroups"`
+	RoutingRules       []RoutingRule           `yaml:"routingRules"`
+	PackagePolicy      PackagePolicy           `yaml:"packagePolicy"`
+	VulnerabilityGate  VulnerabilityGateConfig `yaml:"vulnerabilityGate"`
+	DownloadAudit      DownloadAuditConfig     `yaml:"downloadAudit"`
+	Quarantine         QuarantineConfig        `yaml:"quarantine"`
+	Signatures         SignatureConfig         `yaml:"signatures"`
+	Webhooks           []Webhook               `yaml:"webhooks"`
+	CORS               CORSConfig              `yaml:"cors"`
+	Access             AccessConfig            `yaml:"access"`
+	RateLimit          RateLimitConfig         `yaml:"rateLimit"`
+	Admin              struct {
+		Token  string `yaml:"token"`
+		Listen string `yaml:"listen"`
+	} `yaml:"admin"`
+	ClientAuth struct {
+		Tokens     []string `yaml:"tokens"`
+		TokensFile string   `yaml:"tokensFile"`
+	} `yaml:"clientAuth"`
+	UpstreamTimeouts struct {
+		Connect time.Duration `yaml:"connect"`
+		Read    time.Duration `yaml:"read"`
+	} `yaml:"upstreamTimeouts"`
+	UpstreamConnections struct {
+		MaxIdlePerHost int           `yaml:"maxIdlePerHost"`
+		IdleTimeout    time.Duration `yaml:"idleTimeout"`
+		MaxConcurrent  int           `yaml:"maxConcurrent"`
+		QueueTimeout   time.Duration `yaml:"queueTimeout"`
+	} `yaml:"upstreamConnections"`
+	Hedging struct {
+		Enabled bool          `yaml:"enabled"`
+		Delay   time.Duration `yaml:"delay"`
+	} `yaml:"hedging"`
+	Retry struct {
+		MaxAttempts    int           `yaml:"maxAttempts"`
+		InitialBackoff time.Duration `yaml:"initialBackoff"`
+		MaxBackoff     time.Duration `yaml:"maxBackoff"`
+	} `yaml:"retry"`
+	CircuitBreaker struct {
+		Threshold int           `yaml:"threshold"`
+		Cooldown  time.Duration `yaml:"cooldown"`
+	} `yaml:"circuitBreaker"`
+	HealthCheck struct {
+		Interval time.Duration `yaml:"interval"`
+		Timeout  time.Duration `yaml:"timeout"`
+		Path     string        `yaml:"path"`
+	} `yaml:"healthCheck"`
+	Warmup struct {
+		Packages     []string `yaml:"packages"`
+		PackagesFile string   `yaml:"packagesFile"`
+	} `yaml:"warmup"`
 }
 
-func main() {
-	filename, _ := filepath.Abs(os.Args[1])
-	yamlFile, err := ioutil.ReadFile(filename)
-
+func applyRuntimeConfig(config Config) error {
+	newPackageTTLs, err := parsePackageTTLs(config.PackageTTLs)
+	if err != nil {
+		return err
+	}
+	newUpstreamGroups, err := parseUpstreamGroups(config.UpstreamGroups)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if err := validateRoutingRules(config.RoutingRules, newUpstreamGroups); err != nil {
+		return err
+	}
+	newPackagePolicy, err := compilePackagePolicy(config.PackagePolicy)
+	if err != nil {
+		return err
+	}
+	newVulnerabilityGate, err := configureVulnerabilityGate(config.VulnerabilityGate)
+	if err != nil {
+		return err
+	}
+	newQuarantinePeriod, err := parseQuarantinePeriod(config.Quarantine)
+	if err != nil {
+		return err
+	}
+	newPlugins, err := loadPlugins(config.Plugins)
+	if err != nil {
+		return err
+	}
+	newWebhooks, err := compileWebhooks(config.Webhooks)
+	if err != nil {
+		return err
+	}
+	newClientTokens, err := loadClientTokens(config.ClientAuth.Tokens, config.ClientAuth.TokensFile)
+	if err != nil {
+		return err
+	}
+	newTrustedProxies, err := parseCIDRs(config.Access.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	for i := range config.ExternalRegistries {
+		config.ExternalRegistries[i].external = true
 	}
 
-	var config Config
+	next := defaultRuntimeSettings
+	next.cacheKeyPrefix = config.CacheKeyPrefix
+	next.publicURL = config.PublicURL
+	next.cacheCompression = config.Cache.Compression
+	next.maxCachedObjectSize = config.Cache.MaxObjectSize
+	if config.Server.SpillThreshold > 0 {
+		next.spillThreshold = config.Server.SpillThreshold
+	}
+	if config.Cache.RevalidationWindow != 0 {
+		next.revalidationWindow = config.Cache.RevalidationWindow
+	}
+	next.maxCachedBlobSize = config.Cache.Blobs.MaxObjectSize
+	next.respectCacheControl = config.Cache.RespectCacheControl
+	if len(config.Cache.CacheableStatuses) > 0 {
+		next.cacheableStatuses = make(map[int]bool, len(config.Cache.CacheableStatuses))
+		for _, statusCode := range config.Cache.CacheableStatuses {
+			next.cacheableStatuses[statusCode] = true
+		}
+	}
+	next.minCachingPeriod = config.Cache.MinTTL
+	next.maxCachingPeriod = config.Cache.MaxTTL
+	if len(config.CachePolicies) > 0 {
+		next.cachePolicies = config.CachePolicies
+	}
+	next.packageTTLs = newPackageTTLs
+	next.upstreamGroups = newUpstreamGroups
+	next.routingRules = config.RoutingRules
+	next.packagePolicy = newPackagePolicy
+	next.vulnerabilityGate = newVulnerabilityGate
+	next.quarantinePeriod = newQuarantinePeriod
+	next.quarantineExemptions = config.Quarantine.Exempt
+	next.quarantineFailOpen = config.Quarantine.FailOpen
+	next.signatureConfig = config.Signatures
+	next.webhooks = newWebhooks
+	next.activePlugins = newPlugins
+	next.adminToken = config.Admin.Token
+	next.clientTokens = newClientTokens
+	next.trustedProxies = newTrustedProxies
+	if config.UpstreamTimeouts.Connect > 0 {
+		next.upstreamConnectTimeout = config.UpstreamTimeouts.Connect
+	}
+	if config.UpstreamTimeouts.Read > 0 {
+		next.upstreamReadTimeout = config.UpstreamTimeouts.Read
+	}
+	if config.UpstreamConnections.MaxIdlePerHost > 0 {
+		next.upstreamMaxIdleConnsPerHost = config.UpstreamConnections.MaxIdlePerHost
+	}
+	if config.UpstreamConnections.IdleTimeout > 0 {
+		next.upstreamIdleConnTimeout = config.UpstreamConnections.IdleTimeout
+	}
+	next.upstreamMaxConcurrent = config.UpstreamConnections.MaxConcurrent
+	if config.UpstreamConnections.QueueTimeout > 0 {
+		next.upstreamQueueTimeout = config.UpstreamConnections.QueueTimeout
+	}
+	if config.Retry.MaxAttempts > 0 {
+		next.retryMaxAttempts = config.Retry.MaxAttempts
+	}
+	if config.Retry.InitialBackoff > 0 {
+		next.retryInitialBackoff = config.Retry.InitialBackoff
+	}
+	if config.Retry.MaxBackoff > 0 {
+		next.retryMaxBackoff = config.Retry.MaxBackoff
+	}
+	next.hedgedRequests = config.Hedging.Enabled
+	next.hedgingDelay = config.Hedging.Delay
+	next.circuitBreakerThreshold = config.CircuitBreaker.Threshold
+	next.circuitBreakerCooldown = config.CircuitBreaker.Cooldown
+	next.internalRegistries = config.InternalRegistries
+	next.externalRegistries = config.ExternalRegistries
+	next.externalProxy = config.ExternalProxy
+	currentSettings.Store(&next)
+
+	return nil
+}
+
+func serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	offlineFlag := flags.Bool("offline", false, "serve only from the cache and never contact any registry")
+	filename, overrides := configFlags(flags, args)
+
+	config, err := loadConfig(filename, overrides)
+	if err != nil {
+		exitWithError(err)
+	}
+	config.Offline = config.Offline || *offlineFlag
 
-	err = yaml.Unmarshal(yamlFile, &config)
+	server, err := NewServer(config)
 	if err != nil {
-		panic(err)
+		exitWithError(err)
 	}
 
-	listeningPort := fmt.Sprintf(":%s", config.LeveePort)
-	log.Printf("Welcome to the leeve")
-	log.Printf("Listens on the port of the year the song was published in %s", listeningPort)
+	serverLog.infof(nil, "Welcome to the leeve")
+	serverLog.infof(nil, "Listens on the port of the year the song was published in :%s", config.LeveePort)
+	if err := server.Start(); err != nil {
+		exitWithError(err)
+	}
+
+	go watchConfig(filename, overrides, config.Reload.Interval)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case <-server.errors:
+		os.Exit(1)
+	case receivedSignal := <-signals:
+		serverLog.infof(nil, "Received %s, draining in-flight requests", receivedSignal)
+	}
 
-	redisClient = redis.NewClient(&redis.Options{
-		Addr:     config.Redis.Address,
-		Password: config.Redis.Password,
-		DB:       config.Redis.DB,
-	})
-	internalRegistries = config.InternalRegistries
-	externalRegistries = config.ExternalRegistries
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
 
-	router := leveeRouter()
-	log.Fatal(http.ListenAndServe(listeningPort, router))
+	server.Shutdown(ctx)
+	serverLog.infof(nil, "The levee is closed")
 }
@@ -0,0 +1,477 @@
+package levee_test
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kareem-abdelsalam/levee"
+	"github.com/kareem-abdelsalam/levee/cachetest"
+)
+
+// startLevee runs a Server with a MockCache until the end of the test.
+func startLevee(t *testing.T, config levee.Config, options ...levee.ServerOption) (http.Handler, *cachetest.MockCache) {
+	t.Helper()
+
+	cache := cachetest.NewMockCache()
+	if config.Cache.Blobs.Directory == "" {
+		config.Cache.Blobs.Directory = t.TempDir()
+	}
+	options = append([]levee.ServerOption{
+		levee.WithCache(cache),
+		levee.WithLogHandler(slog.NewTextHandler(ioutil.Discard, nil)),
+	}, options...)
+
+	server, err := levee.NewServer(config, options...)
+	if err != nil {
+		t.Fatalf("NewServer failed: %s", err)
+	}
+	t.Cleanup(func() {
+		server.Shutdown(context.Background())
+	})
+
+	return server.Handler(), cache
+}
+
+func serve(handler http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	wr := httptest.NewRecorder()
+	handler.ServeHTTP(wr, r)
+	return wr
+}
+
+func get(handler http.Handler, path string) *httptest.ResponseRecorder {
+	return serve(handler, httptest.NewRequest(http.MethodGet, path, nil))
+}
+
+// eventually waits for condition, e.g. for a cache write done in the
+// background after the response.
+func eventually(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); !condition(); {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func cachedKeys(t *testing.T, cache *cachetest.MockCache) []string {
+	t.Helper()
+
+	keys, err := cache.Keys("")
+	if err != nil {
+		t.Fatalf("Keys failed: %s", err)
+	}
+
+	return keys
+}
+
+func cachedBlobs(t *testing.T, directory string) int {
+	t.Helper()
+
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		t.Fatalf("Failed to list the blob store: %s", err)
+	}
+
+	blobs := 0
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), ".") {
+			blobs++
+		}
+	}
+
+	return blobs
+}
+
+// npmRegistry is an npm registry serving a single package, lodash, with one
+// version and its tarball.
+type npmRegistry struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	requests map[string]int
+	headers  []http.Header
+	// tarball is served for the version, shasum is what the metadata
+	// lists for it.
+	tarball []byte
+	shasum  string
+	// gate holds back the metadata responses until it is closed.
+	gate chan struct{}
+}
+
+func newNPMRegistry(t *testing.T) *npmRegistry {
+	registry := &npmRegistry{requests: map[string]int{}, tarball: []byte("the lodash tarball")}
+	sum := sha1.Sum(registry.tarball)
+	registry.shasum = hex.EncodeToString(sum[:])
+
+	registry.Server = httptest.NewServer(http.HandlerFunc(registry.serve))
+	t.Cleanup(registry.Close)
+
+	return registry
+}
+
+func (registry *npmRegistry) serve(wr http.ResponseWriter, r *http.Request) {
+	registry.mutex.Lock()
+	registry.requests[r.URL.Path]++
+	registry.headers = append(registry.headers, r.Header.Clone())
+	gate := registry.gate
+	registry.mutex.Unlock()
+
+	switch r.URL.Path {
+	case "/lodash":
+		if gate != nil {
+			<-gate
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			wr.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		integrity := sha512.Sum512(registry.tarball)
+		wr.Header().Set("Content-Type", "application/json")
+		wr.Header().Set("ETag", `"v1"`)
+		fmt.Fprintf(wr, `{"name":"lodash","versions":{"1.0.0":{"dist":{"tarball":"%s/lodash/-/lodash-1.0.0.tgz","shasum":"%s","integrity":"sha512-%s"}}}}`,
+			registry.URL, registry.shasum, base64.StdEncoding.EncodeToString(integrity[:]))
+	case "/lodash/-/lodash-1.0.0.tgz":
+		wr.Write(registry.tarball)
+	default:
+		http.NotFound(wr, r)
+	}
+}
+
+// requestCount returns how many requests for path the registry received.
+func (registry *npmRegistry) requestCount(path string) int {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	return registry.requests[path]
+}
+
+func (registry *npmRegistry) lastHeader() http.Header {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	return registry.headers[len(registry.headers)-1]
+}
+
+func npmConfig(registry *npmRegistry) levee.Config {
+	return levee.Config{ExternalRegistries: []levee.Registry{{URL: registry.URL}}}
+}
+
+func TestCachesPackageMetadata(t *testing.T) {
+	registry := newNPMRegistry(t)
+	handler, cache := startLevee(t, npmConfig(registry))
+
+	first := get(handler, "/lodash")
+	if first.Code != http.StatusOK {
+		t.Fatalf("The first request returned %d: %s", first.Code, first.Body)
+	}
+	eventually(t, func() bool { return len(cachedKeys(t, cache)) > 0 })
+
+	second := get(handler, "/lodash")
+	if second.Code != http.StatusOK || second.Body.String() != first.Body.String() {
+		t.Errorf("The cached response is %d %q, expected %q", second.Code, second.Body, first.Body)
+	}
+	if requests := registry.requestCount("/lodash"); requests != 1 {
+		t.Errorf("The registry received %d requests, expected the second to be served from the cache", requests)
+	}
+}
+
+func TestCoalescesConcurrentCacheMisses(t *testing.T) {
+	registry := newNPMRegistry(t)
+	registry.gate = make(chan struct{})
+	handler, _ := startLevee(t, npmConfig(registry))
+
+	const clients = 10
+	codes := make(chan int, clients)
+	for i := 0; i < clients; i++ {
+		go func() {
+			codes <- get(handler, "/lodash").Code
+		}()
+	}
+
+	eventually(t, func() bool { return registry.requestCount("/lodash") > 0 })
+	// Gives the other clients the time to join the fetch in progress.
+	time.Sleep(100 * time.Millisecond)
+	close(registry.gate)
+
+	for i := 0; i < clients; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("A client got %d", code)
+		}
+	}
+	if requests := registry.requestCount("/lodash"); requests != 1 {
+		t.Errorf("%d clients made %d registry requests, expected a single one", clients, requests)
+	}
+}
+
+func TestRevalidatesExpiredMetadata(t *testing.T) {
+	registry := newNPMRegistry(t)
+	handler, cache := startLevee(t, npmConfig(registry))
+
+	first := get(handler, "/lodash")
+	eventually(t, func() bool { return len(cachedKeys(t, cache)) > 0 })
+	key := cachedKeys(t, cache)[0]
+	if err := cache.Set(key, map[string]string{"hardExpiresAt": "1"}); err != nil {
+		t.Fatalf("Failed to expire %s: %s", key, err)
+	}
+
+	second := get(handler, "/lodash")
+	if second.Code != http.StatusOK || second.Body.String() != first.Body.String() {
+		t.Errorf("The revalidated response is %d %q, expected %q", second.Code, second.Body, first.Body)
+	}
+	if etag := registry.lastHeader().Get("If-None-Match"); etag != `"v1"` {
+		t.Errorf("The expired document was fetched with If-None-Match %q, expected its ETag", etag)
+	}
+
+	eventually(t, func() bool {
+		fields, err := cache.Get(key)
+		return err == nil && fields["hardExpiresAt"] != "1"
+	})
+	fields, _ := cache.Get(key)
+	if fields["wholeResponse"] == "" {
+		t.Error("Re-arming the revalidated document dropped its response")
+	}
+}
+
+func TestRoutesPackagesToTheirUpstreams(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/@corp/lib" {
+			http.NotFound(wr, r)
+			return
+		}
+		wr.Header().Set("Content-Type", "application/json")
+		io.WriteString(wr, `{"name":"@corp/lib","description":"internal"}`)
+	}))
+	defer internal.Close()
+	external := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
+		wr.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(wr, `{"name":%q,"description":"external"}`, strings.TrimPrefix(r.URL.Path, "/"))
+	}))
+	defer external.Close()
+
+	config := levee.Config{
+		InternalRegistries: []levee.Registry{{URL: internal.URL}},
+		ExternalRegistries: []levee.Registry{{URL: external.URL}},
+		RoutingRules:       []levee.RoutingRule{{Pattern: "@corp/*", Upstreams: "internal"}},
+	}
+	handler, _ := startLevee(t, config)
+
+	tests := []struct {
+		path        string
+		code        int
+		description string
+	}{
+		{"/@corp/lib", http.StatusOK, "internal"},
+		{"/@corp/unpublished", http.StatusNotFound, ""},
+		{"/lodash", http.StatusOK, "external"},
+	}
+	for _, test := range tests {
+		wr := get(handler, test.path)
+		if wr.Code != test.code {
+			t.Errorf("%s returned %d, expected %d", test.path, wr.Code, test.code)
+		} else if !strings.Contains(wr.Body.String(), test.description) {
+			t.Errorf("%s returned %s, expected the %s package", test.path, wr.Body, test.description)
+		}
+	}
+}
+
+func TestReportsUnreachableRegistries(t *testing.T) {
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+
+	config := levee.Config{
+		InternalRegistries: []levee.Registry{{URL: unreachable.URL}},
+		ExternalRegistries: []levee.Registry{{URL: missing.URL}},
+		UpstreamGroups: []levee.UpstreamGroup{
+			{Name: "down", Registries: []levee.Registry{{URL: unreachable.URL}}},
+			{Name: "missing", Registries: []levee.Registry{{URL: missing.URL}}},
+		},
+		RoutingRules: []levee.RoutingRule{
+			{Pattern: "@corp/*", Upstreams: "internal"},
+			{Pattern: "@down/*", Groups: []string{"down"}},
+			{Pattern: "@missing/*", Groups: []string{"missing", "down"}},
+		},
+	}
+	handler, _ := startLevee(t, config)
+
+	tests := []struct {
+		path string
+		code int
+	}{
+		{"/@corp/lib", http.StatusBadGateway},
+		{"/@down/lib", http.StatusBadGateway},
+		{"/@missing/lib", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		if wr := get(handler, test.path); wr.Code != test.code {
+			t.Errorf("%s returned %d, expected %d", test.path, wr.Code, test.code)
+		}
+	}
+}
+
+func TestRejectsTarballsFailingIntegrity(t *testing.T) {
+	registry := newNPMRegistry(t)
+	registry.tarball = []byte("a tampered tarball")
+	config := npmConfig(registry)
+	config.Cache.Blobs.Directory = t.TempDir()
+	handler, _ := startLevee(t, config)
+
+	wr := get(handler, "/lodash/-/lodash-1.0.0.tgz")
+	if wr.Code != http.StatusBadGateway {
+		t.Errorf("A tarball failing its integrity returned %d, expected %d", wr.Code, http.StatusBadGateway)
+	}
+	if strings.Contains(wr.Body.String(), "tampered") {
+		t.Error("The tampered tarball was served")
+	}
+	if blobs := cachedBlobs(t, config.Cache.Blobs.Directory); blobs != 0 {
+		t.Errorf("The blob store holds %d blobs, expected the tampered tarball not to be cached", blobs)
+	}
+}
+
+func TestVulnerabilityGateFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		failOpen bool
+		code     int
+	}{
+		{"FailClosed", false, http.StatusServiceUnavailable},
+		{"FailOpen", true, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The registry has no advisory endpoint, every check fails.
+			registry := newNPMRegistry(t)
+			config := npmConfig(registry)
+			config.VulnerabilityGate = levee.VulnerabilityGateConfig{Source: "npm", FailOpen: test.failOpen}
+			handler, _ := startLevee(t, config)
+
+			if wr := get(handler, "/lodash/-/lodash-1.0.0.tgz"); wr.Code != test.code {
+				t.Errorf("A tarball that couldn't be checked returned %d, expected %d", wr.Code, test.code)
+			}
+		})
+	}
+}
+
+func TestRewritesTarballLinks(t *testing.T) {
+	tests := []struct {
+		name      string
+		publicURL string
+		expected  string
+	}{
+		{"Host", "", "http://levee.example.com/lodash/-/lodash-1.0.0.tgz"},
+		{"PublicURL", "https://npm.example.com/levee", "https://npm.example.com/levee/lodash/-/lodash-1.0.0.tgz"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registry := newNPMRegistry(t)
+			config := npmConfig(registry)
+			config.PublicURL = test.publicURL
+			handler, _ := startLevee(t, config)
+
+			wr := get(handler, "http://levee.example.com/lodash")
+			if !strings.Contains(wr.Body.String(), `"tarball":"`+test.expected+`"`) {
+				t.Errorf("The tarball link of %s doesn't point to %s", wr.Body, test.expected)
+			}
+			if strings.Contains(wr.Body.String(), registry.URL) {
+				t.Errorf("%s still links to the registry", wr.Body)
+			}
+		})
+	}
+}
+
+func TestServesTarballRanges(t *testing.T) {
+	registry := newNPMRegistry(t)
+	config := npmConfig(registry)
+	config.Cache.Blobs.Directory = t.TempDir()
+	handler, _ := startLevee(t, config)
+
+	getRange := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/lodash/-/lodash-1.0.0.tgz", nil)
+		r.Header.Set("Range", "bytes=4-9")
+		return serve(handler, r)
+	}
+
+	// The first request is served as it is downloaded, the second from the
+	// blob store.
+	for _, source := range []string{"registry", "blob store"} {
+		wr := getRange()
+		if wr.Code != http.StatusPartialContent || wr.Body.String() != string(registry.tarball[4:10]) {
+			t.Errorf("The range from the %s is %d %q, expected %q", source, wr.Code, wr.Body, registry.tarball[4:10])
+		}
+		eventually(t, func() bool { return cachedBlobs(t, config.Cache.Blobs.Directory) > 0 })
+	}
+	if requests := registry.requestCount("/lodash/-/lodash-1.0.0.tgz"); requests != 1 {
+		t.Errorf("The registry received %d tarball requests, expected 1", requests)
+	}
+}
+
+func TestRequiresClientTokens(t *testing.T) {
+	registry := newNPMRegistry(t)
+	config := npmConfig(registry)
+	config.ClientAuth.Tokens = []string{"secret"}
+	handler, _ := startLevee(t, config)
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		code   int
+	}{
+		{"NoToken", "", "", http.StatusUnauthorized},
+		{"WrongToken", "X-Levee-Token", "guess", http.StatusUnauthorized},
+		{"Token", "X-Levee-Token", "secret", http.StatusOK},
+		{"Bearer", "Authorization", "Bearer secret", http.StatusOK},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/lodash", nil)
+		if test.header != "" {
+			r.Header.Set(test.header, test.value)
+		}
+		if code := serve(handler, r).Code; code != test.code {
+			t.Errorf("%s: returned %d, expected %d", test.name, code, test.code)
+		}
+	}
+
+	if header := registry.lastHeader(); header.Get("Authorization") != "" || header.Get("X-Levee-Token") != "" {
+		t.Errorf("The client token was sent on to the registry: %v", header)
+	}
+}
+
+func TestRateLimitsClients(t *testing.T) {
+	registry := newNPMRegistry(t)
+	config := npmConfig(registry)
+	config.RateLimit = levee.RateLimitConfig{RequestsPerSecond: 0.01, Burst: 2}
+	handler, _ := startLevee(t, config)
+
+	for i, expected := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if code := get(handler, "/lodash").Code; code != expected {
+			t.Errorf("Request %d returned %d, expected %d", i+1, code, expected)
+		}
+	}
+
+	other := httptest.NewRequest(http.MethodGet, "/lodash", nil)
+	other.RemoteAddr = "198.51.100.1:1234"
+	if code := serve(handler, other).Code; code != http.StatusOK {
+		t.Errorf("Another client returned %d, expected its own limit", code)
+	}
+}
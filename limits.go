@@ -0,0 +1,19 @@
+package levee
+
+import "net/http"
+
+func limitRequestBodies(handler http.Handler, maxBodyBytes int64) http.Handler {
+	if maxBodyBytes <= 0 {
+		return handler
+	}
+
+	return http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > maxBodyBytes {
+			http.Error(wr, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(wr, r.Body, maxBodyBytes)
+		handler.ServeHTTP(wr, r)
+	})
+}
@@ -0,0 +1,233 @@
+package levee
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LoggingConfig struct {
+	Level      string            `yaml:"level"`
+	Format     string            `yaml:"format"`
+	Output     string            `yaml:"output"`
+	Components map[string]string `yaml:"components"`
+}
+
+// Logger receives the log records of levee. A *slog.Logger is one, an
+// embedder can pass its own to route them into an existing logging stack.
+type Logger interface {
+	Enabled(ctx context.Context, level slog.Level) bool
+	LogAttrs(ctx context.Context, level slog.Level, msg string, attrs ...slog.Attr)
+}
+
+var logger Logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+// logLevel is the level of the components without one in
+// logging.components.
+var logLevel slog.Level
+var componentLevels map[componentLogger]slog.Level
+
+// componentLogger logs the records of one part of levee, tagged with its name
+// so that its verbosity can be set on its own.
+type componentLogger string
+
+const (
+	proxyLog    componentLogger = "proxy"
+	upstreamLog componentLogger = "upstream"
+	cacheLog    componentLogger = "cache"
+	policyLog   componentLogger = "policy"
+	adminLog    componentLogger = "admin"
+	serverLog   componentLogger = "server"
+	webhooksLog componentLogger = "webhooks"
+	requestsLog componentLogger = "requests"
+)
+
+var logComponents = []componentLogger{proxyLog, upstreamLog, cacheLog, policyLog, adminLog, serverLog, webhooksLog, requestsLog}
+
+type requestLogFields struct {
+	mutex sync.Mutex
+	attrs []slog.Attr
+}
+
+type requestLogFieldsKey struct{}
+
+func parseLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return level, fmt.Errorf("unknown log level %q", name)
+	}
+
+	return level, nil
+}
+
+// configureLogging sets the log levels from config and, unless an embedder
+// passed its own logger, the handler writing the records.
+func configureLogging(config LoggingConfig, customLogger Logger) error {
+	level := slog.LevelInfo
+	if config.Level != "" {
+		var err error
+		if level, err = parseLogLevel(config.Level); err != nil {
+			return err
+		}
+	} else if customLogger != nil {
+		level = slog.LevelDebug
+	}
+
+	levels := map[componentLogger]slog.Level{}
+	handlerLevel := level
+	for name, componentLevel := range config.Components {
+		component := componentLogger(name)
+		if !isLogComponent(component) {
+			return fmt.Errorf("logging.components: unknown component %q, expected one of %v", name, logComponents)
+		}
+
+		parsedLevel, err := parseLogLevel(componentLevel)
+		if err != nil {
+			return fmt.Errorf("logging.components.%s: %s", name, err)
+		}
+		levels[component] = parsedLevel
+		if parsedLevel < handlerLevel {
+			handlerLevel = parsedLevel
+		}
+	}
+
+	if customLogger != nil {
+		logger, logLevel, componentLevels = customLogger, level, levels
+		return nil
+	}
+
+	var output io.Writer = os.Stderr
+	switch config.Output {
+	case "", "stderr":
+	case "stdout":
+		output = os.Stdout
+	default:
+		file, err := os.OpenFile(config.Output, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		output = file
+	}
+
+	options := &slog.HandlerOptions{Level: handlerLevel}
+	switch strings.ToLower(config.Format) {
+	case "", "logfmt", "text":
+		logger = slog.New(slog.NewTextHandler(output, options))
+	case "json":
+		logger = slog.New(slog.NewJSONHandler(output, options))
+	default:
+		return fmt.Errorf("unknown log format %q, expected logfmt or json", config.Format)
+	}
+	logLevel, componentLevels = level, levels
+
+	return nil
+}
+
+func isLogComponent(component componentLogger) bool {
+	for _, known := range logComponents {
+		if component == known {
+			return true
+		}
+	}
+
+	return false
+}
+
+func setLogField(r *http.Request, key string, value interface{}) {
+	fields, ok := r.Context().Value(requestLogFieldsKey{}).(*requestLogFields)
+	if !ok {
+		return
+	}
+
+	fields.mutex.Lock()
+	defer fields.mutex.Unlock()
+
+	for i, attr := range fields.attrs {
+		if attr.Key == key {
+			fields.attrs[i] = slog.Any(key, value)
+			return
+		}
+	}
+	fields.attrs = append(fields.attrs, slog.Any(key, value))
+}
+
+func requestLogAttrs(r *http.Request) []slog.Attr {
+	attrs := []slog.Attr{slog.String("method", r.Method), slog.String("path", r.URL.Path)}
+	if requestID := r.Header.Get(requestIDHeader); requestID != "" {
+		attrs = append(attrs, slog.String("requestID", requestID))
+	}
+
+	if fields, ok := r.Context().Value(requestLogFieldsKey{}).(*requestLogFields); ok {
+		fields.mutex.Lock()
+		attrs = append(attrs, fields.attrs...)
+		fields.mutex.Unlock()
+	}
+
+	return attrs
+}
+
+func (component componentLogger) enabled(ctx context.Context, level slog.Level) bool {
+	minimum, found := componentLevels[component]
+	if !found {
+		minimum = logLevel
+	}
+
+	return level >= minimum && logger.Enabled(ctx, level)
+}
+
+func (component componentLogger) logf(r *http.Request, level slog.Level, format string, args ...interface{}) {
+	ctx := context.Background()
+	if r != nil {
+		ctx = r.Context()
+	}
+	if !component.enabled(ctx, level) {
+		return
+	}
+
+	attrs := []slog.Attr{slog.String("component", string(component))}
+	if r != nil {
+		attrs = append(attrs, requestLogAttrs(r)...)
+	}
+
+	logger.LogAttrs(ctx, level, fmt.Sprintf(format, args...), attrs...)
+}
+
+func (component componentLogger) debugf(r *http.Request, format string, args ...interface{}) {
+	component.logf(r, slog.LevelDebug, format, args...)
+}
+
+func (component componentLogger) infof(r *http.Request, format string, args ...interface{}) {
+	component.logf(r, slog.LevelInfo, format, args...)
+}
+
+func (component componentLogger) warnf(r *http.Request, format string, args ...interface{}) {
+	component.logf(r, slog.LevelWarn, format, args...)
+}
+
+func (component componentLogger) errorf(r *http.Request, format string, args ...interface{}) {
+	component.logf(r, slog.LevelError, format, args...)
+}
+
+func logRequests(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r = r.WithContext(context.WithValue(r.Context(), requestLogFieldsKey{}, &requestLogFields{}))
+
+		recorder := &statusRecorder{ResponseWriter: wr, statusCode: http.StatusOK}
+		handler.ServeHTTP(recorder, r)
+
+		if !strings.HasPrefix(r.URL.Path, "/-/levee/") {
+			recordRecentRequest(recentRequestFrom(r, start, recorder.statusCode))
+		}
+
+		setLogField(r, "status", recorder.statusCode)
+		setLogField(r, "duration", time.Since(start))
+		requestsLog.infof(r, "Handled %s %s", r.Method, r.URL.Path)
+	})
+}
@@ -0,0 +1,145 @@
+package levee
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// mavenProtocol serves a Maven repository to Maven and Gradle. Artifacts
+// never change once published and are kept for good after their checksum
+// has been verified, maven-metadata.xml lists the versions and is cached for
+// the metadata TTL.
+type mavenProtocol struct {
+	*repository
+}
+
+var errChecksumMismatch = errors.New("the artifact does not match its published checksum")
+
+// mavenChecksums are tried in order, the first one the upstream publishes is
+// verified.
+var mavenChecksums = []struct {
+	extension string
+	newHash   func() hash.Hash
+}{
+	{".sha1", sha1.New},
+	{".md5", md5.New},
+}
+
+// Checksum and signature files are not verified themselves.
+var mavenUnverifiedExtensions = []string{".sha1", ".md5", ".sha256", ".sha512", ".asc"}
+
+func newMavenProtocol(repo *repository) RegistryProtocol {
+	return mavenProtocol{repository: repo}
+}
+
+func (mavenProtocol) Name() string {
+	return "maven"
+}
+
+func (protocol mavenProtocol) RegisterRoutes(router *mux.Router) {
+	routes := protocol.routes(router, protocol)
+	metadata := protocol.metadataProxy(protocol)
+	files := protocol.artifactProxy(protocol)
+
+	routes.HandleFunc("/{file:.+}", func(wr http.ResponseWriter, r *http.Request) {
+		if isMavenMetadata(r.URL.Path) {
+			metadata(wr, r)
+		} else {
+			files(wr, r)
+		}
+	}).Methods("GET", "HEAD")
+}
+
+// isMavenMetadata tells the documents that change as versions are published,
+// maven-metadata.xml with its checksums and directory listings, apart from
+// artifacts.
+func isMavenMetadata(requestPath string) bool {
+	return strings.HasSuffix(requestPath, "/") || strings.HasPrefix(path.Base(requestPath), "maven-metadata.xml")
+}
+
+func (protocol mavenProtocol) CacheKey(r *http.Request) string {
+	return cacheKey(r.URL.Path)
+}
+
+func (protocol mavenProtocol) Fetch(r *http.Request) (*http.Response, error) {
+	return protocol.fetch(r)
+}
+
+// RewriteResponse leaves the responses as they are, Maven resolves artifacts
+// relative to the repository.
+func (mavenProtocol) RewriteResponse(r *http.Request, resp *http.Response) error {
+	return nil
+}
+
+// VerifyArtifact checks artifact against the first checksum the upstream
+// publishes next to it. Artifacts without any are accepted.
+func (protocol mavenProtocol) VerifyArtifact(r *http.Request, artifact io.Reader) error {
+	for _, extension := range mavenUnverifiedExtensions {
+		if strings.HasSuffix(r.URL.Path, extension) {
+			return nil
+		}
+	}
+
+	for _, checksum := range mavenChecksums {
+		expected, err := protocol.publishedChecksum(r, checksum.extension)
+		if err != nil {
+			return err
+		} else if expected == "" {
+			continue
+		}
+
+		actual := checksum.newHash()
+		if _, err := io.Copy(actual, artifact); err != nil {
+			return err
+		}
+		if !strings.EqualFold(hex.EncodeToString(actual.Sum(nil)), expected) {
+			return fmt.Errorf("%s: %s", path.Base(r.URL.Path), errChecksumMismatch)
+		}
+
+		return nil
+	}
+
+	policyLog.debugf(r, "No checksum to verify %s against", r.URL.Path)
+	return nil
+}
+
+// publishedChecksum fetches the checksum file of the artifact requested by r,
+// returning an empty checksum when the upstream does not publish one.
+func (protocol mavenProtocol) publishedChecksum(r *http.Request, extension string) (string, error) {
+	req, _ := http.NewRequestWithContext(r.Context(), http.MethodGet, r.URL.Path+extension, nil)
+	req.Host = r.Host
+
+	resp, err := protocol.fetch(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return "", err
+	}
+
+	// Some checksum files are followed by the name of the artifact.
+	fields := bytes.Fields(body)
+	if len(fields) == 0 {
+		return "", nil
+	}
+
+	return string(fields[0]), nil
+}
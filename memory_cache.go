@@ -0,0 +1,179 @@
+package levee
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryCacheEntry struct {
+	key       string
+	fields    map[string]string
+	expiresAt time.Time
+}
+
+type memoryCacheStore struct {
+	mutex      sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element
+	recency    *list.List
+}
+
+// NewMemoryCache returns a cache kept in the memory of the process, holding
+// at most maxEntries documents when maxEntries is positive. It is meant for
+// WithCache.
+func NewMemoryCache(maxEntries int) CacheStore {
+	return newMemoryCacheStore(maxEntries)
+}
+
+func newMemoryCacheStore(maxEntries int) *memoryCacheStore {
+	return &memoryCacheStore{
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		recency:    list.New(),
+	}
+}
+
+func (store *memoryCacheStore) Get(key string) (map[string]string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	fields, _, found := store.get(key)
+	if !found {
+		return nil, ErrCacheMiss
+	}
+
+	return fields, nil
+}
+
+func (store *memoryCacheStore) GetManyWithTTL(keys []string) ([]map[string]string, []time.Duration, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	entries := make([]map[string]string, len(keys))
+	ttls := make([]time.Duration, len(keys))
+	for i, key := range keys {
+		entries[i], ttls[i], _ = store.get(key)
+	}
+
+	return entries, ttls, nil
+}
+
+// get returns a copy of the fields of key and the time it has left, which is
+// negative when it does not expire. The caller holds the mutex.
+func (store *memoryCacheStore) get(key string) (map[string]string, time.Duration, bool) {
+	element, ok := store.entries[key]
+	if !ok {
+		return nil, 0, false
+	}
+
+	entry := element.Value.(*memoryCacheEntry)
+	ttl := time.Duration(-1)
+	if !entry.expiresAt.IsZero() {
+		if ttl = time.Until(entry.expiresAt); ttl <= 0 {
+			store.removeElement(element)
+			return nil, 0, false
+		}
+	}
+
+	store.recency.MoveToFront(element)
+
+	fields := make(map[string]string, len(entry.fields))
+	for field, value := range entry.fields {
+		fields[field] = value
+	}
+
+	return fields, ttl, true
+}
+
+func (store *memoryCacheStore) Set(key string, fields map[string]string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if element, ok := store.entries[key]; ok {
+		entry := element.Value.(*memoryCacheEntry)
+		if !entry.expiresAt.IsZero() && time.Now().After(entry.expiresAt) {
+			entry.fields = make(map[string]string, len(fields))
+			entry.expiresAt = time.Time{}
+		}
+		for field, value := range fields {
+			entry.fields[field] = value
+		}
+		store.recency.MoveToFront(element)
+		return nil
+	}
+
+	entry := &memoryCacheEntry{key: key, fields: make(map[string]string, len(fields))}
+	for field, value := range fields {
+		entry.fields[field] = value
+	}
+	store.entries[key] = store.recency.PushFront(entry)
+
+	for store.maxEntries > 0 && store.recency.Len() > store.maxEntries {
+		store.removeElement(store.recency.Back())
+	}
+
+	return nil
+}
+
+func (store *memoryCacheStore) Expire(key string, expiration time.Duration) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if element, ok := store.entries[key]; ok {
+		element.Value.(*memoryCacheEntry).expiresAt = time.Now().Add(expiration)
+	}
+
+	return nil
+}
+
+func (store *memoryCacheStore) Delete(key string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if element, ok := store.entries[key]; ok {
+		store.removeElement(element)
+	}
+
+	return nil
+}
+
+func (store *memoryCacheStore) Keys(prefix string) ([]string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var keys []string
+	now := time.Now()
+	for key, element := range store.entries {
+		entry := element.Value.(*memoryCacheEntry)
+		if strings.HasPrefix(key, prefix) && (entry.expiresAt.IsZero() || now.Before(entry.expiresAt)) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+func (store *memoryCacheStore) DocumentsSize(prefix string) (int, int64, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	documents := 0
+	var totalBytes int64
+	now := time.Now()
+	for key, element := range store.entries {
+		entry := element.Value.(*memoryCacheEntry)
+		if strings.HasPrefix(key, prefix) && (entry.expiresAt.IsZero() || now.Before(entry.expiresAt)) {
+			documents++
+			totalBytes += int64(len(entry.fields["wholeResponse"]))
+		}
+	}
+
+	return documents, totalBytes, nil
+}
+
+func (store *memoryCacheStore) removeElement(element *list.Element) {
+	store.recency.Remove(element)
+	delete(store.entries, element.Value.(*memoryCacheEntry).key)
+}
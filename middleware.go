@@ -0,0 +1,89 @@
+package levee
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+type middleware func(http.Handler) http.Handler
+
+// defaultMiddlewareOrder lists the middlewares wrapping the router, the
+// outermost first. The middlewares config can reorder them but has to name
+// each of them once, so reordering never drops one by accident.
+var defaultMiddlewareOrder = []string{"bodyLimit", "accessLog", "logging", "requestID", "addressFilter", "cors", "rateLimit", "clientAuth", "plugins", "compression"}
+
+func validateMiddlewareOrder(order []string) error {
+	if len(order) == 0 {
+		return nil
+	}
+
+	seen := make(map[string]bool, len(order))
+	for _, name := range order {
+		if seen[name] {
+			return fmt.Errorf("middlewares: %s is listed twice", name)
+		}
+		seen[name] = true
+	}
+
+	var missing []string
+	for _, name := range defaultMiddlewareOrder {
+		if !seen[name] {
+			missing = append(missing, name)
+		}
+		delete(seen, name)
+	}
+	for name := range seen {
+		return fmt.Errorf("middlewares: %q is unknown, expected %s", name, strings.Join(defaultMiddlewareOrder, ", "))
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("middlewares: %s missing, the list has to name every middleware", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+func serverMiddlewares(config Config, accessLog io.Writer, clientFilter ipFilter, adminFilter ipFilter, stop <-chan struct{}) map[string]middleware {
+	return map[string]middleware{
+		"bodyLimit": func(handler http.Handler) http.Handler {
+			return limitRequestBodies(handler, config.Server.MaxBodyBytes)
+		},
+		"accessLog": func(handler http.Handler) http.Handler {
+			return writeAccessLog(handler, accessLog, config.AccessLog.Format)
+		},
+		"logging":   logRequests,
+		"requestID": assignRequestID,
+		"addressFilter": func(handler http.Handler) http.Handler {
+			return restrictAddresses(handler, clientFilter, adminFilter)
+		},
+		"cors": func(handler http.Handler) http.Handler {
+			return handleCORS(handler, config.CORS)
+		},
+		"rateLimit": func(handler http.Handler) http.Handler {
+			return limitRequestRate(handler, config.RateLimit, stop)
+		},
+		"clientAuth": requireClientToken,
+		"plugins":    runBeforeRequestHooks,
+		"compression": func(handler http.Handler) http.Handler {
+			if !config.Server.Compression {
+				return handler
+			}
+			return compressResponses(handler)
+		},
+	}
+}
+
+// chainMiddlewares wraps handler in the middlewares named by order, the first
+// one ending up outermost.
+func chainMiddlewares(handler http.Handler, middlewares map[string]middleware, order []string) http.Handler {
+	if len(order) == 0 {
+		order = defaultMiddlewareOrder
+	}
+
+	for i := len(order) - 1; i >= 0; i-- {
+		handler = middlewares[order[i]](handler)
+	}
+
+	return handler
+}
@@ -0,0 +1,78 @@
+package levee
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+type npmProtocol struct{}
+
+var npm RegistryProtocol = npmProtocol{}
+
+func (npmProtocol) Name() string {
+	return "npm"
+}
+
+func (npmProtocol) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/-/whoami", internalPassthrough).Methods("GET")
+	router.HandleFunc("/-/user/token/{token}", internalPassthrough).Methods("DELETE")
+	router.HandleFunc("/-/user/{user}", internalPassthrough).Methods("GET", "PUT")
+	router.HandleFunc("/-/v1/login", internalPassthrough).Methods("POST")
+	router.HandleFunc("/-/npm/v1/tokens", internalPassthrough).Methods("GET", "POST")
+	router.HandleFunc("/-/npm/v1/tokens/token/{token}", internalPassthrough).Methods("DELETE")
+	router.HandleFunc("/-/v1/search", searchProxy).Methods("GET", "HEAD")
+	router.HandleFunc("/-/npm/v1/security/audits", externalPassthrough).Methods("POST")
+	router.HandleFunc("/-/npm/v1/security/audits/quick", externalPassthrough).Methods("POST")
+	router.HandleFunc("/-/npm/v1/security/advisories/bulk", externalPassthrough).Methods("POST")
+	router.HandleFunc("/-/package/{scope:@[^/]+}/{package}/dist-tags", distTagsProxy).Methods("GET")
+	router.HandleFunc("/-/package/{scope:@[^/]+}/{package}/dist-tags/{tag}", distTagsProxy).Methods("GET", "PUT", "DELETE")
+	router.HandleFunc("/-/package/{package}/dist-tags", distTagsProxy).Methods("GET")
+	router.HandleFunc("/-/package/{package}/dist-tags/{tag}", distTagsProxy).Methods("GET", "PUT", "DELETE")
+	router.HandleFunc("/npm", cachfulProxy).Methods("GET", "HEAD")
+	router.HandleFunc("/{scope:@[^/]+}/{package}/-/{tarball}", recordDownloads(enforcePackagePolicy(enforceVulnerabilityGate(tarballProxy)))).Methods("GET", "HEAD")
+	router.HandleFunc("/{package}/-/{tarball}", recordDownloads(enforcePackagePolicy(enforceVulnerabilityGate(tarballProxy)))).Methods("GET", "HEAD")
+	router.HandleFunc("/{scope:@[^/]+}/{package}", enforcePackagePolicy(cachfulProxy)).Methods("GET", "HEAD")
+	router.HandleFunc("/{scope:@[^/]+}/{package}", publishProxy).Methods("PUT")
+	router.HandleFunc("/{scope:@[^/]+}/{package}/{version}", enforcePackagePolicy(cachfulProxy)).Methods("GET", "HEAD")
+	router.HandleFunc("/{package}", enforcePackagePolicy(cachfulProxy)).Methods("GET", "HEAD")
+	router.HandleFunc("/{package}", publishProxy).Methods("PUT")
+	router.HandleFunc("/{package}/{version}", enforcePackagePolicy(cachfulProxy)).Methods("GET", "HEAD")
+	router.HandleFunc("/", cachelessProxy)
+}
+
+func (npmProtocol) CacheKey(r *http.Request) string {
+	key := cacheKey(r.URL.Path)
+	if r.URL.RawQuery != "" {
+		key = fmt.Sprintf("%s?%s", key, r.URL.Query().Encode())
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), abbreviatedMetadataType) {
+		return key + abbreviatedMetadataSuffix
+	}
+
+	return key
+}
+
+func (npmProtocol) Fetch(r *http.Request) (*http.Response, error) {
+	return fetchPackage(r)
+}
+
+// RewriteResponse points the tarballs of packuments at levee and, for those
+// of external registries, hides the versions still in quarantine. A
+// packument with hidden versions loses its ETag, so that it is downloaded
+// again rather than revalidated once they are out of quarantine.
+func (npmProtocol) RewriteResponse(r *http.Request, resp *http.Response) error {
+	quarantined := isExternalResponse(resp)
+	packageName := packageNameFromPath(r.URL.Path)
+
+	return rewriteJSONResponse(resp, func(metadata map[string]interface{}) bool {
+		hidden := quarantined && hideQuarantinedVersions(packageName, metadata)
+		if hidden {
+			resp.Header.Del("Etag")
+		}
+		return rewriteMetadataTarballs(metadata, cachedBaseURL) || hidden
+	})
+}
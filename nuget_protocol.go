@@ -0,0 +1,59 @@
+package levee
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// nugetProtocol serves a NuGet v3 feed: the service index, the registration
+// and catalog documents and the flat container of package files. The links
+// of the documents are rewritten to go through levee, the .nupkg and .nuspec
+// files of a version never change and are kept for good.
+type nugetProtocol struct {
+	*repository
+}
+
+const nugetFlatContainer = "/v3-flatcontainer/"
+
+func newNuGetProtocol(repo *repository) RegistryProtocol {
+	return nugetProtocol{repository: repo}
+}
+
+func (nugetProtocol) Name() string {
+	return "nuget"
+}
+
+func (protocol nugetProtocol) RegisterRoutes(router *mux.Router) {
+	routes := protocol.routes(router, protocol)
+	metadata := protocol.metadataProxy(protocol)
+	files := protocol.artifactProxy(protocol)
+
+	// The version list of a package is the only file of the flat container
+	// that changes.
+	routes.HandleFunc(nugetFlatContainer+"{id}/index.json", metadata).Methods("GET", "HEAD")
+	routes.HandleFunc(nugetFlatContainer+"{id}/{version}/{file}", files).Methods("GET", "HEAD")
+	routes.HandleFunc("/{file:.+}", metadata).Methods("GET", "HEAD")
+}
+
+// CacheKey ignores the case of the path, NuGet package ids and versions are
+// case insensitive and the clients do not agree on how to spell them.
+func (protocol nugetProtocol) CacheKey(r *http.Request) string {
+	return cacheKey(strings.ToLower(r.URL.Path))
+}
+
+func (protocol nugetProtocol) Fetch(r *http.Request) (*http.Response, error) {
+	return protocol.fetch(r)
+}
+
+// RewriteResponse points the links of the JSON documents at levee, among
+// them the resources of the service index and the packageContent URLs of the
+// registrations.
+func (protocol nugetProtocol) RewriteResponse(r *http.Request, resp *http.Response) error {
+	if !strings.HasSuffix(r.URL.Path, ".json") {
+		return nil
+	}
+
+	return protocol.rewriteLinks(r, resp)
+}
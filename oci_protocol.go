@@ -0,0 +1,307 @@
+package levee
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ociProtocol is a pull-through cache of an OCI distribution registry, e.g.
+// Docker Hub. Clients expect registries at /v2/ of the host, the images of a
+// repository are pulled as {levee host}/{name}/{image}. Blobs are stored by
+// their digest, shared by every image and repository referencing them.
+type ociProtocol struct {
+	*repository
+	upstreams []ociUpstream
+}
+
+// ociUpstream is a registry whose basic auth credentials are exchanged for
+// bearer tokens at its token endpoint, as the registries ask for, instead
+// of being sent along with every request.
+type ociUpstream struct {
+	registry Registry
+	username string
+	password string
+}
+
+type ociToken struct {
+	token     string
+	expiresAt time.Time
+}
+
+var ociTokens = struct {
+	sync.Mutex
+	tokens map[string]ociToken
+}{tokens: map[string]ociToken{}}
+
+// ociChallenges remembers the last challenge of each upstream per image, so
+// that the next request for the image is sent with a token right away.
+var ociChallenges sync.Map
+
+var ociChallengeParameter = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+var errOCIDigestMismatch = errors.New("the blob does not match its digest")
+
+func newOCIProtocol(repo *repository) RegistryProtocol {
+	protocol := ociProtocol{repository: repo}
+	for _, registry := range repo.Upstreams {
+		upstream := ociUpstream{registry: registry, username: registry.BasicAuth.Username, password: registry.BasicAuth.Password}
+		upstream.registry.BasicAuth.Username = ""
+		upstream.registry.BasicAuth.Password = ""
+		protocol.upstreams = append(protocol.upstreams, upstream)
+	}
+
+	return protocol
+}
+
+func (ociProtocol) Name() string {
+	return "oci"
+}
+
+func (protocol ociProtocol) RegisterRoutes(router *mux.Router) {
+	prefix := "/v2" + protocol.prefix
+	manifests := protocol.metadataProxy(protocol)
+	manifestsByDigest := withProtocol(protocol, func(wr http.ResponseWriter, r *http.Request) {
+		cachedProxy(wr, r, CachePolicy{Pattern: prefix})
+	})
+	blobs := protocol.artifactProxy(protocol)
+
+	router.HandleFunc("/v2/", ociVersionCheck).Methods("GET", "HEAD")
+	router.HandleFunc(prefix+"/{image:.+}/manifests/{reference}", func(wr http.ResponseWriter, r *http.Request) {
+		if _, _, reference := protocol.resource(r); strings.Contains(reference, ":") {
+			manifestsByDigest(wr, r)
+		} else {
+			manifests(wr, r)
+		}
+	}).Methods("GET", "HEAD")
+	router.HandleFunc(prefix+"/{image:.+}/blobs/{digest}", func(wr http.ResponseWriter, r *http.Request) {
+		_, _, digest := protocol.resource(r)
+		wr.Header().Set("Docker-Content-Digest", digest)
+		blobs(wr, r)
+	}).Methods("GET", "HEAD")
+	router.PathPrefix(prefix + "/").HandlerFunc(http.NotFound)
+}
+
+// resource splits the path of a request into the image, the kind of the
+// resource, manifests or blobs, and its reference, a tag or digest.
+func (protocol ociProtocol) resource(r *http.Request) (image string, kind string, reference string) {
+	resourcePath := strings.TrimPrefix(r.URL.Path, "/v2"+protocol.prefix+"/")
+	for _, kind := range []string{"/manifests/", "/blobs/"} {
+		if separator := strings.LastIndex(resourcePath, kind); separator > 0 {
+			return resourcePath[:separator], strings.Trim(kind, "/"), resourcePath[separator+len(kind):]
+		}
+	}
+
+	return resourcePath, "", ""
+}
+
+func ociVersionCheck(wr http.ResponseWriter, r *http.Request) {
+	wr.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	writeJSON(wr, http.StatusOK, map[string]string{})
+}
+
+// CacheKey keys blobs by their digest alone, and manifests by the media types
+// the client accepts, as the registry picks the manifest to return by them.
+func (protocol ociProtocol) CacheKey(r *http.Request) string {
+	if _, kind, digest := protocol.resource(r); kind == "blobs" {
+		return cacheKey("/-/oci/blobs/" + digest)
+	}
+
+	var mediaTypes []string
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(accept, ",") {
+			mediaTypes = append(mediaTypes, strings.TrimSpace(strings.SplitN(mediaType, ";", 2)[0]))
+		}
+	}
+	sort.Strings(mediaTypes)
+
+	return cacheKey(r.URL.Path) + "?accept=" + url.QueryEscape(strings.Join(mediaTypes, ","))
+}
+
+// Fetch gets a manifest or blob from the first upstream that has it, asking
+// the token endpoint of the upstream for a token when it challenges levee.
+func (protocol ociProtocol) Fetch(r *http.Request) (*http.Response, error) {
+	if offline {
+		return nil, errOffline
+	}
+
+	image, kind, reference := protocol.resource(r)
+
+	var resp *http.Response
+	err := errPackageNotFound
+	for _, upstream := range protocol.upstreams {
+		if resp != nil {
+			discardResponse(resp)
+		}
+
+		resp, err = upstream.fetch(r, upstream.imagePath(image), "/"+kind+"/"+reference)
+		if err != nil {
+			continue
+		}
+		if resp.StatusCode != http.StatusNotFound {
+			setLogField(r, "upstream", upstream.registry.URL)
+			return resp, nil
+		}
+	}
+
+	return resp, err
+}
+
+// RewriteResponse drops the challenges of the upstream, levee authenticates
+// to it on its own and must not send clients to its token endpoint.
+func (ociProtocol) RewriteResponse(r *http.Request, resp *http.Response) error {
+	resp.Header.Del("Www-Authenticate")
+	return nil
+}
+
+// VerifyArtifact checks a blob against the digest it is requested by.
+func (protocol ociProtocol) VerifyArtifact(r *http.Request, artifact io.Reader) error {
+	_, _, digest := protocol.resource(r)
+	if !strings.HasPrefix(digest, "sha256:") {
+		policyLog.debugf(r, "Cannot verify the blob %s, only sha256 digests are supported", digest)
+		return nil
+	}
+
+	sum := sha256.New()
+	if _, err := io.Copy(sum, artifact); err != nil {
+		return err
+	}
+	if hex.EncodeToString(sum.Sum(nil)) != strings.TrimPrefix(digest, "sha256:") {
+		return fmt.Errorf("%s: %s", digest, errOCIDigestMismatch)
+	}
+
+	return nil
+}
+
+// imagePath is the path of image on the upstream, official images of Docker
+// Hub live below library/.
+func (upstream ociUpstream) imagePath(image string) string {
+	if registryURL, err := url.Parse(upstream.registry.URL); err == nil && registryURL.Host == "registry-1.docker.io" && !strings.Contains(image, "/") {
+		image = "library/" + image
+	}
+
+	return "/v2/" + image
+}
+
+func (upstream ociUpstream) fetch(r *http.Request, imagePath string, resource string) (*http.Response, error) {
+	upstreamRequest := r.Clone(r.Context())
+	upstreamRequest.URL.Path = imagePath + resource
+	upstreamRequest.URL.RawPath = ""
+
+	// The token is sent as the token of the registry, the credentials of
+	// clients are not forwarded.
+	registries := []Registry{upstream.registry}
+	challengeKey := upstream.registry.URL + imagePath
+	challenge := ""
+	if lastChallenge, found := ociChallenges.Load(challengeKey); found {
+		challenge = lastChallenge.(string)
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		if challenge != "" {
+			token, err := upstream.token(r, challenge)
+			if err != nil {
+				return nil, err
+			}
+			registries[0].Token = token
+		}
+
+		resp, _, err := fetchFromRegistries(registries, upstreamRequest, isAnyResponse)
+		if err != nil {
+			return nil, err
+		}
+
+		nextChallenge := resp.Header.Get("Www-Authenticate")
+		if resp.StatusCode != http.StatusUnauthorized || !strings.HasPrefix(nextChallenge, "Bearer ") || attempt > 0 {
+			return resp, nil
+		}
+
+		discardResponse(resp)
+		challenge = nextChallenge
+		ociChallenges.Store(challengeKey, challenge)
+	}
+
+	return nil, fmt.Errorf("registry %s keeps asking for a token", upstream.registry.URL)
+}
+
+// token returns a token answering challenge, the WWW-Authenticate header of
+// the upstream, reusing the tokens it handed out till they expire.
+func (upstream ociUpstream) token(r *http.Request, challenge string) (string, error) {
+	parameters := map[string]string{}
+	for _, match := range ociChallengeParameter.FindAllStringSubmatch(challenge, -1) {
+		parameters[match[1]] = match[2]
+	}
+	if parameters["realm"] == "" {
+		return "", fmt.Errorf("registry %s sent a challenge without a realm", upstream.registry.URL)
+	}
+
+	tokenURL, err := url.Parse(parameters["realm"])
+	if err != nil {
+		return "", err
+	}
+	query := tokenURL.Query()
+	for _, name := range []string{"service", "scope"} {
+		if parameters[name] != "" {
+			query.Set(name, parameters[name])
+		}
+	}
+	tokenURL.RawQuery = query.Encode()
+
+	key := upstream.username + "@" + tokenURL.String()
+	ociTokens.Lock()
+	cached, found := ociTokens.tokens[key]
+	ociTokens.Unlock()
+	if found && time.Now().Before(cached.expiresAt) {
+		return cached.token, nil
+	}
+
+	req, _ := http.NewRequestWithContext(r.Context(), http.MethodGet, tokenURL.String(), nil)
+	if upstream.username != "" {
+		req.SetBasicAuth(upstream.username, upstream.password)
+	}
+
+	resp, err := upstream.registry.client().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer discardResponse(resp)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("the token endpoint of registry %s responded with %d", upstream.registry.URL, resp.StatusCode)
+	}
+
+	var tokenResponse struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResponse); err != nil {
+		return "", err
+	}
+	if tokenResponse.Token == "" {
+		tokenResponse.Token = tokenResponse.AccessToken
+	}
+	if tokenResponse.ExpiresIn <= 0 {
+		tokenResponse.ExpiresIn = 60
+	}
+
+	// The token is dropped a little before it expires, so that it does not
+	// expire on its way to the registry.
+	expiresIn := time.Duration(tokenResponse.ExpiresIn)*time.Second - 10*time.Second
+	ociTokens.Lock()
+	ociTokens.tokens[key] = ociToken{token: tokenResponse.Token, expiresAt: time.Now().Add(expiresIn)}
+	ociTokens.Unlock()
+
+	return tokenResponse.Token, nil
+}
@@ -0,0 +1,40 @@
+package levee
+
+import (
+	"net/url"
+	"strings"
+)
+
+const packageAPIPrefix = "/-/package"
+
+func packageNameFromPath(requestPath string) string {
+	unescapedPath, err := url.PathUnescape(strings.TrimPrefix(requestPath, "/"))
+	if err != nil {
+		unescapedPath = strings.TrimPrefix(requestPath, "/")
+	}
+
+	segments := strings.SplitN(unescapedPath, "/", 3)
+	if strings.HasPrefix(unescapedPath, "@") && len(segments) > 1 {
+		return segments[0] + "/" + segments[1]
+	}
+
+	return segments[0]
+}
+
+func upstreamPath(requestPath string) string {
+	if strings.HasPrefix(requestPath, packageAPIPrefix) {
+		return packageAPIPrefix + upstreamPath(strings.TrimPrefix(requestPath, packageAPIPrefix))
+	}
+
+	if !strings.HasPrefix(requestPath, "/@") || strings.Contains(requestPath, "/-/") {
+		return requestPath
+	}
+
+	segments := strings.SplitN(strings.TrimPrefix(requestPath, "/"), "/", 3)
+	if len(segments) < 2 {
+		return requestPath
+	}
+
+	segments[1] = segments[0] + "%2f" + segments[1]
+	return "/" + strings.Join(segments[1:], "/")
+}
@@ -0,0 +1,94 @@
+package levee
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+)
+
+type PackagePolicyRule struct {
+	Pattern string `yaml:"pattern"`
+	Regex   string `yaml:"regex"`
+	Action  string `yaml:"action"`
+	Reason  string `yaml:"reason"`
+
+	regex *regexp.Regexp
+}
+
+type PackagePolicy struct {
+	DefaultAction string              `yaml:"defaultAction"`
+	Rules         []PackagePolicyRule `yaml:"rules"`
+}
+
+func compilePackagePolicy(policy PackagePolicy) (PackagePolicy, error) {
+	switch policy.DefaultAction {
+	case "":
+		policy.DefaultAction = "allow"
+	case "allow", "block":
+	default:
+		return policy, fmt.Errorf("unknown package policy default action %q, expected allow or block", policy.DefaultAction)
+	}
+
+	for i, rule := range policy.Rules {
+		switch rule.Action {
+		case "allow", "block":
+		default:
+			return policy, fmt.Errorf("package policy rule %q has unknown action %q, expected allow or block", rule.Pattern+rule.Regex, rule.Action)
+		}
+
+		if rule.Regex != "" {
+			regex, err := regexp.Compile(rule.Regex)
+			if err != nil {
+				return policy, fmt.Errorf("invalid package policy regex %q: %s", rule.Regex, err)
+			}
+			policy.Rules[i].regex = regex
+		} else if _, err := path.Match(rule.Pattern, ""); err != nil || rule.Pattern == "" {
+			return policy, fmt.Errorf("invalid package policy pattern %q", rule.Pattern)
+		}
+	}
+
+	return policy, nil
+}
+
+func (rule PackagePolicyRule) matches(packageName string) bool {
+	if rule.regex != nil {
+		return rule.regex.MatchString(packageName)
+	}
+
+	matched, _ := path.Match(rule.Pattern, packageName)
+	return matched
+}
+
+func (policy PackagePolicy) verdict(packageName string) (bool, string) {
+	for _, rule := range policy.Rules {
+		if rule.matches(packageName) {
+			return rule.Action == "allow", rule.Reason
+		}
+	}
+
+	return policy.DefaultAction != "block", "it is not on the list of approved packages"
+}
+
+func packageBlockedError(packageName string, reason string) error {
+	if reason == "" {
+		return fmt.Errorf("%s is blocked by the levee package policy", packageName)
+	}
+
+	return fmt.Errorf("%s is blocked by the levee package policy: %s", packageName, reason)
+}
+
+func enforcePackagePolicy(handler http.HandlerFunc) http.HandlerFunc {
+	return func(wr http.ResponseWriter, r *http.Request) {
+		packageName := packageNameFromVars(r)
+
+		if allowed, reason := settings().packagePolicy.verdict(packageName); packageName != "" && !allowed {
+			policyLog.warnf(r, "Blocked %s %s by the package policy", r.Method, r.URL.Path)
+			notify(webhookEvent{Event: eventPolicyBlocked, Package: packageName, Reason: packageBlockedError(packageName, reason).Error()})
+			writeJSON(wr, http.StatusForbidden, map[string]string{"error": packageBlockedError(packageName, reason).Error()})
+			return
+		}
+
+		handler(wr, r)
+	}
+}
@@ -0,0 +1,66 @@
+package levee
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+func passthrough(wr http.ResponseWriter, r *http.Request, registries []Registry) int {
+	if offline {
+		http.Error(wr, errOffline.Error(), http.StatusGatewayTimeout)
+		return http.StatusGatewayTimeout
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusBadRequest)
+		return http.StatusBadRequest
+	}
+
+	responseError := fmt.Errorf("no registry responded to %s %s", r.Method, r.URL.Path)
+
+	for _, registry := range orderRegistries(registries) {
+		if !isUpstreamHealthy(registry.URL) {
+			continue
+		}
+
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		resp, err := proxyRequest(registry, r)
+		if err != nil {
+			responseError = err
+			continue
+		}
+
+		upstreamLog.debugf(r, "Registry %s responded to %s request of %s", registry.URL, r.Method, r.URL.Path)
+		setLogField(r, "upstream", registry.URL)
+
+		for k, v := range resp.Header {
+			wr.Header().Set(k, v[0])
+		}
+		wr.WriteHeader(resp.StatusCode)
+		io.Copy(wr, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	upstreamLog.errorf(r, "All registries failed to response to %s %s: %s", r.Method, r.URL.Path, responseError)
+	http.Error(wr, responseError.Error(), http.StatusBadGateway)
+	return http.StatusBadGateway
+}
+
+func externalPassthrough(wr http.ResponseWriter, r *http.Request) {
+	proxyLog.debugf(r, "An external passthrough request handling for %s %s", r.Method, r.URL.Path)
+
+	passthrough(wr, r, settings().externalRegistries)
+}
+
+func internalPassthrough(wr http.ResponseWriter, r *http.Request) {
+	proxyLog.debugf(r, "An internal passthrough request handling for %s %s", r.Method, r.URL.Path)
+
+	passthrough(wr, r, settings().internalRegistries)
+}
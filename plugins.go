@@ -0,0 +1,106 @@
+package levee
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Plugins add organisation specific logic to levee without forking it. They
+// are compiled in: a file of this package registers a plugin from its init
+// function with registerPlugin, and the plugins config enables it by name.
+//
+//	func init() {
+//		registerPlugin("require-team-header", func(options map[string]string) (Plugin, error) {
+//			return Plugin{BeforeRequest: ...}, nil
+//		})
+//	}
+//
+// Every hook is optional.
+type Plugin struct {
+	// BeforeRequest runs before a request reaches its route. Returning false
+	// means the hook has answered the request itself and stops it.
+	BeforeRequest func(wr http.ResponseWriter, r *http.Request) bool
+	// BeforeUpstream can reorder or drop the registries a request is about
+	// to be sent to, in the order they will be tried.
+	BeforeUpstream func(r *http.Request, registries []Registry) []Registry
+	// BeforeCacheWrite decides whether the upstream response stored under
+	// key is cached, it is still served either way.
+	BeforeCacheWrite func(key string, resp *http.Response) bool
+}
+
+type PluginConfig struct {
+	Name    string            `yaml:"name"`
+	Options map[string]string `yaml:"options"`
+}
+
+var pluginFactories = map[string]func(options map[string]string) (Plugin, error){}
+
+func registerPlugin(name string, factory func(options map[string]string) (Plugin, error)) {
+	if _, registered := pluginFactories[name]; registered {
+		panic(fmt.Sprintf("levee: plugin %s is registered twice", name))
+	}
+	pluginFactories[name] = factory
+}
+
+func loadPlugins(configs []PluginConfig) ([]Plugin, error) {
+	var plugins []Plugin
+
+	for i, config := range configs {
+		factory, registered := pluginFactories[config.Name]
+		if !registered {
+			return nil, fmt.Errorf("plugins[%d]: %q is not compiled into this levee, available plugins: %s", i, config.Name, strings.Join(registeredPlugins(), ", "))
+		}
+
+		plugin, err := factory(config.Options)
+		if err != nil {
+			return nil, fmt.Errorf("plugins[%d]: %s: %s", i, config.Name, err)
+		}
+		plugins = append(plugins, plugin)
+	}
+
+	return plugins, nil
+}
+
+func registeredPlugins() []string {
+	names := make([]string, 0, len(pluginFactories))
+	for name := range pluginFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func runBeforeRequestHooks(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
+		for _, plugin := range settings().activePlugins {
+			if plugin.BeforeRequest != nil && !plugin.BeforeRequest(wr, r) {
+				return
+			}
+		}
+
+		handler.ServeHTTP(wr, r)
+	})
+}
+
+func runBeforeUpstreamHooks(r *http.Request, registries []Registry) []Registry {
+	for _, plugin := range settings().activePlugins {
+		if plugin.BeforeUpstream != nil {
+			registries = plugin.BeforeUpstream(r, registries)
+		}
+	}
+
+	return registries
+}
+
+func runBeforeCacheWriteHooks(key string, resp *http.Response) bool {
+	for _, plugin := range settings().activePlugins {
+		if plugin.BeforeCacheWrite != nil && !plugin.BeforeCacheWrite(key, resp) {
+			return false
+		}
+	}
+
+	return true
+}
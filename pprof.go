@@ -0,0 +1,19 @@
+package levee
+
+import (
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/gorilla/mux"
+)
+
+func registerPprofRoutes(router *mux.Router) {
+	profiles := http.NewServeMux()
+	profiles.HandleFunc("/debug/pprof/", pprof.Index)
+	profiles.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	profiles.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	profiles.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	profiles.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	router.PathPrefix("/-/levee/debug/pprof/").Handler(requireAdminToken(http.StripPrefix("/-/levee", profiles).ServeHTTP))
+}
@@ -0,0 +1,56 @@
+package levee
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+func registerProbeRoutes(router *mux.Router, prefix string) {
+	router.HandleFunc(prefix+"/healthz", healthz).Methods("GET", "HEAD")
+	router.HandleFunc(prefix+"/readyz", readyz).Methods("GET", "HEAD")
+}
+
+func healthz(wr http.ResponseWriter, r *http.Request) {
+	writeJSON(wr, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func readyz(wr http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{"cache": "ok", "upstreams": "ok"}
+	ready := true
+
+	if _, err := cacheStore.Get(cacheKey("readyz")); err != nil && err != ErrCacheMiss {
+		checks["cache"] = err.Error()
+		ready = false
+	}
+
+	if !offline && !anyUpstreamHealthy() {
+		checks["upstreams"] = "no healthy upstream registry"
+		ready = false
+	}
+
+	if !ready {
+		writeJSON(wr, http.StatusServiceUnavailable, map[string]interface{}{"status": "unavailable", "checks": checks})
+		return
+	}
+
+	writeJSON(wr, http.StatusOK, map[string]interface{}{"status": "ok", "checks": checks})
+}
+
+// anyUpstreamHealthy reports whether levee can reach a registry, counting the
+// upstreams of the repositories too. A levee serving repositories only has no
+// npm registries to wait for.
+func anyUpstreamHealthy() bool {
+	registries := append(allRegistries(), repositoryUpstreams()...)
+	if len(registries) == 0 {
+		return true
+	}
+
+	for _, registry := range registries {
+		if isUpstreamHealthy(registry.URL) {
+			return true
+		}
+	}
+
+	return false
+}
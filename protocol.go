@@ -0,0 +1,53 @@
+package levee
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// RegistryProtocol is a package ecosystem levee proxies and caches. npm is
+// the first one; others are added as implementations of this interface
+// instead of more routes hard-coded into the router.
+type RegistryProtocol interface {
+	Name() string
+	// RegisterRoutes adds the routes of the protocol to router, below a
+	// path prefix of its own unless it is npm, which owns the root.
+	RegisterRoutes(router *mux.Router)
+	// CacheKey derives the cache key of a request for a cached document.
+	CacheKey(r *http.Request) string
+	// Fetch gets the document requested by r from the upstream registries.
+	Fetch(r *http.Request) (*http.Response, error)
+	// RewriteResponse adapts an upstream response before it is served and
+	// cached, e.g. to point download links at levee.
+	RewriteResponse(r *http.Request, resp *http.Response) error
+}
+
+// registryProtocols are registered in order, npm last since its routes match
+// any top level path.
+var registryProtocols = []RegistryProtocol{npm}
+
+type registryProtocolKey struct{}
+
+// withProtocol marks the requests handled by handler as requests of protocol,
+// for the shared handlers like cachedProxy.
+func withProtocol(protocol RegistryProtocol, handler http.HandlerFunc) http.HandlerFunc {
+	return func(wr http.ResponseWriter, r *http.Request) {
+		handler(wr, r.WithContext(context.WithValue(r.Context(), registryProtocolKey{}, protocol)))
+	}
+}
+
+func protocolOf(r *http.Request) RegistryProtocol {
+	if protocol, ok := r.Context().Value(registryProtocolKey{}).(RegistryProtocol); ok {
+		return protocol
+	}
+
+	return npm
+}
+
+// detachedRequest carries the protocol of r over to a request made in the
+// background, which must outlive the context of r.
+func detachedRequest(req *http.Request, r *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(context.Background(), registryProtocolKey{}, protocolOf(r)))
+}
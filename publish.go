@@ -0,0 +1,42 @@
+package levee
+
+import (
+	"io"
+	"net/http"
+)
+
+func publishProxy(wr http.ResponseWriter, r *http.Request) {
+	proxyLog.debugf(r, "A publish request handling for %s", r.URL.Path)
+
+	if offline {
+		http.Error(wr, errOffline.Error(), http.StatusGatewayTimeout)
+		return
+	}
+
+	if len(settings().internalRegistries) == 0 {
+		http.Error(wr, "no internal registry is configured to publish to", http.StatusBadGateway)
+		return
+	}
+
+	internalRegistry := orderRegistries(settings().internalRegistries)[0]
+	resp, err := proxyRequest(internalRegistry, r)
+	r.Body.Close()
+	if err != nil {
+		upstreamLog.errorf(r, "Internal registry %s failed to accept the publish of %s: %s", internalRegistry.URL, r.URL.Path, err)
+		http.Error(wr, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	upstreamLog.infof(r, "Internal registry %s responded to the publish of %s with %d", internalRegistry.URL, r.URL.Path, resp.StatusCode)
+
+	for k, v := range resp.Header {
+		wr.Header().Set(k, v[0])
+	}
+	wr.WriteHeader(resp.StatusCode)
+	io.Copy(wr, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		invalidatePackageMetadata(packageNameFromVars(r))
+	}
+}
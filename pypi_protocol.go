@@ -0,0 +1,79 @@
+package levee
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// pypiProtocol serves a PyPI repository: the Simple API of PEP 503 and 691,
+// the JSON API and the distribution files its pages link to.
+type pypiProtocol struct {
+	*repository
+}
+
+const pypiSimpleJSONType = "application/vnd.pypi.simple.v1+json"
+
+var pypiNameSeparators = regexp.MustCompile(`[-_.]+`)
+
+func newPyPIProtocol(repo *repository) RegistryProtocol {
+	return pypiProtocol{repository: repo}
+}
+
+func (pypiProtocol) Name() string {
+	return "pypi"
+}
+
+func (protocol pypiProtocol) RegisterRoutes(router *mux.Router) {
+	routes := protocol.routes(router, protocol)
+	metadata := protocol.metadataProxy(protocol)
+	files := protocol.artifactProxy(protocol)
+
+	routes.HandleFunc("/simple/", metadata).Methods("GET", "HEAD")
+	routes.HandleFunc("/simple/{project}/", metadata).Methods("GET", "HEAD")
+	routes.HandleFunc("/simple/{project}", redirectToSlash).Methods("GET", "HEAD")
+	routes.HandleFunc("/pypi/{project}/json", metadata).Methods("GET", "HEAD")
+	routes.HandleFunc("/pypi/{project}/{version}/json", metadata).Methods("GET", "HEAD")
+	// Indexes other than pypi.org link to their files relatively.
+	routes.HandleFunc("/packages/{file:.+}", files).Methods("GET", "HEAD")
+}
+
+// CacheKey keys project pages by their normalized name and keeps the HTML and
+// JSON forms of the Simple API apart.
+func (protocol pypiProtocol) CacheKey(r *http.Request) string {
+	requestPath := r.URL.Path
+	if project := mux.Vars(r)["project"]; project != "" {
+		requestPath = strings.Replace(requestPath, "/"+project+"/", "/"+normalizePyPIName(project)+"/", 1)
+	}
+
+	key := cacheKey(requestPath)
+	if strings.Contains(requestPath, "/simple/") && strings.Contains(r.Header.Get("Accept"), pypiSimpleJSONType) {
+		key += ".json"
+	}
+
+	return key
+}
+
+func (protocol pypiProtocol) Fetch(r *http.Request) (*http.Response, error) {
+	return protocol.fetch(r)
+}
+
+func (protocol pypiProtocol) RewriteResponse(r *http.Request, resp *http.Response) error {
+	return protocol.rewriteLinks(r, resp)
+}
+
+// normalizePyPIName normalizes a project name the way PEP 503 does.
+func normalizePyPIName(name string) string {
+	return strings.ToLower(pypiNameSeparators.ReplaceAllString(name, "-"))
+}
+
+func redirectToSlash(wr http.ResponseWriter, r *http.Request) {
+	target := r.URL.Path + "/"
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+
+	http.Redirect(wr, r, target, http.StatusMovedPermanently)
+}
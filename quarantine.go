@@ -0,0 +1,215 @@
+package levee
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+var errUnknownPublishTime = errors.New("the version is not in the metadata of its package")
+
+type QuarantineConfig struct {
+	Period string   `yaml:"period"`
+	Exempt []string `yaml:"exempt"`
+	// FailOpen serves versions whose publish time can't be looked up, e.g.
+	// while the registry is down, instead of refusing them with a 503.
+	FailOpen bool `yaml:"failOpen"`
+}
+
+// quarantineError refuses a version that is still quarantined, or whose
+// publish time can't be looked up.
+type quarantineError struct {
+	statusCode int
+	reason     string
+}
+
+func (err quarantineError) Error() string {
+	return err.reason
+}
+
+func parseQuarantinePeriod(config QuarantineConfig) (time.Duration, error) {
+	var period time.Duration
+	if config.Period != "" {
+		var err error
+		period, err = parseTTL(config.Period)
+		if err != nil {
+			return 0, fmt.Errorf("invalid quarantine period %q: %s", config.Period, err)
+		}
+	}
+
+	for _, pattern := range config.Exempt {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return 0, fmt.Errorf("invalid quarantine exemption %q: %s", pattern, err)
+		}
+	}
+
+	return period, nil
+}
+
+func isQuarantineExempt(packageName string) bool {
+	for _, pattern := range settings().quarantineExemptions {
+		if matched, _ := path.Match(pattern, packageName); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// versionPublishTime looks the publish time of a version up in the metadata
+// of its package, refetching cached metadata that predates the version.
+func versionPublishTime(packageName string, version string) (time.Time, error) {
+	body, err := cachedMetadata(cacheKey("/" + packageName))
+	if err == nil {
+		if publishedAt, found, err := parsePublishTime(body, version); err != nil || found {
+			return publishedAt, err
+		}
+	}
+
+	body, err = fetchAndCache("/" + packageName)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	publishedAt, found, err := parsePublishTime(body, version)
+	if err == nil && !found {
+		err = errUnknownPublishTime
+	}
+
+	return publishedAt, err
+}
+
+func parsePublishTime(metadataBody []byte, version string) (time.Time, bool, error) {
+	var metadata struct {
+		Time map[string]string `json:"time"`
+	}
+	if err := json.Unmarshal(metadataBody, &metadata); err != nil {
+		return time.Time{}, false, err
+	}
+
+	publishedAt, found := metadata.Time[version]
+	if !found {
+		return time.Time{}, false, nil
+	}
+
+	parsed, err := time.Parse(time.RFC3339, publishedAt)
+	return parsed, true, err
+}
+
+// checkQuarantine refuses a version of a package from an external registry
+// that was published less than the quarantine period ago.
+func checkQuarantine(r *http.Request, packageName string, version string) error {
+	period := settings().quarantinePeriod
+	if period <= 0 || isQuarantineExempt(packageName) {
+		return nil
+	}
+
+	publishedAt, err := versionPublishTime(packageName, version)
+	if err == errUnknownPublishTime {
+		policyLog.warnf(r, "Blocked %s, its publish time is unknown", r.URL.Path)
+		return quarantineError{http.StatusForbidden, fmt.Sprintf("%s@%s is not in the metadata of %s, its publish time is unknown", packageName, version, packageName)}
+	} else if err != nil && settings().quarantineFailOpen {
+		policyLog.warnf(r, "Failed to determine when %s@%s was published, serving it anyway: %s", packageName, version, err)
+		return nil
+	} else if err != nil {
+		policyLog.warnf(r, "Failed to determine when %s@%s was published, refusing it: %s", packageName, version, err)
+		return quarantineError{http.StatusServiceUnavailable, fmt.Sprintf("the publish time of %s@%s can't be looked up: %s", packageName, version, err)}
+	}
+
+	if releasedAt := publishedAt.Add(period); time.Now().Before(releasedAt) {
+		reason := fmt.Sprintf("%s@%s was published at %s and is quarantined until %s", packageName, version, publishedAt.Format(time.RFC3339), releasedAt.Format(time.RFC3339))
+		policyLog.warnf(r, "Blocked %s by the quarantine window", r.URL.Path)
+		notify(webhookEvent{Event: eventPolicyBlocked, Package: packageName, Version: version, Reason: reason})
+		return quarantineError{http.StatusForbidden, reason}
+	}
+
+	return nil
+}
+
+// hideQuarantinedVersions removes the versions still in quarantine from a
+// packument of an external registry, so that npm resolves to versions it may
+// download. dist-tags pointing at them are dropped, except for latest, which
+// moves back to the newest version out of quarantine. It reports whether it
+// removed any version.
+func hideQuarantinedVersions(packageName string, metadata map[string]interface{}) bool {
+	period := settings().quarantinePeriod
+	versions, _ := metadata["versions"].(map[string]interface{})
+	if period <= 0 || len(versions) == 0 || isQuarantineExempt(packageName) {
+		return false
+	}
+
+	publishTimes, err := packagePublishTimes(packageName, metadata)
+	if err != nil {
+		policyLog.warnf(nil, "Failed to determine when the versions of %s were published, leaving them to the tarball downloads: %s", packageName, err)
+		return false
+	}
+
+	now := time.Now()
+	hidden := false
+	var newest string
+	var newestPublishedAt time.Time
+	for version := range versions {
+		publishedAt, known := publishTimes[version]
+		if !known || now.Before(publishedAt.Add(period)) {
+			delete(versions, version)
+			hidden = true
+			continue
+		}
+		if !strings.Contains(version, "-") && publishedAt.After(newestPublishedAt) {
+			newest, newestPublishedAt = version, publishedAt
+		}
+	}
+	if !hidden {
+		return false
+	}
+
+	distTags, _ := metadata["dist-tags"].(map[string]interface{})
+	for tag, version := range distTags {
+		if versionName, _ := version.(string); versions[versionName] != nil {
+			continue
+		}
+
+		if tag == "latest" && newest != "" {
+			distTags[tag] = newest
+		} else {
+			delete(distTags, tag)
+		}
+	}
+
+	return true
+}
+
+// packagePublishTimes returns when the versions of a packument were
+// published. Abbreviated packuments have no time, which is then looked up in
+// the full packument.
+func packagePublishTimes(packageName string, metadata map[string]interface{}) (map[string]time.Time, error) {
+	times, ok := metadata["time"].(map[string]interface{})
+	if !ok {
+		body, err := fetchAndCache("/" + packageName)
+		if err != nil {
+			return nil, err
+		}
+
+		var fullMetadata struct {
+			Time map[string]interface{} `json:"time"`
+		}
+		if err := json.Unmarshal(body, &fullMetadata); err != nil {
+			return nil, err
+		}
+		times = fullMetadata.Time
+	}
+
+	publishTimes := make(map[string]time.Time, len(times))
+	for version, publishedAt := range times {
+		text, _ := publishedAt.(string)
+		if parsed, err := time.Parse(time.RFC3339, text); err == nil {
+			publishTimes[version] = parsed
+		}
+	}
+
+	return publishTimes, nil
+}
@@ -0,0 +1,41 @@
+package levee
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestHideQuarantinedVersions(t *testing.T) {
+	defer currentSettings.Store(&defaultRuntimeSettings)
+	quarantined := defaultRuntimeSettings
+	quarantined.quarantinePeriod = 24 * time.Hour
+	currentSettings.Store(&quarantined)
+
+	old := time.Now().Add(-48 * time.Hour).Format(time.RFC3339)
+	recent := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	var metadata map[string]interface{}
+	document := `{"name":"lodash",
+		"dist-tags":{"latest":"2.0.0","next":"3.0.0-beta"},
+		"versions":{"1.0.0":{},"2.0.0":{},"3.0.0-beta":{}},
+		"time":{"1.0.0":"` + old + `","2.0.0":"` + recent + `","3.0.0-beta":"` + recent + `"}}`
+	if err := json.Unmarshal([]byte(document), &metadata); err != nil {
+		t.Fatal(err)
+	}
+
+	if !hideQuarantinedVersions("lodash", metadata) {
+		t.Fatal("hideQuarantinedVersions hid no version")
+	}
+	versions := metadata["versions"].(map[string]interface{})
+	if _, found := versions["1.0.0"]; !found || len(versions) != 1 {
+		t.Errorf("The versions left are %v, expected only 1.0.0", versions)
+	}
+	distTags := metadata["dist-tags"].(map[string]interface{})
+	if distTags["latest"] != "1.0.0" || len(distTags) != 1 {
+		t.Errorf("The dist-tags are %v, expected latest to move back to 1.0.0 and next to be dropped", distTags)
+	}
+
+	if hideQuarantinedVersions("lodash", metadata) {
+		t.Error("hideQuarantinedVersions hid versions out of quarantine")
+	}
+}
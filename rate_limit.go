@@ -0,0 +1,122 @@
+package levee
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type RateLimitConfig struct {
+	RequestsPerSecond float64 `yaml:"requestsPerSecond"`
+	Burst             int     `yaml:"burst"`
+	KeyBy             string  `yaml:"keyBy"`
+}
+
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+type rateLimiter struct {
+	mutex   sync.Mutex
+	rate    float64
+	burst   float64
+	keyBy   string
+	buckets map[string]*tokenBucket
+}
+
+// newRateLimiter evicts the buckets of idle clients until stop is closed.
+func newRateLimiter(config RateLimitConfig, stop <-chan struct{}) *rateLimiter {
+	burst := float64(config.Burst)
+	if burst < 1 {
+		burst = math.Max(1, config.RequestsPerSecond)
+	}
+
+	limiter := &rateLimiter{
+		rate:    config.RequestsPerSecond,
+		burst:   burst,
+		keyBy:   config.KeyBy,
+		buckets: make(map[string]*tokenBucket),
+	}
+	go limiter.evictIdleBuckets(time.Minute, stop)
+
+	return limiter
+}
+
+func (limiter *rateLimiter) take(key string) (bool, time.Duration) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+	bucket, ok := limiter.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: limiter.burst, lastRefill: now}
+		limiter.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(limiter.burst, bucket.tokens+now.Sub(bucket.lastRefill).Seconds()*limiter.rate)
+	bucket.lastRefill = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+
+	return false, time.Duration((1 - bucket.tokens) / limiter.rate * float64(time.Second))
+}
+
+func (limiter *rateLimiter) evictIdleBuckets(interval time.Duration, stop <-chan struct{}) {
+	idleAfter := time.Duration(limiter.burst / limiter.rate * float64(time.Second))
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		limiter.mutex.Lock()
+		for key, bucket := range limiter.buckets {
+			if time.Since(bucket.lastRefill) > idleAfter {
+				delete(limiter.buckets, key)
+			}
+		}
+		limiter.mutex.Unlock()
+	}
+}
+
+// key buckets requests by their client token when keyBy is token, as long as
+// the token is valid. Any other token falls back to the address, otherwise
+// clients could get a fresh bucket with every made-up token.
+func (limiter *rateLimiter) key(r *http.Request) string {
+	if limiter.keyBy == "token" {
+		if token := clientToken(r); token != "" && isClientTokenValid(token) {
+			return "token:" + token
+		}
+	}
+
+	return "ip:" + clientIP(r).String()
+}
+
+func limitRequestRate(handler http.Handler, config RateLimitConfig, stop <-chan struct{}) http.Handler {
+	if config.RequestsPerSecond <= 0 {
+		return handler
+	}
+
+	limiter := newRateLimiter(config, stop)
+
+	return http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
+		allowed, retryAfter := limiter.take(limiter.key(r))
+		if !allowed {
+			wr.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			writeJSON(wr, http.StatusTooManyRequests, map[string]string{"error": "too many requests"})
+			return
+		}
+
+		handler.ServeHTTP(wr, r)
+	})
+}
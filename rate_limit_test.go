@@ -0,0 +1,23 @@
+package levee
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEvictIdleBucketsStops(t *testing.T) {
+	limiter := &rateLimiter{rate: 1, burst: 1, buckets: map[string]*tokenBucket{}}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		limiter.evictIdleBuckets(time.Hour, stop)
+		close(stopped)
+	}()
+
+	close(stop)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The eviction of idle buckets kept running after the stop")
+	}
+}
@@ -0,0 +1,94 @@
+package levee
+
+import (
+	"net/http"
+	"time"
+)
+
+type Registry struct {
+	URL            string        `yaml:"url"`
+	MaxAttempts    int           `yaml:"maxAttempts"`
+	MaxConcurrent  int           `yaml:"maxConcurrent"`
+	ConnectTimeout time.Duration `yaml:"connectTimeout"`
+	ReadTimeout    time.Duration `yaml:"readTimeout"`
+	Token          string        `yaml:"token"`
+	TokenFile      string        `yaml:"tokenFile"`
+	BasicAuth      struct {
+		Username string `yaml:"username"`
+		Password string `yaml:"password"`
+	} `yaml:"basicAuth"`
+	Headers map[string]string `yaml:"headers"`
+	Proxy   string            `yaml:"proxy"`
+	// Registries are tried in ascending priority, those sharing a
+	// priority are shuffled by weight on every request.
+	Priority int `yaml:"priority"`
+	Weight   int `yaml:"weight"`
+	TLS      struct {
+		CAFile             string `yaml:"caFile"`
+		CertFile           string `yaml:"certFile"`
+		KeyFile            string `yaml:"keyFile"`
+		InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+	} `yaml:"tls"`
+	Transform RegistryTransform `yaml:"transform"`
+	// ForwardCredentials passes the Authorization and Cookie headers of
+	// clients on to the registry, e.g. so that they publish with their own
+	// npm tokens. They are dropped for every other registry.
+	ForwardCredentials bool `yaml:"forwardCredentials"`
+
+	external bool
+}
+
+func (registry *Registry) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var registryURL string
+	if err := unmarshal(&registryURL); err == nil {
+		registry.URL = registryURL
+		return nil
+	}
+
+	type plainRegistry Registry
+	return unmarshal((*plainRegistry)(registry))
+}
+
+func (registry Registry) authorize(req *http.Request) {
+	for name, value := range registry.Headers {
+		req.Header.Set(name, value)
+	}
+
+	if registry.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+registry.Token)
+	} else if registry.BasicAuth.Username != "" {
+		req.SetBasicAuth(registry.BasicAuth.Username, registry.BasicAuth.Password)
+	}
+
+	registry.Transform.Request.apply(req.Header)
+}
+
+// forwardsHeader tells whether the client header name is sent on to the
+// registry. The levee client token and the vulnerability gate bypass are
+// meant for levee alone, and credentials only go to registries trusted with
+// them.
+func (registry Registry) forwardsHeader(r *http.Request, name string) bool {
+	switch name {
+	case "Accept-Encoding", clientTokenHeader, http.CanonicalHeaderKey(settings().vulnerabilityGate.BypassHeader):
+		return false
+	case "Authorization":
+		token := bearerToken(r)
+		return registry.ForwardCredentials && (token == "" || !isClientTokenValid(token))
+	case "Cookie":
+		return registry.ForwardCredentials
+	default:
+		return true
+	}
+}
+
+func allRegistries() []Registry {
+	current := settings()
+	registries := make([]Registry, 0, len(current.internalRegistries)+len(current.externalRegistries))
+	registries = append(registries, current.internalRegistries...)
+	registries = append(registries, current.externalRegistries...)
+	for _, group := range current.upstreamGroups {
+		registries = append(registries, group...)
+	}
+
+	return registries
+}
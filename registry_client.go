@@ -0,0 +1,183 @@
+package levee
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var registryClients sync.Map
+
+func (registry Registry) client() *http.Client {
+	if client, ok := registryClients.Load(registry.URL); ok {
+		return client.(*http.Client)
+	}
+
+	client, _ := registryClients.LoadOrStore(registry.URL, newRegistryClient(registry))
+	return client.(*http.Client)
+}
+
+func resetRegistryClients() {
+	registryClients.Range(func(registryURL, client interface{}) bool {
+		registryClients.Delete(registryURL)
+		client.(*http.Client).CloseIdleConnections()
+		return true
+	})
+}
+
+// discardResponse drains a small rejected response before closing it, so its
+// connection goes back to the pool instead of being torn down.
+func discardResponse(resp *http.Response) {
+	io.CopyN(ioutil.Discard, resp.Body, 64<<10)
+	resp.Body.Close()
+}
+
+func (registry Registry) proxy() func(*http.Request) (*url.URL, error) {
+	proxyURL := registry.Proxy
+	if proxyURL == "" && registry.external {
+		proxyURL = settings().externalProxy
+	}
+
+	if proxyURL != "" {
+		parsedProxyURL, err := url.Parse(proxyURL)
+		if err != nil {
+			return func(*http.Request) (*url.URL, error) { return nil, err }
+		}
+		return http.ProxyURL(parsedProxyURL)
+	}
+
+	if registry.external {
+		return http.ProxyFromEnvironment
+	}
+
+	return nil
+}
+
+func (registry Registry) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: registry.TLS.InsecureSkipVerify,
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+
+	if registry.TLS.CAFile != "" {
+		caBundle, err := ioutil.ReadFile(registry.TLS.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("no certificates found in %s", registry.TLS.CAFile)
+		}
+	}
+
+	if registry.TLS.CertFile != "" || registry.TLS.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(registry.TLS.CertFile, registry.TLS.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, nil
+}
+
+func newRegistryClient(registry Registry) *http.Client {
+	connectTimeout := settings().upstreamConnectTimeout
+	if registry.ConnectTimeout > 0 {
+		connectTimeout = registry.ConnectTimeout
+	}
+
+	readTimeout := settings().upstreamReadTimeout
+	if registry.ReadTimeout > 0 {
+		readTimeout = registry.ReadTimeout
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = connectTimeout
+	transport.MaxIdleConns = 0
+	transport.MaxIdleConnsPerHost = settings().upstreamMaxIdleConnsPerHost
+	transport.IdleConnTimeout = settings().upstreamIdleConnTimeout
+	transport.ResponseHeaderTimeout = readTimeout
+	transport.Proxy = registry.proxy()
+	if tlsConfig, err := registry.tlsConfig(); err == nil {
+		transport.TLSClientConfig = tlsConfig
+	} else {
+		upstreamLog.warnf(nil, "Ignoring the TLS settings of registry %s: %s", registry.URL, err)
+		transport.TLSClientConfig = &tls.Config{ClientSessionCache: tls.NewLRUClientSessionCache(0)}
+	}
+
+	return &http.Client{Transport: idleTimeoutTransport{RoundTripper: transport, timeout: readTimeout}}
+}
+
+var errUpstreamReadTimeout = errors.New("the registry sent nothing for longer than the read timeout")
+
+// idleTimeoutTransport gives up on a response whose body stalls for longer
+// than timeout, ResponseHeaderTimeout only covers the wait for the headers.
+type idleTimeoutTransport struct {
+	http.RoundTripper
+	timeout time.Duration
+}
+
+func (transport idleTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	resp, err := transport.RoundTripper.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	body := &idleTimeoutBody{ReadCloser: resp.Body, timeout: transport.timeout, cancel: cancel}
+	body.timer = time.AfterFunc(transport.timeout, body.expire)
+	body.timer.Stop()
+	resp.Body = body
+
+	return resp, nil
+}
+
+// idleTimeoutBody cancels its request when a read waits on the registry for
+// longer than timeout. The time between reads doesn't count, levee may take
+// long to pass a chunk on to a slow client.
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	cancel  context.CancelFunc
+	timer   *time.Timer
+	expired int32
+}
+
+func (body *idleTimeoutBody) expire() {
+	atomic.StoreInt32(&body.expired, 1)
+	body.cancel()
+}
+
+func (body *idleTimeoutBody) Read(p []byte) (int, error) {
+	body.timer.Reset(body.timeout)
+	n, err := body.ReadCloser.Read(p)
+	body.timer.Stop()
+	if err != nil && atomic.LoadInt32(&body.expired) == 1 {
+		return n, errUpstreamReadTimeout
+	}
+
+	return n, err
+}
+
+func (body *idleTimeoutBody) Close() error {
+	body.timer.Stop()
+	defer body.cancel()
+	return body.ReadCloser.Close()
+}
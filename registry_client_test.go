@@ -0,0 +1,54 @@
+package levee
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadTimeout(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
+		wr.Write([]byte("partial"))
+		wr.(http.Flusher).Flush()
+		if r.URL.Path == "/stall" {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(2 * time.Second):
+			}
+		}
+	}))
+	defer upstream.Close()
+	client := newRegistryClient(Registry{URL: upstream.URL, ReadTimeout: 100 * time.Millisecond})
+
+	t.Run("Stall", func(t *testing.T) {
+		resp, err := client.Get(upstream.URL + "/stall")
+		if err != nil {
+			t.Fatalf("The request failed: %s", err)
+		}
+		defer resp.Body.Close()
+
+		start := time.Now()
+		if _, err := ioutil.ReadAll(resp.Body); err != errUpstreamReadTimeout {
+			t.Errorf("Reading a stalled body returned %v, expected %v", err, errUpstreamReadTimeout)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Gave up on the stalled body after %s", elapsed)
+		}
+	})
+
+	// A client taking its time with the body is no stall of the registry.
+	t.Run("SlowReader", func(t *testing.T) {
+		resp, err := client.Get(upstream.URL)
+		if err != nil {
+			t.Fatalf("The request failed: %s", err)
+		}
+		defer resp.Body.Close()
+
+		time.Sleep(300 * time.Millisecond)
+		if body, err := ioutil.ReadAll(resp.Body); err != nil || string(body) != "partial" {
+			t.Errorf("Reading the body after a pause returned %q, %v", body, err)
+		}
+	})
+}
@@ -0,0 +1,55 @@
+package levee
+
+import (
+	"math/rand"
+	"sort"
+)
+
+func orderRegistries(registries []Registry) []Registry {
+	ordered := make([]Registry, len(registries))
+	copy(ordered, registries)
+
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Priority < ordered[j].Priority
+	})
+
+	for start := 0; start < len(ordered); {
+		end := start + 1
+		for end < len(ordered) && ordered[end].Priority == ordered[start].Priority {
+			end++
+		}
+		shuffleByWeight(ordered[start:end])
+		start = end
+	}
+
+	return ordered
+}
+
+func shuffleByWeight(registries []Registry) {
+	totalWeight := 0
+	for _, registry := range registries {
+		totalWeight += registry.Weight
+	}
+	if totalWeight == 0 {
+		return
+	}
+
+	for i := range registries {
+		remainingWeight := 0
+		for _, registry := range registries[i:] {
+			remainingWeight += registry.Weight
+		}
+		if remainingWeight == 0 {
+			return
+		}
+
+		pick := rand.Intn(remainingWeight)
+		for j := i; j < len(registries); j++ {
+			pick -= registries[j].Weight
+			if pick < 0 {
+				registries[i], registries[j] = registries[j], registries[i]
+				break
+			}
+		}
+	}
+}
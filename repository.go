@@ -0,0 +1,437 @@
+package levee
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// RepositoryConfig mounts a registry of another package ecosystem below
+// /{name}, next to the npm registry at the root.
+type RepositoryConfig struct {
+	Name     string `yaml:"name"`
+	Protocol string `yaml:"protocol"`
+	// Upstreams default to the public registry of the protocol.
+	Upstreams []Registry `yaml:"upstreams"`
+	// Downloads are the hosts the metadata of the upstreams links to for
+	// downloads, links to them are rewritten to go through levee.
+	Downloads   []Registry    `yaml:"downloads"`
+	MetadataTTL time.Duration `yaml:"metadataTTL"`
+}
+
+// repositoryProtocol creates the RegistryProtocol serving a repository and
+// holds the defaults of the repositories using it.
+type repositoryProtocol struct {
+	newProtocol func(repo *repository) RegistryProtocol
+	upstreams   []string
+	downloads   []string
+	metadataTTL time.Duration
+}
+
+var repositoryProtocols = map[string]repositoryProtocol{
+	"pypi":     {newProtocol: newPyPIProtocol, upstreams: []string{"https://pypi.org"}, downloads: []string{"https://files.pythonhosted.org"}, metadataTTL: 10 * time.Minute},
+	"go":       {newProtocol: newGoProxyProtocol, upstreams: []string{"https://proxy.golang.org"}, metadataTTL: 5 * time.Minute},
+	"maven":    {newProtocol: newMavenProtocol, upstreams: []string{"https://repo1.maven.org/maven2"}, metadataTTL: 10 * time.Minute},
+	"oci":      {newProtocol: newOCIProtocol, upstreams: []string{"https://registry-1.docker.io"}, metadataTTL: 10 * time.Minute},
+	"cargo":    {newProtocol: newCargoProtocol, upstreams: []string{"https://index.crates.io"}, downloads: []string{"https://static.crates.io"}, metadataTTL: 5 * time.Minute},
+	"nuget":    {newProtocol: newNuGetProtocol, upstreams: []string{"https://api.nuget.org"}, metadataTTL: 5 * time.Minute},
+	"composer": {newProtocol: newComposerProtocol, upstreams: []string{"https://repo.packagist.org"}, downloads: []string{"https://api.github.com"}, metadataTTL: 5 * time.Minute},
+	"apt":      {newProtocol: newAptProtocol, upstreams: []string{"https://deb.debian.org/debian"}, metadataTTL: 10 * time.Minute},
+	"yum":      {newProtocol: newYumProtocol, metadataTTL: 5 * time.Minute},
+	"apk":      {newProtocol: newAPKProtocol, upstreams: []string{"https://dl-cdn.alpinelinux.org/alpine"}, metadataTTL: 5 * time.Minute},
+}
+
+// downloadsPath is where a repository serves the files of its download hosts,
+// followed by the host and the path of the file on it.
+const downloadsPath = "/-/downloads/"
+
+var repositoryName = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+var errUnknownDownloadHost = errors.New("not a download host of this repository")
+
+// artifactVerifier is implemented by protocols that can check a downloaded
+// file before it is served and cached, e.g. against a published checksum.
+type artifactVerifier interface {
+	VerifyArtifact(r *http.Request, artifact io.Reader) error
+}
+
+// repository is a configured RepositoryConfig, shared by the protocols that
+// serve repositories.
+type repository struct {
+	RepositoryConfig
+	prefix string
+}
+
+func validateRepositories(repositories []RepositoryConfig) []error {
+	var problems []error
+	names := map[string]bool{}
+
+	for i, repo := range repositories {
+		field := fmt.Sprintf("repositories[%d]", i)
+		if !repositoryName.MatchString(repo.Name) {
+			problems = append(problems, fmt.Errorf("%s.name: %q must be a lowercase path segment, e.g. pypi", field, repo.Name))
+		} else if names[repo.Name] || repo.Name == "npm" {
+			problems = append(problems, fmt.Errorf("%s.name: %q is already taken", field, repo.Name))
+		}
+		names[repo.Name] = true
+
+		if repositoryProtocol, found := repositoryProtocols[repo.Protocol]; !found {
+			problems = append(problems, fmt.Errorf("%s.protocol: %q is unknown, expected one of %s", field, repo.Protocol, strings.Join(repositoryProtocolNames(), ", ")))
+		} else if len(repositoryProtocol.upstreams) == 0 && len(repo.Upstreams) == 0 {
+			problems = append(problems, fmt.Errorf("%s.upstreams: the %s protocol has no default upstream, at least one is needed", field, repo.Protocol))
+		}
+		for j, registry := range repo.Upstreams {
+			problems = append(problems, validateURL(fmt.Sprintf("%s.upstreams[%d]", field, j), registry.URL))
+			problems = append(problems, validateRegistryTLS(fmt.Sprintf("%s.upstreams[%d]", field, j), registry))
+		}
+		for j, registry := range repo.Downloads {
+			problems = append(problems, validateURL(fmt.Sprintf("%s.downloads[%d]", field, j), registry.URL))
+			problems = append(problems, validateRegistryTLS(fmt.Sprintf("%s.downloads[%d]", field, j), registry))
+		}
+		if repo.MetadataTTL < 0 {
+			problems = append(problems, fmt.Errorf("%s.metadataTTL: must not be negative", field))
+		}
+	}
+
+	return problems
+}
+
+func repositoryProtocolNames() []string {
+	names := make([]string, 0, len(repositoryProtocols))
+	for name := range repositoryProtocols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// configureRepositories creates the protocols of the configured repositories,
+// they are routed before npm since it owns the root.
+func configureRepositories(repositories []RepositoryConfig) ([]RegistryProtocol, error) {
+	var protocols []RegistryProtocol
+
+	for _, config := range repositories {
+		repositoryProtocol := repositoryProtocols[config.Protocol]
+		repo := &repository{RepositoryConfig: config, prefix: "/" + config.Name}
+
+		if len(repo.Upstreams) == 0 {
+			repo.Upstreams = defaultRegistries(repositoryProtocol.upstreams)
+		}
+		if len(repo.Downloads) == 0 && len(config.Upstreams) == 0 {
+			repo.Downloads = defaultRegistries(repositoryProtocol.downloads)
+		}
+		if repo.MetadataTTL == 0 {
+			repo.MetadataTTL = repositoryProtocol.metadataTTL
+		}
+
+		for _, registries := range [][]Registry{repo.Upstreams, repo.Downloads} {
+			for i := range registries {
+				registries[i].external = true
+			}
+		}
+
+		protocols = append(protocols, repositoryProtocol.newProtocol(repo))
+	}
+
+	return append(protocols, npm), nil
+}
+
+// repositoryUpstreams returns the upstreams of every repository.
+func repositoryUpstreams() []Registry {
+	var registries []Registry
+	for _, protocol := range registryProtocols {
+		if repo, ok := protocol.(interface{ upstreams() []Registry }); ok {
+			registries = append(registries, repo.upstreams()...)
+		}
+	}
+
+	return registries
+}
+
+func (repo *repository) upstreams() []Registry {
+	return repo.Upstreams
+}
+
+func defaultRegistries(registryURLs []string) []Registry {
+	registries := make([]Registry, len(registryURLs))
+	for i, registryURL := range registryURLs {
+		registries[i] = Registry{URL: registryURL}
+	}
+
+	return registries
+}
+
+// routes returns the router of the repository below its prefix. Paths it does
+// not know are answered with a 404 rather than handed to npm.
+func (repo *repository) routes(router *mux.Router, protocol RegistryProtocol) *mux.Router {
+	subrouter := router.PathPrefix(repo.prefix + "/").Subrouter()
+	subrouter.HandleFunc(downloadsPath+"{host}/{file:.+}", repo.artifactProxy(protocol)).Methods("GET", "HEAD")
+
+	router.PathPrefix(repo.prefix + "/").HandlerFunc(http.NotFound)
+	return subrouter
+}
+
+// metadataProxy caches the documents describing packages for the metadata
+// TTL of the repository.
+func (repo *repository) metadataProxy(protocol RegistryProtocol) http.HandlerFunc {
+	return withProtocol(protocol, func(wr http.ResponseWriter, r *http.Request) {
+		cachedProxy(wr, r, CachePolicy{Pattern: repo.prefix, TTL: repo.MetadataTTL})
+	})
+}
+
+// artifactProxy returns the handler caching the immutable files of the
+// repository, e.g. package archives, in the blob store for good.
+func (repo *repository) artifactProxy(protocol RegistryProtocol) http.HandlerFunc {
+	return withProtocol(protocol, artifactProxy)
+}
+
+// fetch gets the file requested by r below the prefix of the repository from
+// its upstreams, or from a download host when it is requested below
+// downloadsPath.
+func (repo *repository) fetch(r *http.Request) (*http.Response, error) {
+	if offline {
+		return nil, errOffline
+	}
+
+	upstreamPath := strings.TrimPrefix(r.URL.Path, repo.prefix)
+	registries := repo.Upstreams
+	if strings.HasPrefix(upstreamPath, downloadsPath) {
+		segments := strings.SplitN(strings.TrimPrefix(upstreamPath, downloadsPath), "/", 2)
+		if len(segments) < 2 {
+			return nil, errUnknownDownloadHost
+		}
+
+		registries = repo.downloadRegistries(segments[0])
+		if len(registries) == 0 {
+			return nil, errUnknownDownloadHost
+		}
+		upstreamPath = "/" + segments[1]
+	}
+
+	upstreamRequest := r.Clone(r.Context())
+	upstreamRequest.URL.Path = upstreamPath
+	upstreamRequest.URL.RawPath = ""
+
+	resp, registry, err := fetchFromRegistries(registries, upstreamRequest, isAnyResponse)
+	if err != nil {
+		return nil, err
+	}
+	setLogField(r, "upstream", registry.URL)
+
+	return resp, nil
+}
+
+func (repo *repository) downloadRegistries(host string) []Registry {
+	var registries []Registry
+	for _, registry := range repo.Downloads {
+		if registryURL, err := url.Parse(registry.URL); err == nil && registryURL.Host == host {
+			registries = append(registries, registry)
+		}
+	}
+
+	return registries
+}
+
+// localURLs replaces the URLs of the upstreams and download hosts of the
+// repository with the URLs levee serves them at.
+func (repo *repository) localURLs() *strings.Replacer {
+	baseURL := cachedBaseURL + repo.prefix
+
+	var replacements []string
+	for _, registry := range repo.Downloads {
+		if registryURL, err := url.Parse(registry.URL); err == nil {
+			replacements = append(replacements, strings.TrimSuffix(registry.URL, "/"), baseURL+strings.TrimSuffix(downloadsPath, "/")+"/"+registryURL.Host)
+		}
+	}
+	for _, registry := range repo.Upstreams {
+		replacements = append(replacements, strings.TrimSuffix(registry.URL, "/"), baseURL)
+	}
+
+	return strings.NewReplacer(replacements...)
+}
+
+// rewriteLinks points the links of a successful response of the repository at
+// levee.
+func (repo *repository) rewriteLinks(r *http.Request, resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	replacer := repo.localURLs()
+	return rewriteBody(resp, func(body []byte) []byte {
+		return []byte(replacer.Replace(string(body)))
+	})
+}
+
+// rewriteBody replaces the body of resp with its rewritten form, decoding a
+// gzipped body first.
+func rewriteBody(resp *http.Response, rewrite func(body []byte) []byte) error {
+	var bodyReader io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gzipReader, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		bodyReader = gzipReader
+	}
+
+	body, err := ioutil.ReadAll(bodyReader)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	body = rewrite(body)
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header.Del("Content-Encoding")
+
+	return nil
+}
+
+func verifyArtifact(r *http.Request, verifier artifactVerifier, artifact *spillBuffer) error {
+	if _, err := artifact.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return verifier.VerifyArtifact(r, artifact)
+}
+
+// artifactProxy serves an immutable file of a repository, which is kept in the
+// blob store once it has been downloaded completely.
+func artifactProxy(wr http.ResponseWriter, r *http.Request) {
+	proxyLog.debugf(r, "An artifact request handling for %s", r.URL.Path)
+	key := requestCacheKey(r)
+
+	blob, info, err := blobStore.Get(key)
+	if err == nil {
+		setLogField(r, "cache", "hit")
+		recordCacheHit("", false)
+		serveTarball(wr, r, blob, info)
+		blob.Close()
+		return
+	}
+
+	setLogField(r, "cache", "miss")
+	recordCacheMiss()
+
+	fill, waited := joinCacheFill(r, key, func(shared interface{}) bool {
+		blob, info, err = openFilledBlob(shared, key)
+		return err == nil
+	})
+	if fill == nil {
+		setLogField(r, "cache", "coalesced")
+		serveTarball(wr, r, blob, info)
+		blob.Close()
+		return
+	}
+	defer func() {
+		if fill != nil {
+			fill.release()
+		}
+	}()
+	if waited && r.Context().Err() != nil {
+		return
+	}
+
+	upstreamRequest := asGetRequest(r)
+	upstreamRequest.Header.Del("Range")
+	upstreamRequest.Header.Del("If-Range")
+	resp, err := protocolOf(r).Fetch(upstreamRequest)
+	if err != nil && r.Context().Err() != nil {
+		proxyLog.debugf(r, "The client went away, abandoned fetching %s", r.URL.Path)
+		return
+	} else if err == errOffline {
+		http.Error(wr, err.Error(), http.StatusGatewayTimeout)
+		return
+	} else if err == errUnknownDownloadHost || err == errPackageNotFound {
+		http.Error(wr, err.Error(), http.StatusNotFound)
+		return
+	} else if err == errUpstreamBusy {
+		wr.Header().Set("Retry-After", "1")
+		http.Error(wr, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		upstreamLog.errorf(r, "Failed to fetch the artifact %s: %s", r.URL.Path, err)
+		http.Error(wr, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		for k, v := range resp.Header {
+			wr.Header().Set(k, v[0])
+		}
+		wr.WriteHeader(resp.StatusCode)
+		io.Copy(wr, resp.Body)
+		return
+	}
+
+	artifact := &spillBuffer{}
+	if _, err := io.Copy(artifact, resp.Body); err != nil {
+		artifact.Close()
+		upstreamLog.errorf(r, "Failed to download the artifact %s: %s", r.URL.Path, err)
+		http.Error(wr, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if verifier, ok := protocolOf(r).(artifactVerifier); ok {
+		if err := verifyArtifact(r, verifier, artifact); err != nil {
+			artifact.Close()
+			policyLog.errorf(r, "Refusing the artifact %s: %s", r.URL.Path, err)
+			http.Error(wr, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+	if _, err := artifact.Seek(0, io.SeekStart); err != nil {
+		artifact.Close()
+		http.Error(wr, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for k, v := range resp.Header {
+		if k != "Content-Length" && k != "Accept-Ranges" {
+			wr.Header().Set(k, v[0])
+		}
+	}
+	info = blobInfo(resp.Header)
+	fill.share(sharedBlob{artifact, info})
+	serveTarball(wr, r, artifact, info)
+
+	releaseFill := fill
+	fill = nil
+	queueCacheWrite(func() {
+		defer releaseFill.release()
+		defer artifact.Close()
+
+		if !runBeforeCacheWriteHooks(key, resp) {
+			cacheLog.debugf(nil, "A plugin kept %s out of the cache", key)
+			return
+		}
+		if settings().maxCachedBlobSize > 0 && artifact.Size() > settings().maxCachedBlobSize {
+			cacheLog.infof(nil, "Not caching %s, it is larger than cache.blobs.maxObjectSize", key)
+			return
+		}
+		if _, err := artifact.Seek(0, io.SeekStart); err != nil {
+			cacheLog.warnf(nil, "Failed to cache %s: %s", key, err)
+			return
+		}
+		if err := blobStore.Put(key, artifact, info); err != nil {
+			cacheLog.warnf(nil, "Failed to cache %s: %s", key, err)
+		}
+	})
+}
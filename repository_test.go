@@ -0,0 +1,277 @@
+package levee_test
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/kareem-abdelsalam/levee"
+)
+
+// fileUpstream serves files by their path, {{URL}} in them stands for its
+// own URL.
+type fileUpstream struct {
+	*httptest.Server
+
+	files    map[string]string
+	mutex    sync.Mutex
+	requests int
+}
+
+func newFileUpstream(t *testing.T, files map[string]string) *fileUpstream {
+	upstream := &fileUpstream{files: files}
+	upstream.Server = httptest.NewServer(http.HandlerFunc(upstream.serve))
+	t.Cleanup(upstream.Close)
+
+	return upstream
+}
+
+func (upstream *fileUpstream) serve(wr http.ResponseWriter, r *http.Request) {
+	upstream.mutex.Lock()
+	upstream.requests++
+	upstream.mutex.Unlock()
+
+	file, found := upstream.files[r.URL.Path]
+	if !found {
+		http.NotFound(wr, r)
+		return
+	}
+
+	switch {
+	case strings.HasSuffix(r.URL.Path, ".json"):
+		wr.Header().Set("Content-Type", "application/json")
+	case strings.Contains(r.URL.Path, "/manifests/"):
+		wr.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+	case strings.HasSuffix(r.URL.Path, "/"):
+		wr.Header().Set("Content-Type", "text/html")
+	default:
+		wr.Header().Set("Content-Type", "application/octet-stream")
+	}
+	wr.Write([]byte(strings.Replace(file, "{{URL}}", upstream.URL, -1)))
+}
+
+func (upstream *fileUpstream) requestCount() int {
+	upstream.mutex.Lock()
+	defer upstream.mutex.Unlock()
+
+	return upstream.requests
+}
+
+func sha1Hex(content string) string {
+	sum := sha1.Sum([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// TestRepositories fetches a document and a file of every protocol through
+// levee, checks that both are cached and, for the protocols verifying their
+// files, that a tampered file is refused.
+func TestRepositories(t *testing.T) {
+	tests := []struct {
+		protocol string
+		name     string
+		files    map[string]string
+		// downloads sets the upstream as the download host of the
+		// repository as well.
+		downloads bool
+		// {{HOST}} in the paths and in metadataLink stands for the host
+		// of the upstream.
+		metadataPath string
+		metadataLink string
+		artifactPath string
+		artifact     string
+		tamperedPath string
+	}{
+		{
+			protocol: "pypi",
+			name:     "pypi",
+			files: map[string]string{
+				"/simple/requests/":             `<a href="{{URL}}/packages/ab/requests-2.0.whl#sha256=` + sha256Hex("wheel") + `">requests-2.0.whl</a>`,
+				"/packages/ab/requests-2.0.whl": "wheel",
+			},
+			downloads:    true,
+			metadataPath: "/pypi/simple/requests/",
+			metadataLink: "/pypi/-/downloads/{{HOST}}/packages/ab/requests-2.0.whl",
+			artifactPath: "/pypi/-/downloads/{{HOST}}/packages/ab/requests-2.0.whl",
+			artifact:     "wheel",
+		},
+		{
+			protocol: "go",
+			name:     "go",
+			files: map[string]string{
+				"/example.com/mod/@v/list":       "v1.0.0\n",
+				"/example.com/mod/@v/v1.0.0.zip": "module zip",
+			},
+			metadataPath: "/go/example.com/mod/@v/list",
+			artifactPath: "/go/example.com/mod/@v/v1.0.0.zip",
+			artifact:     "module zip",
+		},
+		{
+			protocol: "maven",
+			name:     "maven",
+			files: map[string]string{
+				"/org/example/lib/maven-metadata.xml":   "<metadata/>",
+				"/org/example/lib/1.0/lib-1.0.jar":      "jar",
+				"/org/example/lib/1.0/lib-1.0.jar.sha1": sha1Hex("jar"),
+				"/org/example/lib/1.1/lib-1.1.jar":      "tampered",
+				"/org/example/lib/1.1/lib-1.1.jar.sha1": sha1Hex("jar"),
+			},
+			metadataPath: "/maven/org/example/lib/maven-metadata.xml",
+			artifactPath: "/maven/org/example/lib/1.0/lib-1.0.jar",
+			artifact:     "jar",
+			tamperedPath: "/maven/org/example/lib/1.1/lib-1.1.jar",
+		},
+		{
+			protocol: "oci",
+			name:     "hub",
+			files: map[string]string{
+				"/v2/library/nginx/manifests/latest":                        `{"schemaVersion":2}`,
+				"/v2/library/nginx/blobs/sha256:" + sha256Hex("layer"):      "layer",
+				"/v2/library/nginx/blobs/sha256:" + strings.Repeat("0", 64): "tampered",
+			},
+			metadataPath: "/v2/hub/library/nginx/manifests/latest",
+			artifactPath: "/v2/hub/library/nginx/blobs/sha256:" + sha256Hex("layer"),
+			artifact:     "layer",
+			tamperedPath: "/v2/hub/library/nginx/blobs/sha256:" + strings.Repeat("0", 64),
+		},
+		{
+			protocol: "cargo",
+			name:     "crates",
+			files: map[string]string{
+				"/config.json":                 `{"dl":"{{URL}}/crates","api":"https://crates.io"}`,
+				"/se/rd/serde":                 `{"name":"serde","vers":"1.0.0","cksum":"` + sha256Hex("crate") + `"}` + "\n" + `{"name":"serde","vers":"1.0.1","cksum":"` + sha256Hex("crate") + `"}` + "\n",
+				"/crates/serde/1.0.0/download": "crate",
+				"/crates/serde/1.0.1/download": "tampered",
+			},
+			downloads:    true,
+			metadataPath: "/crates/config.json",
+			metadataLink: "/crates/-/downloads/{{HOST}}/crates",
+			artifactPath: "/crates/-/downloads/{{HOST}}/crates/serde/1.0.0/download",
+			artifact:     "crate",
+			tamperedPath: "/crates/-/downloads/{{HOST}}/crates/serde/1.0.1/download",
+		},
+		{
+			protocol: "composer",
+			name:     "packagist",
+			files: map[string]string{
+				"/p2/acme/lib.json": `{"packages":{"acme/lib":[{"version":"1.0.0","dist":{"type":"zip","url":"{{URL}}/zipball/acme-lib"}}]}}`,
+				"/zipball/acme-lib": "zipball",
+			},
+			downloads:    true,
+			metadataPath: "/packagist/p2/acme/lib.json",
+			metadataLink: "/packagist/-/downloads/{{HOST}}/zipball/acme-lib",
+			artifactPath: "/packagist/-/downloads/{{HOST}}/zipball/acme-lib",
+			artifact:     "zipball",
+		},
+		{
+			protocol: "nuget",
+			name:     "nuget",
+			files: map[string]string{
+				"/v3/index.json": `{"version":"3.0.0","resources":[{"@id":"{{URL}}/v3-flatcontainer/","@type":"PackageBaseAddress/3.0.0"}]}`,
+				"/v3-flatcontainer/acme/1.0.0/acme.1.0.0.nupkg": "nupkg",
+			},
+			metadataPath: "/nuget/v3/index.json",
+			metadataLink: "/nuget/v3-flatcontainer/",
+			artifactPath: "/nuget/v3-flatcontainer/acme/1.0.0/acme.1.0.0.nupkg",
+			artifact:     "nupkg",
+		},
+		{
+			protocol: "apt",
+			name:     "debian",
+			files: map[string]string{
+				"/dists/stable/InRelease":                                                 "Suite: stable\n",
+				"/pool/main/a/acme/acme_1.0_amd64.deb":                                    "deb",
+				"/dists/stable/main/binary-amd64/by-hash/SHA256/" + sha256Hex("Packages"): "tampered",
+			},
+			metadataPath: "/debian/dists/stable/InRelease",
+			artifactPath: "/debian/pool/main/a/acme/acme_1.0_amd64.deb",
+			artifact:     "deb",
+			tamperedPath: "/debian/dists/stable/main/binary-amd64/by-hash/SHA256/" + sha256Hex("Packages"),
+		},
+		{
+			protocol: "yum",
+			name:     "rocky",
+			files: map[string]string{
+				"/repodata/repomd.xml":            "<repomd/>",
+				"/Packages/a/acme-1.0.x86_64.rpm": "rpm",
+			},
+			metadataPath: "/rocky/repodata/repomd.xml",
+			artifactPath: "/rocky/Packages/a/acme-1.0.x86_64.rpm",
+			artifact:     "rpm",
+		},
+		{
+			protocol: "apk",
+			name:     "alpine",
+			files: map[string]string{
+				"/main/x86_64/APKINDEX.tar.gz": "index",
+				"/main/x86_64/acme-1.0-r0.apk": "apk",
+			},
+			metadataPath: "/alpine/main/x86_64/APKINDEX.tar.gz",
+			artifactPath: "/alpine/main/x86_64/acme-1.0-r0.apk",
+			artifact:     "apk",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.protocol, func(t *testing.T) {
+			upstream := newFileUpstream(t, test.files)
+			host := upstream.Listener.Addr().String()
+			withHost := func(s string) string {
+				return strings.Replace(s, "{{HOST}}", host, -1)
+			}
+
+			repository := levee.RepositoryConfig{Name: test.name, Protocol: test.protocol, Upstreams: []levee.Registry{{URL: upstream.URL}}}
+			if test.downloads {
+				repository.Downloads = []levee.Registry{{URL: upstream.URL}}
+			}
+			config := levee.Config{Repositories: []levee.RepositoryConfig{repository}}
+			config.Cache.Blobs.Directory = t.TempDir()
+			handler, cache := startLevee(t, config)
+
+			metadata := get(handler, test.metadataPath)
+			if metadata.Code != http.StatusOK {
+				t.Fatalf("%s returned %d: %s", test.metadataPath, metadata.Code, metadata.Body)
+			}
+			if !strings.Contains(metadata.Body.String(), withHost(test.metadataLink)) {
+				t.Errorf("%s returned %s, expected it to link to %s", test.metadataPath, metadata.Body, withHost(test.metadataLink))
+			}
+			eventually(t, func() bool { return len(cachedKeys(t, cache)) > 0 })
+
+			artifact := get(handler, withHost(test.artifactPath))
+			if artifact.Code != http.StatusOK || artifact.Body.String() != test.artifact {
+				t.Fatalf("%s returned %d %q, expected %q", test.artifactPath, artifact.Code, artifact.Body, test.artifact)
+			}
+			eventually(t, func() bool { return cachedBlobs(t, config.Cache.Blobs.Directory) > 0 })
+
+			requests := upstream.requestCount()
+			if cached := get(handler, test.metadataPath); cached.Body.String() != metadata.Body.String() {
+				t.Errorf("The cached %s is %q, expected %q", test.metadataPath, cached.Body, metadata.Body)
+			}
+			if cached := get(handler, withHost(test.artifactPath)); cached.Body.String() != test.artifact {
+				t.Errorf("The cached %s is %q, expected %q", test.artifactPath, cached.Body, test.artifact)
+			}
+			if upstream.requestCount() != requests {
+				t.Errorf("The cached document and file were fetched from the upstream again")
+			}
+
+			if test.tamperedPath != "" {
+				tampered := get(handler, withHost(test.tamperedPath))
+				if tampered.Code != http.StatusBadGateway {
+					t.Errorf("The tampered %s returned %d, expected %d", test.tamperedPath, tampered.Code, http.StatusBadGateway)
+				}
+				if blobs := cachedBlobs(t, config.Cache.Blobs.Directory); blobs != 1 {
+					t.Errorf("The blob store holds %d blobs, expected the tampered file not to be cached", blobs)
+				}
+			}
+		})
+	}
+}
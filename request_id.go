@@ -0,0 +1,43 @@
+package levee
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+func isValidRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > 128 {
+		return false
+	}
+
+	for _, character := range requestID {
+		if character < '!' || character > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+func assignRequestID(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if !isValidRequestID(requestID) {
+			requestID = newRequestID()
+			r.Header.Set(requestIDHeader, requestID)
+		}
+
+		wr.Header().Set(requestIDHeader, requestID)
+		handler.ServeHTTP(wr, r)
+	})
+}
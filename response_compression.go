@@ -0,0 +1,79 @@
+package levee
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gzipWriter  *gzip.Writer
+	wroteHeader bool
+}
+
+func isCompressibleContentType(contentType string) bool {
+	return strings.Contains(contentType, "json") || strings.HasPrefix(contentType, "text/") || strings.Contains(contentType, "xml")
+}
+
+func (wr *gzipResponseWriter) WriteHeader(statusCode int) {
+	if wr.wroteHeader {
+		return
+	}
+	wr.wroteHeader = true
+
+	header := wr.Header()
+	header.Add("Vary", "Accept-Encoding")
+	if statusCode != http.StatusNoContent && statusCode != http.StatusNotModified &&
+		header.Get("Content-Encoding") == "" && isCompressibleContentType(header.Get("Content-Type")) {
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", "gzip")
+		wr.gzipWriter = gzip.NewWriter(wr.ResponseWriter)
+	}
+
+	wr.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (wr *gzipResponseWriter) Write(body []byte) (int, error) {
+	if !wr.wroteHeader {
+		if wr.Header().Get("Content-Type") == "" {
+			wr.Header().Set("Content-Type", http.DetectContentType(body))
+		}
+		wr.WriteHeader(http.StatusOK)
+	}
+
+	if wr.gzipWriter != nil {
+		return wr.gzipWriter.Write(body)
+	}
+
+	return wr.ResponseWriter.Write(body)
+}
+
+func (wr *gzipResponseWriter) Flush() {
+	if wr.gzipWriter != nil {
+		wr.gzipWriter.Flush()
+	}
+	if flusher, ok := wr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (wr *gzipResponseWriter) close() {
+	if wr.gzipWriter != nil {
+		wr.gzipWriter.Close()
+	}
+}
+
+func compressResponses(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead || !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			handler.ServeHTTP(wr, r)
+			return
+		}
+
+		gzipWriter := &gzipResponseWriter{ResponseWriter: wr}
+		defer gzipWriter.close()
+
+		handler.ServeHTTP(gzipWriter, r)
+	})
+}
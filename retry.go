@@ -0,0 +1,36 @@
+package levee
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+func (registry Registry) maxAttempts() int {
+	if registry.MaxAttempts > 0 {
+		return registry.MaxAttempts
+	}
+
+	return settings().retryMaxAttempts
+}
+
+func isRetryable(resp *http.Response, err error) bool {
+	if err == errCircuitOpen || err == errUpstreamBusy {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+
+	return resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusGatewayTimeout
+}
+
+func retryBackoff(attempt int) time.Duration {
+	current := settings()
+	backoff := current.retryInitialBackoff << uint(attempt-1)
+	if backoff <= 0 || backoff > current.retryMaxBackoff {
+		backoff = current.retryMaxBackoff
+	}
+
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
@@ -0,0 +1,106 @@
+package levee
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var revalidations sync.Map
+
+func retentionPeriod(cachingPeriod time.Duration) time.Duration {
+	window := settings().revalidationWindow
+	if cachingPeriod <= 0 || window <= 0 {
+		return cachingPeriod
+	}
+
+	return cachingPeriod + window
+}
+
+func conditionalRequest(r *http.Request, etag string) *http.Request {
+	conditional := r.Clone(r.Context())
+	conditional.Header.Set("If-None-Match", etag)
+	conditional.Header.Del("If-Modified-Since")
+
+	return conditional
+}
+
+func entryExpiryFields(hardTTL time.Duration, softTTL time.Duration) map[string]string {
+	now := time.Now()
+	fields := map[string]string{"hardExpiresAt": "", "softExpiresAt": ""}
+
+	if hardTTL > -1 {
+		fields["hardExpiresAt"] = strconv.FormatInt(now.Add(hardTTL).Unix(), 10)
+	}
+	if softTTL > 0 && (hardTTL < 0 || softTTL < hardTTL) {
+		fields["softExpiresAt"] = strconv.FormatInt(now.Add(softTTL).Unix(), 10)
+	}
+
+	return fields
+}
+
+func isPast(npmResponse map[string]string, field string) bool {
+	expiresAt, err := strconv.ParseInt(npmResponse[field], 10, 64)
+	if err != nil {
+		return false
+	}
+
+	return time.Now().After(time.Unix(expiresAt, 0))
+}
+
+func isStale(npmResponse map[string]string) bool {
+	return isPast(npmResponse, "softExpiresAt")
+}
+
+func isExpired(npmResponse map[string]string) bool {
+	return isPast(npmResponse, "hardExpiresAt")
+}
+
+func revalidateInBackground(r *http.Request, cached map[string]string, policy CachePolicy) {
+	key := requestCacheKey(r)
+	if _, running := revalidations.LoadOrStore(key, true); running {
+		return
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, r.URL.RequestURI(), nil)
+	req = detachedRequest(req, r)
+	req.Host = r.Host
+	for name, value := range r.Header {
+		if name != "If-None-Match" {
+			req.Header.Set(name, value[0])
+		}
+	}
+	if cached["Etag"] != "" {
+		req.Header.Set("If-None-Match", cached["Etag"])
+	}
+
+	go func() {
+		defer revalidations.Delete(key)
+
+		resp, err := protocolOf(req).Fetch(req)
+		if err != nil {
+			cacheLog.warnf(req, "Failed to revalidate %s: %s", req.URL.Path, err)
+			return
+		}
+
+		if err := protocolOf(req).RewriteResponse(req, resp); err != nil {
+			cacheLog.warnf(req, "Failed to rewrite the response of %s: %s", req.URL.Path, err)
+		}
+
+		entry, err := teeResponse(ioutil.Discard, resp)
+		resp.Body.Close()
+		if err != nil {
+			cacheLog.warnf(req, "Failed to revalidate %s: %s", req.URL.Path, err)
+			return
+		}
+
+		writePackageInfo(key, resp, entry, cached, policy)
+		if resp.StatusCode == http.StatusNotModified {
+			cacheLog.debugf(req, "Revalidated %s, it has not changed upstream", req.URL.Path)
+		} else {
+			cacheLog.debugf(req, "Revalidated %s with a %d response", req.URL.Path, resp.StatusCode)
+		}
+	}()
+}
@@ -0,0 +1,132 @@
+package levee
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+)
+
+type RoutingRule struct {
+	Pattern   string   `yaml:"pattern"`
+	Upstreams string   `yaml:"upstreams"`
+	Groups    []string `yaml:"groups"`
+}
+
+type UpstreamGroup struct {
+	Name       string     `yaml:"name"`
+	External   bool       `yaml:"external"`
+	Registries []Registry `yaml:"registries"`
+}
+
+var errPackageNotFound = errors.New("package not found in any of the registries it is routed to")
+
+func routingRuleFor(packageName string) RoutingRule {
+	for _, rule := range settings().routingRules {
+		if matched, _ := path.Match(rule.Pattern, packageName); matched {
+			return rule
+		}
+	}
+
+	return RoutingRule{Pattern: "*", Upstreams: "all"}
+}
+
+func parseUpstreamGroups(groups []UpstreamGroup) (map[string][]Registry, error) {
+	registriesByGroup := make(map[string][]Registry, len(groups))
+
+	for _, group := range groups {
+		switch group.Name {
+		case "":
+			return nil, errors.New("upstream groups need a name")
+		case "internal", "external", "all":
+			return nil, fmt.Errorf("upstream group name %q is reserved", group.Name)
+		}
+		if _, exists := registriesByGroup[group.Name]; exists {
+			return nil, fmt.Errorf("upstream group %q is defined twice", group.Name)
+		}
+		if len(group.Registries) == 0 {
+			return nil, fmt.Errorf("upstream group %q has no registries", group.Name)
+		}
+
+		for i := range group.Registries {
+			group.Registries[i].external = group.External
+		}
+		registriesByGroup[group.Name] = group.Registries
+	}
+
+	return registriesByGroup, nil
+}
+
+func validateRoutingRules(rules []RoutingRule, registriesByGroup map[string][]Registry) error {
+	for _, rule := range rules {
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return fmt.Errorf("invalid routing pattern %q: %s", rule.Pattern, err)
+		}
+
+		if len(rule.Groups) > 0 {
+			if rule.Upstreams != "" {
+				return fmt.Errorf("routing rule %q sets both upstreams and groups", rule.Pattern)
+			}
+			for _, group := range rule.Groups {
+				if _, exists := registriesByGroup[group]; !exists && group != "internal" && group != "external" {
+					return fmt.Errorf("routing rule %q references unknown upstream group %q", rule.Pattern, group)
+				}
+			}
+			continue
+		}
+
+		switch rule.Upstreams {
+		case "internal", "external", "all":
+		default:
+			return fmt.Errorf("routing rule %q has unknown upstreams %q, expected internal, external or all", rule.Pattern, rule.Upstreams)
+		}
+	}
+
+	return nil
+}
+
+func groupRegistries(group string) []Registry {
+	switch group {
+	case "internal":
+		return settings().internalRegistries
+	case "external":
+		return settings().externalRegistries
+	default:
+		return settings().upstreamGroups[group]
+	}
+}
+
+// fetchFromGroups fetches r from the first group having it. When none does,
+// the package is only reported missing if a registry answered so, otherwise
+// the last failure to reach one is returned.
+func fetchFromGroups(r *http.Request, groups []string) (*http.Response, error) {
+	var responseError error
+	notFound := false
+	for i, group := range groups {
+		accept := isInternalHit
+		if i == len(groups)-1 {
+			accept = isAnyResponse
+		}
+
+		resp, registry, err := fetchFromRegistries(groupRegistries(group), r, accept)
+		if err == nil {
+			upstreamLog.debugf(r, "Registry %s of group %s responded to %s request of %s", registry.URL, group, r.Method, r.URL.Path)
+			setLogField(r, "upstream", registry.URL)
+			return resp, nil
+		}
+
+		if err == errPackageNotFound {
+			notFound = true
+		} else {
+			responseError = err
+		}
+	}
+
+	if notFound || responseError == nil {
+		upstreamLog.infof(r, "None of the upstream groups %v has %s", groups, r.URL.Path)
+		return nil, errPackageNotFound
+	}
+
+	upstreamLog.warnf(r, "None of the upstream groups %v answered for %s: %s", groups, r.URL.Path, responseError)
+	return nil, responseError
+}
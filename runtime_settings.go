@@ -0,0 +1,106 @@
+package levee
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// runtimeSettings holds everything of the config that a reload may change.
+// It is never modified once stored, a reload stores new settings instead, so
+// a request reading its settings once sees a consistent config throughout.
+type runtimeSettings struct {
+	cacheKeyPrefix   string
+	publicURL        string
+	cacheCompression string
+
+	// maxCachedObjectSize caps the size of a response body held in the cache
+	// store, larger ones are streamed to the client without being cached.
+	maxCachedObjectSize int64
+	// maxCachedBlobSize caps the size of a tarball kept in the blob store.
+	maxCachedBlobSize int64
+	// spillThreshold is how much of an in-flight body is held in memory
+	// before the rest goes to a temporary file, so many large downloads
+	// streaming at once don't grow the memory of levee.
+	spillThreshold int64
+	// revalidationWindow is how long an expired entry with an ETag stays in
+	// the cache, so the next request can revalidate it instead of
+	// downloading it.
+	revalidationWindow time.Duration
+
+	respectCacheControl bool
+	minCachingPeriod    time.Duration
+	maxCachingPeriod    time.Duration
+	cacheableStatuses   map[int]bool
+	cachePolicies       []CachePolicy
+	packageTTLs         map[string]time.Duration
+
+	internalRegistries []Registry
+	externalRegistries []Registry
+	upstreamGroups     map[string][]Registry
+	routingRules       []RoutingRule
+	externalProxy      string
+
+	packagePolicy        PackagePolicy
+	vulnerabilityGate    VulnerabilityGateConfig
+	quarantinePeriod     time.Duration
+	quarantineExemptions []string
+	quarantineFailOpen   bool
+	signatureConfig      SignatureConfig
+	webhooks             []Webhook
+	activePlugins        []Plugin
+
+	adminToken     string
+	clientTokens   []string
+	trustedProxies []*net.IPNet
+
+	upstreamConnectTimeout time.Duration
+	upstreamReadTimeout    time.Duration
+	// CI bursts hit the same few registries with many parallel requests, the
+	// default of 2 idle connections per host would close most connections
+	// after each request and run out of ephemeral ports.
+	upstreamMaxIdleConnsPerHost int
+	upstreamIdleConnTimeout     time.Duration
+	upstreamMaxConcurrent       int
+	upstreamQueueTimeout        time.Duration
+
+	retryMaxAttempts        int
+	retryInitialBackoff     time.Duration
+	retryMaxBackoff         time.Duration
+	hedgedRequests          bool
+	hedgingDelay            time.Duration
+	circuitBreakerThreshold int
+	circuitBreakerCooldown  time.Duration
+}
+
+// defaultRuntimeSettings apply until a config is loaded, and to every option
+// the loaded config leaves unset.
+var defaultRuntimeSettings = runtimeSettings{
+	spillThreshold:              1 << 20,
+	revalidationWindow:          24 * time.Hour,
+	cacheableStatuses:           map[int]bool{http.StatusOK: true},
+	cachePolicies:               defaultCachePolicies,
+	upstreamGroups:              map[string][]Registry{},
+	upstreamConnectTimeout:      10 * time.Second,
+	upstreamReadTimeout:         60 * time.Second,
+	upstreamMaxIdleConnsPerHost: 64,
+	upstreamIdleConnTimeout:     90 * time.Second,
+	upstreamQueueTimeout:        10 * time.Second,
+	retryMaxAttempts:            1,
+	retryInitialBackoff:         100 * time.Millisecond,
+	retryMaxBackoff:             2 * time.Second,
+}
+
+var currentSettings atomic.Value
+
+// settings returns the settings of the config levee runs with. Functions
+// reading several of them read the settings once, so that a reload in
+// between doesn't mix two configs.
+func settings() *runtimeSettings {
+	if current, ok := currentSettings.Load().(*runtimeSettings); ok {
+		return current
+	}
+
+	return &defaultRuntimeSettings
+}
@@ -0,0 +1,282 @@
+package levee
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// s3ConcurrentGets is how many objects GetManyWithTTL reads at once.
+const s3ConcurrentGets = 16
+
+type s3CacheObject struct {
+	Fields    map[string]string `json:"fields"`
+	ExpiresAt time.Time         `json:"expiresAt,omitempty"`
+}
+
+type s3CacheStore struct {
+	client               *s3.S3
+	bucket               string
+	keyPrefix            string
+	serverSideEncryption string
+	kmsKeyID             string
+	ctx                  context.Context
+}
+
+func newS3CacheStore(config Config) (*s3CacheStore, error) {
+	awsConfig := &aws.Config{
+		Region:           aws.String(config.Cache.Region),
+		S3ForcePathStyle: aws.Bool(config.Cache.ForcePathStyle),
+	}
+	if config.Cache.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(config.Cache.Endpoint)
+	}
+	if config.Cache.AccessKeyID != "" {
+		awsConfig.Credentials = credentials.NewStaticCredentials(config.Cache.AccessKeyID, config.Cache.SecretAccessKey, "")
+	}
+
+	awsSession, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3CacheStore{
+		client:               s3.New(awsSession),
+		bucket:               config.Cache.Bucket,
+		keyPrefix:            config.Cache.KeyPrefix,
+		serverSideEncryption: config.Cache.ServerSideEncryption,
+		kmsKeyID:             config.Cache.KMSKeyID,
+	}, nil
+}
+
+func (store *s3CacheStore) objectKey(key string) string {
+	return store.keyPrefix + key
+}
+
+func (store *s3CacheStore) WithContext(ctx context.Context) CacheStore {
+	bound := *store
+	bound.ctx = ctx
+	return &bound
+}
+
+func (store *s3CacheStore) context() context.Context {
+	if store.ctx == nil {
+		return context.Background()
+	}
+
+	return store.ctx
+}
+
+func (store *s3CacheStore) getObject(key string) (*s3CacheObject, error) {
+	output, err := store.client.GetObjectWithContext(store.context(), &s3.GetObjectInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(store.objectKey(key)),
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, ErrCacheMiss
+	} else if err != nil {
+		return nil, err
+	}
+	defer output.Body.Close()
+
+	body, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var object s3CacheObject
+	if err := json.Unmarshal(body, &object); err != nil {
+		return nil, err
+	}
+
+	if !object.ExpiresAt.IsZero() && time.Now().After(object.ExpiresAt) {
+		return nil, ErrCacheMiss
+	}
+
+	return &object, nil
+}
+
+func (store *s3CacheStore) putObject(key string, object *s3CacheObject) error {
+	body, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(store.bucket),
+		Key:         aws.String(store.objectKey(key)),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	}
+	if store.serverSideEncryption != "" {
+		input.ServerSideEncryption = aws.String(store.serverSideEncryption)
+	}
+	if store.kmsKeyID != "" {
+		input.SSEKMSKeyId = aws.String(store.kmsKeyID)
+	}
+
+	_, err = store.client.PutObjectWithContext(store.context(), input)
+	return err
+}
+
+func (store *s3CacheStore) Get(key string) (map[string]string, error) {
+	object, err := store.getObject(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return object.Fields, nil
+}
+
+// GetManyWithTTL reads up to s3ConcurrentGets of the objects at once.
+func (store *s3CacheStore) GetManyWithTTL(keys []string) ([]map[string]string, []time.Duration, error) {
+	entries := make([]map[string]string, len(keys))
+	ttls := make([]time.Duration, len(keys))
+
+	var mutex sync.Mutex
+	var firstErr error
+	var workers sync.WaitGroup
+	next := make(chan int)
+	for i := 0; i < s3ConcurrentGets && i < len(keys); i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for i := range next {
+				object, err := store.getObject(keys[i])
+				if err == ErrCacheMiss {
+					continue
+				} else if err != nil {
+					mutex.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mutex.Unlock()
+					continue
+				}
+
+				entries[i] = object.Fields
+				ttls[i] = -1
+				if !object.ExpiresAt.IsZero() {
+					ttls[i] = time.Until(object.ExpiresAt)
+				}
+			}
+		}()
+	}
+	for i := range keys {
+		next <- i
+	}
+	close(next)
+	workers.Wait()
+
+	if firstErr != nil {
+		return nil, nil, firstErr
+	}
+
+	return entries, ttls, nil
+}
+
+func (store *s3CacheStore) Set(key string, fields map[string]string) error {
+	object, err := store.getObject(key)
+	if err == ErrCacheMiss {
+		object = &s3CacheObject{Fields: make(map[string]string, len(fields))}
+	} else if err != nil {
+		return err
+	}
+
+	for field, value := range fields {
+		object.Fields[field] = value
+	}
+
+	return store.putObject(key, object)
+}
+
+func (store *s3CacheStore) Expire(key string, expiration time.Duration) error {
+	object, err := store.getObject(key)
+	if err == ErrCacheMiss {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	object.ExpiresAt = time.Now().Add(expiration)
+	return store.putObject(key, object)
+}
+
+// SetWithExpiry merges fields into the stored entry and sets its expiry in a
+// single PUT, a negative expiration keeps the one it has.
+func (store *s3CacheStore) SetWithExpiry(key string, fields map[string]string, expiration time.Duration) error {
+	object, err := store.getObject(key)
+	if err == ErrCacheMiss {
+		object = &s3CacheObject{Fields: make(map[string]string, len(fields))}
+	} else if err != nil {
+		return err
+	}
+
+	for field, value := range fields {
+		object.Fields[field] = value
+	}
+	if expiration > -1 {
+		object.ExpiresAt = time.Now().Add(expiration)
+	}
+
+	return store.putObject(key, object)
+}
+
+func (store *s3CacheStore) GetMany(keys []string) ([]map[string]string, error) {
+	entries, _, err := store.GetManyWithTTL(keys)
+	return entries, err
+}
+
+func (store *s3CacheStore) Delete(key string) error {
+	_, err := store.client.DeleteObjectWithContext(store.context(), &s3.DeleteObjectInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(store.objectKey(key)),
+	})
+	return err
+}
+
+func (store *s3CacheStore) Keys(prefix string) ([]string, error) {
+	var keys []string
+
+	err := store.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(store.bucket),
+		Prefix: aws.String(store.objectKey(prefix)),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			keys = append(keys, strings.TrimPrefix(aws.StringValue(object.Key), store.keyPrefix))
+		}
+		return true
+	})
+
+	return keys, err
+}
+
+// DocumentsSize adds up the sizes S3 lists for the objects, which hold the
+// responses with their few other fields.
+func (store *s3CacheStore) DocumentsSize(prefix string) (int, int64, error) {
+	documents := 0
+	var totalBytes int64
+
+	err := store.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(store.bucket),
+		Prefix: aws.String(store.objectKey(prefix)),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			documents++
+			totalBytes += aws.Int64Value(object.Size)
+		}
+		return true
+	})
+
+	return documents, totalBytes, err
+}
@@ -0,0 +1,19 @@
+package levee
+
+import (
+	"net/http"
+	"time"
+)
+
+const defaultSearchCachingPeriod = 5 * time.Minute
+
+func searchProxy(wr http.ResponseWriter, r *http.Request) {
+	proxyLog.debugf(r, "A search request handling for %s", r.URL.RequestURI())
+
+	policy := cachePolicyFor(r.URL.Path)
+	if policy.TTL <= 0 {
+		policy.TTL = defaultSearchCachingPeriod
+	}
+
+	cachedProxy(wr, r, policy)
+}
@@ -0,0 +1,290 @@
+package levee
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Server is a levee that can be embedded into another service, either by
+// mounting its Handler or by letting it listen on its own ports with Start.
+// levee keeps its state in package variables, a process runs one Server at a
+// time and NewServer fails until the previous one is shut down.
+type Server struct {
+	config      Config
+	handler     http.Handler
+	httpServer  *http.Server
+	adminServer *http.Server
+	errors      chan error
+	stop        chan struct{}
+	stopOnce    sync.Once
+}
+
+// ServerOption changes how NewServer sets levee up, on top of its Config.
+type ServerOption func(*serverOptions)
+
+type serverOptions struct {
+	config Config
+	logger Logger
+	cache  CacheStore
+}
+
+// WithCache keeps the cached documents in store instead of the cache
+// configured by cache.type.
+func WithCache(store CacheStore) ServerOption {
+	return func(options *serverOptions) {
+		options.cache = store
+	}
+}
+
+// WithUpstreams adds external registries to fetch packages from, after those
+// of the config.
+func WithUpstreams(registries ...Registry) ServerOption {
+	return func(options *serverOptions) {
+		options.config.ExternalRegistries = append(options.config.ExternalRegistries, registries...)
+	}
+}
+
+// WithTTL caches the metadata of every package for ttl, unless one of the
+// cachePolicies of the config matches it first.
+func WithTTL(ttl time.Duration) ServerOption {
+	return func(options *serverOptions) {
+		options.config.CachePolicies = append(options.config.CachePolicies,
+			CachePolicy{Pattern: "/*", TTL: ttl},
+			CachePolicy{Pattern: "/@*/*", TTL: ttl},
+		)
+	}
+}
+
+// WithLogger sends the log records of levee to logger instead of the handler
+// configured by logging.format and logging.output. logging.level and
+// logging.components still filter them, unset they leave it to logger.
+func WithLogger(logger Logger) ServerOption {
+	return func(options *serverOptions) {
+		options.logger = logger
+	}
+}
+
+// WithLogHandler sends the log records of levee to handler, see WithLogger.
+func WithLogHandler(handler slog.Handler) ServerOption {
+	return WithLogger(slog.New(handler))
+}
+
+// LoadConfig reads a config file the way the levee command does, including
+// its includes, environment overrides and secret files.
+func LoadConfig(filename string) (Config, error) {
+	return loadConfig(filename, nil)
+}
+
+// New sets levee up from options alone, with the defaults of every setting
+// they do not cover, e.g.
+//
+//	levee.New(levee.WithUpstreams(levee.Registry{URL: "https://registry.npmjs.org"}), levee.WithTTL(time.Hour))
+func New(options ...ServerOption) (*Server, error) {
+	return NewServer(Config{}, options...)
+}
+
+var errServerExists = errors.New("levee already runs a Server in this process, shut it down first")
+
+// serverExists is 1 from the creation of a Server till its Shutdown.
+var serverExists int32
+
+// NewServer sets levee up from config, connecting to its cache, and starts
+// its background work: health checks, cache writers and the warmup.
+func NewServer(config Config, options ...ServerOption) (*Server, error) {
+	if !atomic.CompareAndSwapInt32(&serverExists, 0, 1) {
+		return nil, errServerExists
+	}
+
+	server, err := newServer(config, options...)
+	if err != nil {
+		atomic.StoreInt32(&serverExists, 0)
+	}
+
+	return server, err
+}
+
+// newServer undoes what it set up when a later step fails: the connections
+// of the cache and the access log. The background work is started last,
+// once nothing can fail anymore.
+func newServer(config Config, options ...ServerOption) (server *Server, err error) {
+	serverOptions := serverOptions{config: config}
+	for _, option := range options {
+		option(&serverOptions)
+	}
+	config = serverOptions.config
+
+	config.applyDefaults()
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := configureLogging(config.Logging, serverOptions.logger); err != nil {
+		return nil, err
+	}
+	accessLog, err := openAccessLog(config.AccessLog)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if file, ok := accessLog.(*os.File); ok && err != nil && file != os.Stdout && file != os.Stderr {
+			file.Close()
+		}
+	}()
+
+	defer func() {
+		if err != nil {
+			tearDown(serverOptions.cache == nil)
+		}
+	}()
+	if err := setUp(config, serverOptions.cache); err != nil {
+		return nil, err
+	}
+	adminListenAddress = config.Admin.Listen
+	clientFilter, err := newIPFilter(config.Access.Allow, config.Access.Deny)
+	if err != nil {
+		return nil, err
+	}
+	adminFilter, err := newIPFilter(config.Access.AdminAllow, config.Access.AdminDeny)
+	if err != nil {
+		return nil, err
+	}
+	offline = config.Offline
+	if offline {
+		serverLog.infof(nil, "Running offline, only cached documents will be served")
+	}
+
+	warmupPackages := config.Warmup.Packages
+	if config.Warmup.PackagesFile != "" {
+		filePackages, err := readPackageList(config.Warmup.PackagesFile)
+		if err != nil {
+			return nil, err
+		}
+		warmupPackages = append(warmupPackages, filePackages...)
+	}
+
+	stop := make(chan struct{})
+	middlewares := serverMiddlewares(config, accessLog, clientFilter, adminFilter, stop)
+	server = &Server{
+		config:  config,
+		handler: chainMiddlewares(leveeRouter(), middlewares, config.Middlewares),
+		errors:  make(chan error, 2),
+		stop:    stop,
+	}
+
+	server.httpServer = &http.Server{
+		Addr:              fmt.Sprintf(":%s", config.LeveePort),
+		Handler:           server.handler,
+		ReadTimeout:       config.Server.ReadTimeout,
+		ReadHeaderTimeout: config.Server.ReadHeaderTimeout,
+		WriteTimeout:      config.Server.WriteTimeout,
+		IdleTimeout:       config.Server.IdleTimeout,
+		MaxHeaderBytes:    config.Server.MaxHeaderBytes,
+	}
+	if adminListenAddress != "" {
+		server.adminServer = &http.Server{
+			Addr:              adminListenAddress,
+			Handler:           logRequests(assignRequestID(restrictAddresses(adminRouter(), adminFilter, ipFilter{}))),
+			ReadHeaderTimeout: config.Server.ReadHeaderTimeout,
+		}
+	}
+
+	if config.HealthCheck.Interval > 0 && !offline {
+		go watchUpstreamsHealth(config.HealthCheck.Interval, config.HealthCheck.Path, config.HealthCheck.Timeout, server.stop)
+	}
+	startCacheWriters(config.Cache.Writes)
+	if len(warmupPackages) > 0 && !offline {
+		go warmCache(warmupPackages)
+	}
+
+	return server, nil
+}
+
+// Handler serves the registry and, unless admin.listen is set, the admin
+// endpoints. It can be mounted into another server instead of calling Start.
+func (server *Server) Handler() http.Handler {
+	return server.handler
+}
+
+// Start listens on the configured ports and serves in the background. It
+// returns once the listeners are open, errors serving later are logged.
+func (server *Server) Start() error {
+	listener, err := net.Listen("tcp", server.httpServer.Addr)
+	if err != nil {
+		return err
+	}
+
+	if server.adminServer != nil {
+		adminListener, err := net.Listen("tcp", server.adminServer.Addr)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+
+		go func() {
+			serverLog.infof(nil, "Serving the admin endpoints on %s", server.adminServer.Addr)
+			server.serveUntilShutdown(server.adminServer.Serve(adminListener))
+		}()
+	}
+
+	go func() {
+		if server.config.TLS.CertFile != "" {
+			server.httpServer.TLSConfig = &tls.Config{
+				MinVersion: tls.VersionTLS12,
+				NextProtos: []string{"h2", "http/1.1"},
+			}
+			serverLog.infof(nil, "Serving TLS with HTTP/2 enabled")
+			server.serveUntilShutdown(server.httpServer.ServeTLS(listener, server.config.TLS.CertFile, server.config.TLS.KeyFile))
+			return
+		}
+
+		server.serveUntilShutdown(server.httpServer.Serve(listener))
+	}()
+
+	return nil
+}
+
+func (server *Server) serveUntilShutdown(err error) {
+	if err == http.ErrServerClosed {
+		return
+	}
+
+	serverLog.errorf(nil, "%s", err)
+	server.errors <- err
+}
+
+// Shutdown drains the in-flight requests and pending cache writes, stops the
+// background work and closes the cache, giving up when ctx is done. Calling
+// it again only waits for the draining once more.
+func (server *Server) Shutdown(ctx context.Context) error {
+	stopping := false
+	server.stopOnce.Do(func() {
+		close(server.stop)
+		stopping = true
+	})
+
+	err := server.httpServer.Shutdown(ctx)
+	if err != nil {
+		serverLog.errorf(nil, "Failed to drain all in-flight requests: %s", err)
+	}
+	if server.adminServer != nil {
+		server.adminServer.Shutdown(ctx)
+	}
+	if err := drainCacheWrites(ctx); err != nil {
+		serverLog.errorf(nil, "Failed to finish all pending cache writes: %s", err)
+	}
+	if stopping {
+		tearDown(true)
+		atomic.StoreInt32(&serverExists, 0)
+	}
+
+	return err
+}
@@ -0,0 +1,43 @@
+package levee_test
+
+import (
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"testing"
+
+	"github.com/kareem-abdelsalam/levee"
+	"github.com/kareem-abdelsalam/levee/cachetest"
+)
+
+func TestNewServerFailure(t *testing.T) {
+	config := levee.Config{ExternalRegistries: []levee.Registry{{URL: "https://registry.npmjs.org"}}}
+	config.Cache.Blobs.Directory = t.TempDir()
+	config.Access.Allow = []string{"not an address"}
+	logs := levee.WithLogHandler(slog.NewTextHandler(ioutil.Discard, nil))
+
+	if _, err := levee.NewServer(config, levee.WithCache(cachetest.NewMockCache()), logs); err == nil {
+		t.Fatal("NewServer accepted an invalid address filter")
+	}
+
+	config.Access.Allow = nil
+	server, err := levee.NewServer(config, levee.WithCache(cachetest.NewMockCache()), logs)
+	if err != nil {
+		t.Fatalf("NewServer failed after a failed one: %s", err)
+	}
+	server.Shutdown(context.Background())
+}
+
+func TestShutdownTwice(t *testing.T) {
+	config := levee.Config{ExternalRegistries: []levee.Registry{{URL: "https://registry.npmjs.org"}}}
+	config.Cache.Blobs.Directory = t.TempDir()
+	server, err := levee.NewServer(config, levee.WithCache(cachetest.NewMockCache()), levee.WithLogHandler(slog.NewTextHandler(ioutil.Discard, nil)))
+	if err != nil {
+		t.Fatalf("NewServer failed: %s", err)
+	}
+
+	server.Shutdown(context.Background())
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Errorf("The second Shutdown failed: %s", err)
+	}
+}
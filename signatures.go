@@ -0,0 +1,156 @@
+package levee
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type SignatureConfig struct {
+	Verify            bool   `yaml:"verify"`
+	RequireSignatures bool   `yaml:"requireSignatures"`
+	KeysURL           string `yaml:"keysURL"`
+}
+
+var errUnsignedTarball = errors.New("tarball has no registry signature")
+var errTarballSignature = errors.New("tarball does not match its registry signature")
+
+var registryKeys = struct {
+	sync.Mutex
+	keys      map[string]*ecdsa.PublicKey
+	fetchedAt time.Time
+}{}
+
+func isExternalResponse(resp *http.Response) bool {
+	if resp.Request == nil {
+		return false
+	}
+
+	for _, registry := range settings().externalRegistries {
+		if strings.HasPrefix(resp.Request.URL.String(), strings.TrimSuffix(registry.URL, "/")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func fetchRegistryKeys() (map[string]*ecdsa.PublicKey, error) {
+	registries := orderRegistries(settings().externalRegistries)
+	if len(registries) == 0 {
+		return nil, fmt.Errorf("no external registry to fetch signing keys from")
+	}
+	registry := registries[0]
+
+	keysURL := settings().signatureConfig.KeysURL
+	if keysURL == "" {
+		keysURL = strings.TrimSuffix(registry.URL, "/") + "/-/npm/v1/keys"
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, keysURL, nil)
+	registry.authorize(req)
+
+	resp, err := registry.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s responded with %d", keysURL, resp.StatusCode)
+	}
+
+	var keysResponse struct {
+		Keys []struct {
+			KeyID string `json:"keyid"`
+			Key   string `json:"key"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&keysResponse); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*ecdsa.PublicKey, len(keysResponse.Keys))
+	for _, key := range keysResponse.Keys {
+		der, err := base64.StdEncoding.DecodeString(key.Key)
+		if err != nil {
+			continue
+		}
+
+		publicKey, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			continue
+		}
+
+		if ecdsaKey, ok := publicKey.(*ecdsa.PublicKey); ok {
+			keys[key.KeyID] = ecdsaKey
+		}
+	}
+
+	return keys, nil
+}
+
+func registryPublicKey(keyID string) (*ecdsa.PublicKey, error) {
+	registryKeys.Lock()
+	defer registryKeys.Unlock()
+
+	if key, ok := registryKeys.keys[keyID]; ok {
+		return key, nil
+	}
+
+	if time.Since(registryKeys.fetchedAt) > time.Minute {
+		keys, err := fetchRegistryKeys()
+		if err != nil {
+			return nil, err
+		}
+		registryKeys.keys = keys
+		registryKeys.fetchedAt = time.Now()
+	}
+
+	key, ok := registryKeys.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown registry signing key %s", keyID)
+	}
+
+	return key, nil
+}
+
+func verifyTarballSignature(packageName string, dist tarballDist) error {
+	config := settings().signatureConfig
+	if !config.Verify {
+		return nil
+	}
+
+	if len(dist.Signatures) == 0 {
+		if config.RequireSignatures {
+			return errUnsignedTarball
+		}
+		policyLog.warnf(nil, "No registry signature to verify %s@%s against", packageName, dist.version)
+		return nil
+	}
+
+	digest := sha256.Sum256([]byte(fmt.Sprintf("%s@%s:%s", packageName, dist.version, dist.Integrity)))
+
+	for _, signature := range dist.Signatures {
+		key, err := registryPublicKey(signature.KeyID)
+		if err != nil {
+			policyLog.warnf(nil, "Cannot verify the signature of %s@%s: %s", packageName, dist.version, err)
+			continue
+		}
+
+		signatureBytes, err := base64.StdEncoding.DecodeString(signature.Signature)
+		if err == nil && ecdsa.VerifyASN1(key, digest[:], signatureBytes) {
+			return nil
+		}
+	}
+
+	return errTarballSignature
+}
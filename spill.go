@@ -0,0 +1,130 @@
+package levee
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// spillBuffer is written once and then read, possibly several times after
+// seeking back to its start.
+type spillBuffer struct {
+	memory bytes.Buffer
+	file   *os.File
+	reader *bytes.Reader
+	size   int64
+
+	mutex sync.Mutex
+	// readers counts the readers opened on the buffer that aren't closed
+	// yet, its temporary file is removed only after them.
+	readers int
+	closed  bool
+}
+
+// spillReader is a reader of its own over a spillBuffer.
+type spillReader struct {
+	*io.SectionReader
+	buffer *spillBuffer
+	once   sync.Once
+}
+
+func (buffer *spillBuffer) Write(p []byte) (int, error) {
+	if buffer.file == nil && buffer.size+int64(len(p)) > settings().spillThreshold {
+		file, err := ioutil.TempFile("", "levee-spill-")
+		if err != nil {
+			return 0, err
+		}
+		if _, err := file.Write(buffer.memory.Bytes()); err != nil {
+			discardTempFile(file)
+			return 0, err
+		}
+		buffer.file = file
+		buffer.memory = bytes.Buffer{}
+	}
+
+	var written int
+	var err error
+	if buffer.file != nil {
+		written, err = buffer.file.Write(p)
+	} else {
+		written, err = buffer.memory.Write(p)
+	}
+	buffer.size += int64(written)
+
+	return written, err
+}
+
+func (buffer *spillBuffer) contents() io.ReadSeeker {
+	if buffer.file != nil {
+		return buffer.file
+	}
+	if buffer.reader == nil {
+		buffer.reader = bytes.NewReader(buffer.memory.Bytes())
+	}
+
+	return buffer.reader
+}
+
+func (buffer *spillBuffer) Read(p []byte) (int, error) {
+	return buffer.contents().Read(p)
+}
+
+func (buffer *spillBuffer) Seek(offset int64, whence int) (int64, error) {
+	return buffer.contents().Seek(offset, whence)
+}
+
+func (buffer *spillBuffer) Size() int64 {
+	return buffer.size
+}
+
+// open returns a reader of its own over the contents, so that they can be
+// served to several clients at once. It fails once the buffer is closed.
+func (buffer *spillBuffer) open() (*spillReader, bool) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	if buffer.closed {
+		return nil, false
+	}
+	buffer.readers++
+
+	var contents io.ReaderAt = buffer.file
+	if buffer.file == nil {
+		contents = bytes.NewReader(buffer.memory.Bytes())
+	}
+
+	return &spillReader{SectionReader: io.NewSectionReader(contents, 0, buffer.size), buffer: buffer}, true
+}
+
+// Close removes the temporary file, if the body was spilled into one, once
+// the readers opened on it are closed too.
+func (buffer *spillBuffer) Close() error {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	buffer.closed = true
+	buffer.discard()
+
+	return nil
+}
+
+func (buffer *spillBuffer) discard() {
+	if buffer.closed && buffer.readers == 0 && buffer.file != nil {
+		discardTempFile(buffer.file)
+		buffer.file = nil
+	}
+}
+
+func (reader *spillReader) Close() error {
+	reader.once.Do(func() {
+		reader.buffer.mutex.Lock()
+		defer reader.buffer.mutex.Unlock()
+
+		reader.buffer.readers--
+		reader.buffer.discard()
+	})
+
+	return nil
+}
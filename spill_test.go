@@ -0,0 +1,38 @@
+package levee
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSpillReadersOutliveBuffer(t *testing.T) {
+	defer currentSettings.Store(&defaultRuntimeSettings)
+	spilling := defaultRuntimeSettings
+	spilling.spillThreshold = 4
+	currentSettings.Store(&spilling)
+
+	buffer := &spillBuffer{}
+	if _, err := buffer.Write([]byte("the tarball")); err != nil {
+		t.Fatal(err)
+	}
+	spilled := buffer.file.Name()
+
+	reader, ok := buffer.open()
+	if !ok {
+		t.Fatal("The buffer couldn't be opened")
+	}
+	buffer.Close()
+	if _, ok := buffer.open(); ok {
+		t.Error("The closed buffer was opened")
+	}
+
+	contents, err := ioutil.ReadAll(reader)
+	if err != nil || string(contents) != "the tarball" {
+		t.Errorf("The reader returned %q, %v after the buffer was closed", contents, err)
+	}
+	reader.Close()
+	if _, err := os.Stat(spilled); !os.IsNotExist(err) {
+		t.Errorf("The spilled file %s is left after all readers were closed", spilled)
+	}
+}
@@ -0,0 +1,246 @@
+package levee
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+type upstreamCounters struct {
+	Successes uint64  `json:"successes"`
+	Failures  uint64  `json:"failures"`
+	Success   float64 `json:"successRate"`
+}
+
+var proxyStats = struct {
+	sync.Mutex
+	startedAt   time.Time
+	hits        uint64
+	staleHits   uint64
+	misses      uint64
+	packageHits map[string]uint64
+	upstreams   map[string]*upstreamCounters
+	// uncheckedServed and uncheckedRefused count the tarballs the
+	// vulnerability gate failed to check.
+	uncheckedServed  uint64
+	uncheckedRefused uint64
+}{
+	startedAt:   time.Now(),
+	packageHits: make(map[string]uint64),
+	upstreams:   make(map[string]*upstreamCounters),
+}
+
+func recordCacheHit(packageName string, stale bool) {
+	proxyStats.Lock()
+	defer proxyStats.Unlock()
+
+	proxyStats.hits++
+	if stale {
+		proxyStats.staleHits++
+	}
+	if packageName != "" {
+		proxyStats.packageHits[packageName]++
+	}
+}
+
+func recordCacheMiss() {
+	proxyStats.Lock()
+	proxyStats.misses++
+	proxyStats.Unlock()
+}
+
+func recordUpstreamResult(registryURL string, success bool) {
+	proxyStats.Lock()
+	defer proxyStats.Unlock()
+
+	counters, ok := proxyStats.upstreams[registryURL]
+	if !ok {
+		counters = &upstreamCounters{}
+		proxyStats.upstreams[registryURL] = counters
+	}
+
+	if success {
+		counters.Successes++
+	} else {
+		counters.Failures++
+	}
+	counters.Success = float64(counters.Successes) / float64(counters.Successes+counters.Failures)
+}
+
+func recordVulnerabilityCheckFailure(served bool) {
+	proxyStats.Lock()
+	defer proxyStats.Unlock()
+
+	if served {
+		proxyStats.uncheckedServed++
+	} else {
+		proxyStats.uncheckedRefused++
+	}
+}
+
+type packageHitCount struct {
+	Package string `json:"package"`
+	Hits    uint64 `json:"hits"`
+}
+
+func topPackages(limit int) []packageHitCount {
+	packages := make([]packageHitCount, 0, len(proxyStats.packageHits))
+	for packageName, hits := range proxyStats.packageHits {
+		packages = append(packages, packageHitCount{Package: packageName, Hits: hits})
+	}
+
+	sort.Slice(packages, func(i, j int) bool {
+		if packages[i].Hits == packages[j].Hits {
+			return packages[i].Package < packages[j].Package
+		}
+		return packages[i].Hits > packages[j].Hits
+	})
+	if len(packages) > limit {
+		packages = packages[:limit]
+	}
+
+	return packages
+}
+
+func cachedDocumentsSize() (int, int64, error) {
+	return documentsSize(cacheStore, settings().cacheKeyPrefix+"/")
+}
+
+// documentsSize counts the documents below prefix and their size. Stores
+// that can't tell the size on their own have every document read.
+func documentsSize(store CacheStore, prefix string) (int, int64, error) {
+	if sizedStore, ok := store.(sizedCacheStore); ok {
+		return sizedStore.DocumentsSize(prefix)
+	}
+
+	keys, err := store.Keys(prefix)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	npmResponses, err := getCacheEntries(store, keys)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var totalBytes int64
+	for _, npmResponse := range npmResponses {
+		totalBytes += int64(len(npmResponse["wholeResponse"]))
+	}
+
+	return len(keys), totalBytes, nil
+}
+
+func cachedBlobsSize() (int, int64, error) {
+	keys, err := blobStore.Keys("")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var totalBytes int64
+	if sizer, ok := blobStore.(interface{ Size() (int64, error) }); ok {
+		totalBytes, err = sizer.Size()
+	}
+
+	return len(keys), totalBytes, err
+}
+
+// cacheSizesInterval is how long the counted sizes of the cache are reused.
+// Counting them lists every key of the cache, which is too much for every
+// stats request of an open dashboard.
+const cacheSizesInterval = time.Minute
+
+type cacheSizes struct {
+	documents     int
+	tarballs      int
+	documentBytes int64
+	tarballBytes  int64
+}
+
+var lastCacheSizes struct {
+	sync.Mutex
+	cacheSizes
+	countedAt time.Time
+}
+
+// countCacheSizes returns the sizes of the cache counted within the last
+// cacheSizesInterval, requests arriving while they are counted wait for them.
+func countCacheSizes() (cacheSizes, time.Time, error) {
+	lastCacheSizes.Lock()
+	defer lastCacheSizes.Unlock()
+
+	if !lastCacheSizes.countedAt.IsZero() && time.Since(lastCacheSizes.countedAt) < cacheSizesInterval {
+		return lastCacheSizes.cacheSizes, lastCacheSizes.countedAt, nil
+	}
+
+	var sizes cacheSizes
+	var err error
+	if sizes.documents, sizes.documentBytes, err = cachedDocumentsSize(); err != nil {
+		return cacheSizes{}, time.Time{}, err
+	}
+	if sizes.tarballs, sizes.tarballBytes, err = cachedBlobsSize(); err != nil {
+		return cacheSizes{}, time.Time{}, err
+	}
+
+	lastCacheSizes.cacheSizes = sizes
+	lastCacheSizes.countedAt = time.Now()
+	return sizes, lastCacheSizes.countedAt, nil
+}
+
+// forgetCacheSizes has the sizes counted again, e.g. after a purge.
+func forgetCacheSizes() {
+	lastCacheSizes.Lock()
+	defer lastCacheSizes.Unlock()
+
+	lastCacheSizes.countedAt = time.Time{}
+}
+
+func currentStats() (map[string]interface{}, error) {
+	sizes, countedAt, err := countCacheSizes()
+	if err != nil {
+		return nil, err
+	}
+
+	proxyStats.Lock()
+	defer proxyStats.Unlock()
+
+	hitRatio := 0.0
+	if requests := proxyStats.hits + proxyStats.misses; requests > 0 {
+		hitRatio = float64(proxyStats.hits) / float64(requests)
+	}
+
+	upstreams := make(map[string]upstreamCounters, len(proxyStats.upstreams))
+	for registryURL, counters := range proxyStats.upstreams {
+		upstreams[registryURL] = *counters
+	}
+
+	return map[string]interface{}{
+		"since":       proxyStats.startedAt.UTC().Format(time.RFC3339),
+		"hits":        proxyStats.hits,
+		"staleHits":   proxyStats.staleHits,
+		"misses":      proxyStats.misses,
+		"hitRatio":    hitRatio,
+		"entries":     map[string]int{"documents": sizes.documents, "tarballs": sizes.tarballs},
+		"bytes":       map[string]int64{"documents": sizes.documentBytes, "tarballs": sizes.tarballBytes, "total": sizes.documentBytes + sizes.tarballBytes},
+		"countedAt":   countedAt.UTC().Format(time.RFC3339),
+		"topPackages": topPackages(20),
+		"upstreams":   upstreams,
+		"cacheWrites": currentCacheWriteStats(),
+		"vulnerabilityCheckFailures": map[string]uint64{
+			"served":  proxyStats.uncheckedServed,
+			"refused": proxyStats.uncheckedRefused,
+		},
+	}, nil
+}
+
+func cacheStats(wr http.ResponseWriter, r *http.Request) {
+	stats, err := currentStats()
+	if err != nil {
+		adminLog.errorf(r, "Failed to collect the cache statistics: %s", err)
+		writeJSON(wr, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(wr, http.StatusOK, stats)
+}
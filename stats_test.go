@@ -0,0 +1,56 @@
+package levee
+
+import "testing"
+
+func TestDocumentsSize(t *testing.T) {
+	store := newMemoryCacheStore(0)
+	store.Set("/lodash", map[string]string{"wholeResponse": "12345", "Etag": "v1"})
+	store.Set("/react", map[string]string{"wholeResponse": "123"})
+	store.Set("other", map[string]string{"wholeResponse": "1234567"})
+
+	documents, totalBytes, err := documentsSize(store, "/")
+	if err != nil || documents != 2 || totalBytes != 8 {
+		t.Errorf("documentsSize returned %d, %d, %v, expected 2 documents of 8 bytes", documents, totalBytes, err)
+	}
+
+	// The tiered store asks its backing store, which has to be read.
+	documents, totalBytes, err = documentsSize(newTieredCacheStore(unsizedCacheStore{store}, 0, 0), "/")
+	if err != nil || documents != 2 || totalBytes != 8 {
+		t.Errorf("documentsSize of a store without sizes returned %d, %d, %v, expected 2 documents of 8 bytes", documents, totalBytes, err)
+	}
+}
+
+// unsizedCacheStore hides the DocumentsSize of the store it wraps.
+type unsizedCacheStore struct {
+	CacheStore
+}
+
+func TestCountCacheSizesReusesCount(t *testing.T) {
+	store := newMemoryCacheStore(0)
+	blobs, err := newFileBlobStore(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("Failed to create the blob store: %s", err)
+	}
+	previousCache, previousBlobs := cacheStore, blobStore
+	cacheStore, blobStore = store, blobs
+	defer func() {
+		cacheStore, blobStore = previousCache, previousBlobs
+		forgetCacheSizes()
+	}()
+	forgetCacheSizes()
+
+	store.Set("/lodash", map[string]string{"wholeResponse": "12345"})
+	if sizes, _, err := countCacheSizes(); err != nil || sizes.documents != 1 {
+		t.Fatalf("countCacheSizes returned %+v, %v, expected 1 document", sizes, err)
+	}
+
+	store.Set("/react", map[string]string{"wholeResponse": "123"})
+	if sizes, _, _ := countCacheSizes(); sizes.documents != 1 {
+		t.Errorf("countCacheSizes counted %d documents again right away", sizes.documents)
+	}
+
+	forgetCacheSizes()
+	if sizes, _, _ := countCacheSizes(); sizes.documents != 2 || sizes.documentBytes != 8 {
+		t.Errorf("countCacheSizes after forgetCacheSizes returned %+v, expected 2 documents of 8 bytes", sizes)
+	}
+}
@@ -0,0 +1,145 @@
+package levee
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+var errObjectTooLarge = errors.New("too large to cache")
+
+// cacheEntry builds the cached form of a response, its head followed by its
+// body and compressed as configured, while the body is downloaded. Only the
+// final entry is held in memory, not a copy of the body next to a dump of the
+// whole response.
+type cacheEntry struct {
+	buffer     bytes.Buffer
+	compressor io.WriteCloser
+	encoding   string
+	size       int64
+	tooLarge   bool
+}
+
+func newCacheEntry(resp *http.Response) (*cacheEntry, error) {
+	entry := &cacheEntry{}
+
+	var err error
+	if entry.compressor, entry.encoding, err = newCacheCompressor(&entry.buffer); err != nil {
+		return nil, err
+	}
+
+	// The length of the body is known only once it has been read, the
+	// cached response is read back till its end instead.
+	fmt.Fprintf(entry.compressor, "HTTP/%d.%d %s\r\n", resp.ProtoMajor, resp.ProtoMinor, resp.Status)
+	resp.Header.WriteSubset(entry.compressor, map[string]bool{"Content-Length": true, "Transfer-Encoding": true})
+	io.WriteString(entry.compressor, "\r\n")
+
+	return entry, nil
+}
+
+// Write never fails on an oversized body, it drops the entry instead so the
+// body keeps streaming to the client.
+func (entry *cacheEntry) Write(p []byte) (int, error) {
+	maxSize := settings().maxCachedObjectSize
+	if entry.tooLarge {
+		return len(p), nil
+	}
+
+	entry.size += int64(len(p))
+	if maxSize > 0 && entry.size > maxSize {
+		entry.tooLarge = true
+		entry.buffer = bytes.Buffer{}
+		return len(p), nil
+	}
+
+	return entry.compressor.Write(p)
+}
+
+// finish completes the entry, calling it again returns the same entry.
+func (entry *cacheEntry) finish() (string, string, error) {
+	if entry.tooLarge {
+		return "", "", errObjectTooLarge
+	}
+	if entry.compressor != nil {
+		if err := entry.compressor.Close(); err != nil {
+			return "", "", err
+		}
+		entry.compressor = nil
+	}
+
+	return entry.buffer.String(), entry.encoding, nil
+}
+
+// teeResponse copies the body of resp to dst and, when its status is
+// cacheable, into a cache entry at the same time.
+func teeResponse(dst io.Writer, resp *http.Response) (*cacheEntry, error) {
+	maxSize := settings().maxCachedObjectSize
+	if !isCacheableStatus(resp.StatusCode) {
+		_, err := io.Copy(dst, resp.Body)
+		return nil, err
+	}
+
+	if maxSize > 0 && resp.ContentLength > maxSize {
+		_, err := io.Copy(dst, resp.Body)
+		return &cacheEntry{tooLarge: true}, err
+	}
+
+	entry, err := newCacheEntry(resp)
+	if err != nil {
+		io.Copy(dst, resp.Body)
+		return nil, err
+	}
+
+	if _, err := io.Copy(io.MultiWriter(dst, entry), resp.Body); err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// serveResponse serves resp with body, its links pointed at the base URL of
+// the client. Localizing changes the length of the body, it is sent without
+// one.
+func serveResponse(wr http.ResponseWriter, r *http.Request, resp *http.Response, body io.Reader) error {
+	for k, v := range resp.Header {
+		if k != "Content-Length" {
+			wr.Header().Set(k, v[0])
+		}
+	}
+	wr.WriteHeader(resp.StatusCode)
+
+	localized := newLocalizingWriter(wr, r)
+	if _, err := io.Copy(localized, body); err != nil {
+		return err
+	}
+
+	return localized.flush()
+}
+
+func registryReverseProxy(registry Registry, transportError *error) *httputil.ReverseProxy {
+	target, _ := url.Parse(registry.URL)
+
+	return &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			req.URL.Path = target.Path + req.URL.Path
+			req.URL.RawPath = ""
+			req.Host = target.Host
+			registry.authorize(req)
+		},
+		Transport: registry.client().Transport,
+		ModifyResponse: func(resp *http.Response) error {
+			registry.transformResponse(resp)
+			return nil
+		},
+		ErrorHandler: func(wr http.ResponseWriter, req *http.Request, err error) {
+			upstreamLog.warnf(req, "Registry %s failed to respond to %s %s: %s", registry.URL, req.Method, req.URL.Path, err)
+			*transportError = err
+		},
+	}
+}
@@ -0,0 +1,340 @@
+package levee
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+var blobStore BlobStore
+
+var errTarballIntegrity = errors.New("tarball does not match the integrity of its package metadata")
+var errTarballUnverified = errors.New("tarball is not listed in its package metadata, it can't be verified")
+
+type tarballDist struct {
+	Tarball    string `json:"tarball"`
+	Shasum     string `json:"shasum"`
+	Integrity  string `json:"integrity"`
+	Signatures []struct {
+		KeyID     string `json:"keyid"`
+		Signature string `json:"sig"`
+	} `json:"signatures"`
+
+	version string
+}
+
+func packageMetadata(packageName string) ([]byte, error) {
+	key := cacheKey("/" + packageName)
+
+	npmResponses, _ := getCacheEntries(cacheStore, []string{key, key + abbreviatedMetadataSuffix})
+	for _, npmResponse := range npmResponses {
+		if npmResponse == nil {
+			continue
+		}
+		if body, err := decodeCachedMetadata(npmResponse); err == nil {
+			return body, nil
+		}
+	}
+
+	return fetchAndCache("/" + packageName)
+}
+
+func cachedMetadata(key string) ([]byte, error) {
+	npmResponse, err := cacheStore.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeCachedMetadata(npmResponse)
+}
+
+func decodeCachedMetadata(npmResponse map[string]string) ([]byte, error) {
+	wholeResponse, err := decompressCachedBody(npmResponse["wholeResponse"], npmResponse["encoding"])
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader([]byte(wholeResponse))), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func expectedTarballDist(packageName string, tarballName string) (tarballDist, bool) {
+	body, err := packageMetadata(packageName)
+	if err != nil {
+		return tarballDist{}, false
+	}
+
+	var metadata struct {
+		Versions map[string]struct {
+			Dist tarballDist `json:"dist"`
+		} `json:"versions"`
+	}
+	if err := json.Unmarshal(body, &metadata); err != nil {
+		return tarballDist{}, false
+	}
+
+	for versionNumber, version := range metadata.Versions {
+		if path.Base(version.Dist.Tarball) == tarballName {
+			version.Dist.version = versionNumber
+			return version.Dist, true
+		}
+	}
+
+	return tarballDist{}, false
+}
+
+func verifyTarball(dist tarballDist, sha1Sum []byte, sha512Sum []byte) error {
+	for _, integrity := range strings.Fields(dist.Integrity) {
+		separator := strings.Index(integrity, "-")
+		if separator < 0 {
+			continue
+		}
+
+		var actualSum []byte
+		switch integrity[:separator] {
+		case "sha512":
+			actualSum = sha512Sum
+		case "sha1":
+			actualSum = sha1Sum
+		default:
+			continue
+		}
+
+		expectedDigest := strings.SplitN(integrity[separator+1:], "?", 2)[0]
+		if base64.StdEncoding.EncodeToString(actualSum) != expectedDigest {
+			return errTarballIntegrity
+		}
+	}
+
+	if dist.Shasum != "" && !strings.EqualFold(hex.EncodeToString(sha1Sum), dist.Shasum) {
+		return errTarballIntegrity
+	}
+
+	return nil
+}
+
+// serveTarball serves a downloaded or cached blob, validated against the
+// ETag and Last-Modified the upstream served it with.
+// sharedBlob is a downloaded blob that a cache fill hands to the requests
+// waiting for it.
+type sharedBlob struct {
+	buffer *spillBuffer
+	info   BlobInfo
+}
+
+// openFilledBlob opens the blob a cache fill shared or, when it didn't or is
+// done with it, the one it cached.
+func openFilledBlob(shared interface{}, key string) (io.ReadCloser, BlobInfo, error) {
+	if fetched, ok := shared.(sharedBlob); ok {
+		if blob, ok := fetched.buffer.open(); ok {
+			return blob, fetched.info, nil
+		}
+	}
+
+	return blobStore.Get(key)
+}
+
+func serveTarball(wr http.ResponseWriter, r *http.Request, tarball io.Reader, info BlobInfo) {
+	wr.Header().Set("Content-Type", "application/octet-stream")
+	if info.ETag != "" {
+		wr.Header().Set("ETag", info.ETag)
+	}
+
+	seeker, seekable := tarball.(io.ReadSeeker)
+	if !seekable {
+		io.Copy(wr, tarball)
+		return
+	}
+
+	http.ServeContent(wr, r, path.Base(r.URL.Path), info.LastModified, seeker)
+}
+
+func fetchVerifiedTarball(r *http.Request) (*http.Response, *spillBuffer, error) {
+	r = r.Clone(r.Context())
+	r.Method = http.MethodGet
+	r.Header.Del("Range")
+	r.Header.Del("If-Range")
+
+	resp, err := fetchPackage(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp, nil, nil
+	}
+
+	tarballName := path.Base(r.URL.Path)
+	packageName := packageNameFromPath(r.URL.Path)
+	// Only the packages of external registries are quarantined.
+	if isExternalResponse(resp) {
+		version := strings.TrimSuffix(strings.TrimPrefix(tarballName, path.Base(packageName)+"-"), ".tgz")
+		if err := checkQuarantine(r, packageName, version); err != nil {
+			resp.Body.Close()
+			return nil, nil, err
+		}
+	}
+
+	tarball := &spillBuffer{}
+	sha1Hash := sha1.New()
+	sha512Hash := sha512.New()
+	_, err = io.Copy(io.MultiWriter(tarball, sha1Hash, sha512Hash), resp.Body)
+	// Closing the body frees the upstream slot of the request, the metadata
+	// lookup below may need one of its own.
+	resp.Body.Close()
+	if err != nil {
+		tarball.Close()
+		return nil, nil, err
+	}
+
+	dist, found := expectedTarballDist(packageName, tarballName)
+	if !found {
+		tarball.Close()
+		return nil, nil, fmt.Errorf("%s: %s", tarballName, errTarballUnverified)
+	}
+	if err := verifyTarball(dist, sha1Hash.Sum(nil), sha512Hash.Sum(nil)); err != nil {
+		tarball.Close()
+		return nil, nil, fmt.Errorf("%s: %s", tarballName, err)
+	}
+
+	if isExternalResponse(resp) {
+		if err := verifyTarballSignature(packageName, dist); err != nil {
+			tarball.Close()
+			return nil, nil, fmt.Errorf("%s: %s", tarballName, err)
+		}
+	}
+
+	if _, err := tarball.Seek(0, io.SeekStart); err != nil {
+		tarball.Close()
+		return nil, nil, err
+	}
+
+	return resp, tarball, nil
+}
+
+func discardTempFile(tempFile *os.File) {
+	tempFile.Close()
+	os.Remove(tempFile.Name())
+}
+
+func tarballProxy(wr http.ResponseWriter, r *http.Request) {
+	proxyLog.debugf(r, "A tarball request handling for %s", r.URL.Path)
+	key := cacheKey(r.URL.Path)
+
+	blob, info, err := blobStore.Get(key)
+	if err == nil {
+		cacheLog.debugf(r, "Serving the cached tarball %s", r.URL.Path)
+		setLogField(r, "cache", "hit")
+		recordCacheHit(packageNameFromPath(r.URL.Path), false)
+		serveTarball(wr, r, blob, info)
+		blob.Close()
+		return
+	}
+
+	setLogField(r, "cache", "miss")
+	recordCacheMiss()
+
+	fill, waited := joinCacheFill(r, key, func(shared interface{}) bool {
+		blob, info, err = openFilledBlob(shared, key)
+		return err == nil
+	})
+	if fill == nil {
+		setLogField(r, "cache", "coalesced")
+		serveTarball(wr, r, blob, info)
+		blob.Close()
+		return
+	}
+	defer func() {
+		if fill != nil {
+			fill.release()
+		}
+	}()
+	if waited && r.Context().Err() != nil {
+		return
+	}
+
+	resp, tarball, err := fetchVerifiedTarball(r)
+	if err != nil && r.Context().Err() != nil {
+		proxyLog.debugf(r, "The client went away, abandoned fetching %s", r.URL.Path)
+		return
+	} else if err == errOffline {
+		http.Error(wr, err.Error(), http.StatusGatewayTimeout)
+		return
+	} else if err == errPackageNotFound {
+		writeJSON(wr, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	} else if err == errUpstreamBusy {
+		wr.Header().Set("Retry-After", "1")
+		http.Error(wr, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if blocked, ok := err.(quarantineError); ok {
+		writeJSON(wr, blocked.statusCode, map[string]string{"error": blocked.reason})
+		return
+	} else if err != nil {
+		proxyLog.errorf(r, "Failed to fetch the tarball %s: %s", r.URL.Path, err)
+		http.Error(wr, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	if tarball == nil {
+		for k, v := range resp.Header {
+			wr.Header().Set(k, v[0])
+		}
+		wr.WriteHeader(resp.StatusCode)
+		io.Copy(wr, resp.Body)
+		resp.Body.Close()
+		return
+	}
+
+	for k, v := range resp.Header {
+		if k != "Content-Length" && k != "Accept-Ranges" {
+			wr.Header().Set(k, v[0])
+		}
+	}
+	info = blobInfo(resp.Header)
+	fill.share(sharedBlob{tarball, info})
+	serveTarball(wr, r, tarball, info)
+
+	cachedEvent := webhookEvent{Event: eventPackageCached, Package: packageNameFromVars(r), Version: tarballVersion(r)}
+	releaseFill := fill
+	fill = nil
+	queueCacheWrite(func() {
+		defer releaseFill.release()
+		defer tarball.Close()
+
+		if !runBeforeCacheWriteHooks(key, resp) {
+			cacheLog.debugf(nil, "A plugin kept %s out of the cache", key)
+			return
+		}
+		if settings().maxCachedBlobSize > 0 && tarball.Size() > settings().maxCachedBlobSize {
+			cacheLog.infof(nil, "Not caching %s, it is larger than cache.blobs.maxObjectSize", key)
+			return
+		}
+		if _, err := tarball.Seek(0, io.SeekStart); err != nil {
+			cacheLog.warnf(nil, "Failed to cache %s: %s", key, err)
+			return
+		}
+		if err := blobStore.Put(key, tarball, info); err != nil {
+			cacheLog.warnf(nil, "Failed to cache %s: %s", key, err)
+			return
+		}
+
+		notify(cachedEvent)
+	})
+}
@@ -0,0 +1,186 @@
+package levee
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// cachedBaseURL stands in for the URL of levee in the documents kept in the
+// cache, and is replaced with the URL the client reached levee at whenever
+// a document is served. The Host of a request thus only shapes its own
+// response, never the cached document served to everyone else. The .invalid
+// domain never resolves.
+const cachedBaseURL = "http://levee.invalid"
+
+func leveeBaseURL(r *http.Request) string {
+	publicURL := settings().publicURL
+	if publicURL != "" {
+		return strings.TrimSuffix(publicURL, "/")
+	}
+	if r.Host == "" {
+		return ""
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	// Only a proxy in front of levee knows the scheme the client used.
+	if forwardedProto := r.Header.Get("X-Forwarded-Proto"); (forwardedProto == "http" || forwardedProto == "https") && isTrustedProxy(r) {
+		scheme = forwardedProto
+	}
+
+	return scheme + "://" + r.Host
+}
+
+// localizingWriter replaces cachedBaseURL in what is written through it with
+// the base URL of the client. The end of a write that may be the start of
+// cachedBaseURL is held back till the next write or flush.
+type localizingWriter struct {
+	dst     io.Writer
+	baseURL []byte
+	pending []byte
+}
+
+func newLocalizingWriter(dst io.Writer, r *http.Request) *localizingWriter {
+	return &localizingWriter{dst: dst, baseURL: []byte(leveeBaseURL(r))}
+}
+
+func (writer *localizingWriter) Write(p []byte) (int, error) {
+	data := append(writer.pending, p...)
+
+	// cachedBaseURL has no prefix that is also its suffix, a partial match
+	// at the end can't overlap a full one.
+	held := 0
+	for length := len(cachedBaseURL) - 1; length > 0; length-- {
+		if bytes.HasSuffix(data, []byte(cachedBaseURL[:length])) {
+			held = length
+			break
+		}
+	}
+
+	writer.pending = append([]byte(nil), data[len(data)-held:]...)
+	if _, err := writer.dst.Write(bytes.ReplaceAll(data[:len(data)-held], []byte(cachedBaseURL), writer.baseURL)); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (writer *localizingWriter) flush() error {
+	pending := writer.pending
+	writer.pending = nil
+	_, err := writer.dst.Write(pending)
+	return err
+}
+
+// localizeCachedResponse points the links of a cached response at the base
+// URL of the client.
+func localizeCachedResponse(r *http.Request, wholeResponse string) string {
+	return strings.ReplaceAll(wholeResponse, cachedBaseURL, leveeBaseURL(r))
+}
+
+func rewriteTarballURLs(resp *http.Response, baseURL string) error {
+	if baseURL == "" {
+		return nil
+	}
+
+	return rewriteJSONResponse(resp, func(metadata map[string]interface{}) bool {
+		return rewriteMetadataTarballs(metadata, baseURL)
+	})
+}
+
+// rewriteJSONResponse has rewrite change the JSON document of a successful
+// response, which is encoded again when rewrite reports a change.
+func rewriteJSONResponse(resp *http.Response, rewrite func(metadata map[string]interface{}) bool) error {
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Header.Get("Content-Type"), "json") {
+		return nil
+	}
+
+	var bodyReader io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gzipReader, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		bodyReader = gzipReader
+	}
+
+	body, err := ioutil.ReadAll(bodyReader)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	var metadata map[string]interface{}
+	if err := json.Unmarshal(body, &metadata); err == nil && rewrite(metadata) {
+		var rewritten bytes.Buffer
+		encoder := json.NewEncoder(&rewritten)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(metadata); err == nil {
+			body = rewritten.Bytes()
+		}
+	}
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header.Del("Content-Encoding")
+
+	return nil
+}
+
+// rewriteMetadataTarballs points the tarballs of a packument, or of the
+// document of a single version, at baseURL.
+func rewriteMetadataTarballs(metadata map[string]interface{}, baseURL string) bool {
+	name, _ := metadata["name"].(string)
+	if dist, ok := metadata["dist"].(map[string]interface{}); ok {
+		return rewriteDistTarball(dist, name, baseURL)
+	}
+
+	versions, _ := metadata["versions"].(map[string]interface{})
+	rewrote := false
+
+	for _, version := range versions {
+		versionMetadata, _ := version.(map[string]interface{})
+		dist, _ := versionMetadata["dist"].(map[string]interface{})
+		if rewriteDistTarball(dist, name, baseURL) {
+			rewrote = true
+		}
+	}
+
+	return rewrote
+}
+
+// rewriteDistTarball points the tarball of dist at baseURL. The path the
+// registry serves it at below its own base path, e.g. a Nexus repository at
+// /repository/npm/, is dropped so that the link matches the tarball routes.
+func rewriteDistTarball(dist map[string]interface{}, name string, baseURL string) bool {
+	tarball, _ := dist["tarball"].(string)
+	if tarball == "" {
+		return false
+	}
+
+	tarballURL, err := url.Parse(tarball)
+	if err != nil {
+		return false
+	}
+
+	tarballPath := tarballURL.Path
+	if name != "" {
+		if start := strings.LastIndex(tarballPath, "/"+name+"/-/"); start >= 0 {
+			tarballPath = tarballPath[start:]
+		}
+	}
+
+	dist["tarball"] = baseURL + (&url.URL{Path: tarballPath}).EscapedPath()
+	return true
+}
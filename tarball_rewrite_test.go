@@ -0,0 +1,51 @@
+package levee
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRewriteMetadataTarballs(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata string
+		expected string
+	}{
+		{
+			"Packument",
+			`{"name":"lodash","versions":{"1.0.0":{"dist":{"tarball":"https://registry.npmjs.org/lodash/-/lodash-1.0.0.tgz"}}}}`,
+			"http://levee.test/lodash/-/lodash-1.0.0.tgz",
+		},
+		{
+			"RegistryBasePath",
+			`{"name":"@corp/lib","versions":{"1.0.0":{"dist":{"tarball":"https://nexus.test/repository/npm/@corp/lib/-/lib-1.0.0.tgz"}}}}`,
+			"http://levee.test/@corp/lib/-/lib-1.0.0.tgz",
+		},
+		{
+			"Version",
+			`{"name":"lodash","version":"1.0.0","dist":{"tarball":"https://nexus.test/repository/npm/lodash/-/lodash-1.0.0.tgz"}}`,
+			"http://levee.test/lodash/-/lodash-1.0.0.tgz",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var metadata map[string]interface{}
+			if err := json.Unmarshal([]byte(test.metadata), &metadata); err != nil {
+				t.Fatal(err)
+			}
+			if !rewriteMetadataTarballs(metadata, "http://levee.test") {
+				t.Fatal("rewriteMetadataTarballs found no tarball to rewrite")
+			}
+
+			dist, ok := metadata["dist"].(map[string]interface{})
+			if !ok {
+				version := metadata["versions"].(map[string]interface{})["1.0.0"].(map[string]interface{})
+				dist = version["dist"].(map[string]interface{})
+			}
+			if dist["tarball"] != test.expected {
+				t.Errorf("The tarball was rewritten to %v, expected %s", dist["tarball"], test.expected)
+			}
+		})
+	}
+}
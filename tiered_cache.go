@@ -0,0 +1,145 @@
+package levee
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+type tieredCacheStore struct {
+	memory    *memoryCacheStore
+	backing   CacheStore
+	memoryTTL time.Duration
+}
+
+func newTieredCacheStore(backing CacheStore, maxEntries int, memoryTTL time.Duration) *tieredCacheStore {
+	if memoryTTL <= 0 {
+		memoryTTL = time.Minute
+	}
+
+	return &tieredCacheStore{
+		memory:    newMemoryCacheStore(maxEntries),
+		backing:   backing,
+		memoryTTL: memoryTTL,
+	}
+}
+
+func (store *tieredCacheStore) WithContext(ctx context.Context) CacheStore {
+	if backing, ok := store.backing.(contextCacheStore); ok {
+		return &tieredCacheStore{memory: store.memory, backing: backing.WithContext(ctx), memoryTTL: store.memoryTTL}
+	}
+
+	return store
+}
+
+func (store *tieredCacheStore) Get(key string) (map[string]string, error) {
+	if fields, err := store.memory.Get(key); err == nil {
+		return fields, nil
+	}
+
+	entries, err := store.fetch([]string{key})
+	if err != nil {
+		return nil, err
+	}
+	if entries[0] == nil {
+		return nil, ErrCacheMiss
+	}
+
+	return entries[0], nil
+}
+
+func (store *tieredCacheStore) Set(key string, fields map[string]string) error {
+	store.memory.Delete(key)
+	return store.backing.Set(key, fields)
+}
+
+func (store *tieredCacheStore) SetWithExpiry(key string, fields map[string]string, expiration time.Duration) error {
+	store.memory.Delete(key)
+	return setCacheEntry(store.backing, key, fields, expiration)
+}
+
+func (store *tieredCacheStore) GetMany(keys []string) ([]map[string]string, error) {
+	entries := make([]map[string]string, len(keys))
+
+	var missingKeys []string
+	var missingIndexes []int
+	for i, key := range keys {
+		if fields, err := store.memory.Get(key); err == nil {
+			entries[i] = fields
+		} else {
+			missingKeys = append(missingKeys, key)
+			missingIndexes = append(missingIndexes, i)
+		}
+	}
+	if len(missingKeys) == 0 {
+		return entries, nil
+	}
+
+	backingEntries, err := store.fetch(missingKeys)
+	if err != nil {
+		return nil, err
+	}
+	for i, fields := range backingEntries {
+		entries[missingIndexes[i]] = fields
+	}
+
+	return entries, nil
+}
+
+// fetch reads keys from the backing store and keeps a copy of each entry in
+// memory for the memory TTL, or for the time the entry has left in the
+// backing store when that is shorter. Entries of backing stores that can't
+// tell the time left are not kept in memory, they could outlive the entry.
+func (store *tieredCacheStore) fetch(keys []string) ([]map[string]string, error) {
+	backing, ok := store.backing.(expiringCacheStore)
+	if !ok {
+		return getCacheEntries(store.backing, keys)
+	}
+
+	entries, ttls, err := backing.GetManyWithTTL(keys)
+	if err != nil {
+		return nil, err
+	}
+	for i, fields := range entries {
+		if fields == nil || ttls[i] == 0 {
+			continue
+		}
+
+		memoryTTL := store.memoryTTL
+		if ttls[i] > 0 && ttls[i] < memoryTTL {
+			memoryTTL = ttls[i]
+		}
+		store.memory.Set(keys[i], fields)
+		store.memory.Expire(keys[i], memoryTTL)
+	}
+
+	return entries, nil
+}
+
+func (store *tieredCacheStore) Expire(key string, expiration time.Duration) error {
+	if expiration < store.memoryTTL {
+		store.memory.Expire(key, expiration)
+	}
+	return store.backing.Expire(key, expiration)
+}
+
+func (store *tieredCacheStore) Delete(key string) error {
+	store.memory.Delete(key)
+	return store.backing.Delete(key)
+}
+
+func (store *tieredCacheStore) Keys(prefix string) ([]string, error) {
+	return store.backing.Keys(prefix)
+}
+
+func (store *tieredCacheStore) DocumentsSize(prefix string) (int, int64, error) {
+	return documentsSize(store.backing, prefix)
+}
+
+func (store *tieredCacheStore) Close() error {
+	if closer, ok := store.backing.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,31 @@
+package levee
+
+import "net/http"
+
+// RegistryTransform rewrites the requests sent to a registry and the
+// responses it returns, for registries that expect or send odd headers.
+type RegistryTransform struct {
+	Request  HeaderTransform `yaml:"request"`
+	Response HeaderTransform `yaml:"response"`
+}
+
+// HeaderTransform removes headers, then sets the given ones.
+type HeaderTransform struct {
+	SetHeaders    map[string]string `yaml:"setHeaders"`
+	RemoveHeaders []string          `yaml:"removeHeaders"`
+}
+
+func (transform HeaderTransform) apply(header http.Header) {
+	for _, name := range transform.RemoveHeaders {
+		header.Del(name)
+	}
+	for name, value := range transform.SetHeaders {
+		header.Set(name, value)
+	}
+}
+
+// transformResponse applies the response transform of registry to resp
+// before levee caches or forwards it.
+func (registry Registry) transformResponse(resp *http.Response) {
+	registry.Transform.Response.apply(resp.Header)
+}
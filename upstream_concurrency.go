@@ -0,0 +1,76 @@
+package levee
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var upstreamSlots sync.Map
+
+var errUpstreamBusy = errors.New("upstream has too many requests in flight, try again later")
+
+func (registry Registry) maxConcurrent() int {
+	if registry.MaxConcurrent > 0 {
+		return registry.MaxConcurrent
+	}
+
+	return settings().upstreamMaxConcurrent
+}
+
+// acquireUpstreamSlot waits for one of the limited request slots of registry,
+// giving up with errUpstreamBusy after the queue timeout. The slot is held
+// until the returned release function is called.
+func acquireUpstreamSlot(r *http.Request, registry Registry) (func(), error) {
+	queueTimeout := settings().upstreamQueueTimeout
+	limit := registry.maxConcurrent()
+	if limit <= 0 {
+		return func() {}, nil
+	}
+
+	loadedSlots, _ := upstreamSlots.LoadOrStore(registry.URL, make(chan struct{}, limit))
+	slots := loadedSlots.(chan struct{})
+
+	select {
+	case slots <- struct{}{}:
+	default:
+		upstreamLog.debugf(r, "Registry %s has %d requests in flight, queueing %s", registry.URL, cap(slots), r.URL.Path)
+
+		timer := time.NewTimer(queueTimeout)
+		defer timer.Stop()
+
+		select {
+		case slots <- struct{}{}:
+		case <-timer.C:
+			upstreamLog.warnf(r, "Registry %s stayed busy for %s, giving up on %s", registry.URL, queueTimeout, r.URL.Path)
+			return nil, errUpstreamBusy
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+	}
+
+	var once sync.Once
+	return func() { once.Do(func() { <-slots }) }, nil
+}
+
+func resetUpstreamSlots() {
+	upstreamSlots.Range(func(registryURL, _ interface{}) bool {
+		upstreamSlots.Delete(registryURL)
+		return true
+	})
+}
+
+// slotBody keeps the upstream slot of a response till its body is closed, a
+// streaming download occupies its connection as long as a pending request.
+type slotBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (body slotBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.release()
+	return err
+}
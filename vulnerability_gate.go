@@ -0,0 +1,238 @@
+package levee
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type VulnerabilityGateConfig struct {
+	Source       string        `yaml:"source"`
+	MinSeverity  string        `yaml:"minSeverity"`
+	OSVURL       string        `yaml:"osvURL"`
+	VerdictTTL   time.Duration `yaml:"verdictTTL"`
+	BypassHeader string        `yaml:"bypassHeader"`
+	BypassToken  string        `yaml:"bypassToken"`
+	// FailOpen serves tarballs that couldn't be checked, e.g. while the
+	// advisory source is down, instead of refusing them with a 503.
+	FailOpen bool `yaml:"failOpen"`
+}
+
+var severityRanks = map[string]int{"info": 0, "low": 1, "moderate": 2, "medium": 2, "high": 3, "critical": 4}
+
+type vulnerability struct {
+	ID       string
+	Severity string
+}
+
+func configureVulnerabilityGate(config VulnerabilityGateConfig) (VulnerabilityGateConfig, error) {
+	switch config.Source {
+	case "", "npm", "osv":
+	default:
+		return config, fmt.Errorf("unknown vulnerability source %q, expected npm or osv", config.Source)
+	}
+
+	if config.MinSeverity == "" {
+		config.MinSeverity = "high"
+	}
+	if _, ok := severityRanks[strings.ToLower(config.MinSeverity)]; !ok {
+		return config, fmt.Errorf("unknown vulnerability severity %q", config.MinSeverity)
+	}
+	if config.OSVURL == "" {
+		config.OSVURL = "https://api.osv.dev"
+	}
+	if config.VerdictTTL <= 0 {
+		config.VerdictTTL = 24 * time.Hour
+	}
+	if config.BypassHeader == "" {
+		config.BypassHeader = "X-Levee-Vulnerability-Bypass"
+	}
+
+	return config, nil
+}
+
+func severityRank(severity string) int {
+	rank, ok := severityRanks[strings.ToLower(severity)]
+	if !ok {
+		// Entries without a severity, e.g. malicious package reports, are treated as critical.
+		return severityRanks["critical"]
+	}
+
+	return rank
+}
+
+func npmVulnerabilities(ctx context.Context, packageName string, version string) ([]vulnerability, error) {
+	registries := orderRegistries(settings().externalRegistries)
+	if len(registries) == 0 {
+		return nil, fmt.Errorf("no external registry to query advisories from")
+	}
+	registry := registries[0]
+
+	requestBody, _ := json.Marshal(map[string][]string{packageName: {version}})
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, registry.URL+"/-/npm/v1/security/advisories/bulk", bytes.NewReader(requestBody))
+	req.Header.Set("Content-Type", "application/json")
+	registry.authorize(req)
+
+	resp, err := registry.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s responded to the advisory query with %d", registry.URL, resp.StatusCode)
+	}
+
+	var advisories map[string][]struct {
+		ID       int    `json:"id"`
+		URL      string `json:"url"`
+		Severity string `json:"severity"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&advisories); err != nil {
+		return nil, err
+	}
+
+	var vulnerabilities []vulnerability
+	for _, advisory := range advisories[packageName] {
+		id := advisory.URL
+		if id == "" {
+			id = fmt.Sprintf("%d", advisory.ID)
+		}
+		vulnerabilities = append(vulnerabilities, vulnerability{ID: id, Severity: advisory.Severity})
+	}
+
+	return vulnerabilities, nil
+}
+
+func osvVulnerabilities(ctx context.Context, packageName string, version string) ([]vulnerability, error) {
+	osv := Registry{URL: strings.TrimSuffix(settings().vulnerabilityGate.OSVURL, "/"), external: true}
+
+	requestBody, _ := json.Marshal(map[string]interface{}{
+		"package": map[string]string{"name": packageName, "ecosystem": "npm"},
+		"version": version,
+	})
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, osv.URL+"/v1/query", bytes.NewReader(requestBody))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := osv.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s responded to the vulnerability query with %d", osv.URL, resp.StatusCode)
+	}
+
+	var result struct {
+		Vulns []struct {
+			ID               string `json:"id"`
+			DatabaseSpecific struct {
+				Severity string `json:"severity"`
+			} `json:"database_specific"`
+		} `json:"vulns"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	var vulnerabilities []vulnerability
+	for _, vuln := range result.Vulns {
+		vulnerabilities = append(vulnerabilities, vulnerability{ID: vuln.ID, Severity: vuln.DatabaseSpecific.Severity})
+	}
+
+	return vulnerabilities, nil
+}
+
+func vulnerabilityVerdict(ctx context.Context, packageName string, version string) (bool, string, error) {
+	gate := settings().vulnerabilityGate
+	key := cacheKey("vulnerabilities:" + packageName + "@" + version)
+	if verdict, err := cacheStoreFor(ctx).Get(key); err == nil {
+		return verdict["blocked"] == "true", verdict["reason"], nil
+	}
+
+	var vulnerabilities []vulnerability
+	var err error
+	if gate.Source == "osv" {
+		vulnerabilities, err = osvVulnerabilities(ctx, packageName, version)
+	} else {
+		vulnerabilities, err = npmVulnerabilities(ctx, packageName, version)
+	}
+	if err != nil {
+		return false, "", err
+	}
+
+	var blockingIDs []string
+	for _, vuln := range vulnerabilities {
+		if severityRank(vuln.Severity) >= severityRank(gate.MinSeverity) {
+			blockingIDs = append(blockingIDs, vuln.ID)
+		}
+	}
+
+	blocked := len(blockingIDs) > 0
+	reason := ""
+	if blocked {
+		reason = fmt.Sprintf("%s@%s has known vulnerabilities of %s severity or above: %s", packageName, version, gate.MinSeverity, strings.Join(blockingIDs, ", "))
+	}
+
+	setCacheEntry(cacheStore, key, map[string]string{"blocked": fmt.Sprintf("%t", blocked), "reason": reason}, gate.VerdictTTL)
+
+	return blocked, reason, nil
+}
+
+func tarballVersion(r *http.Request) string {
+	vars := mux.Vars(r)
+	return strings.TrimSuffix(strings.TrimPrefix(path.Base(vars["tarball"]), vars["package"]+"-"), ".tgz")
+}
+
+func bypassesVulnerabilityGate(r *http.Request) bool {
+	gate := settings().vulnerabilityGate
+	bypassToken := r.Header.Get(gate.BypassHeader)
+	return gate.BypassToken != "" && subtle.ConstantTimeCompare([]byte(bypassToken), []byte(gate.BypassToken)) == 1
+}
+
+func enforceVulnerabilityGate(handler http.HandlerFunc) http.HandlerFunc {
+	return func(wr http.ResponseWriter, r *http.Request) {
+		if settings().vulnerabilityGate.Source == "" || offline {
+			handler(wr, r)
+			return
+		}
+
+		packageName := packageNameFromVars(r)
+		version := tarballVersion(r)
+
+		if bypassesVulnerabilityGate(r) {
+			policyLog.warnf(r, "Bypassing the vulnerability gate for %s@%s", packageName, version)
+			handler(wr, r)
+			return
+		}
+
+		blocked, reason, err := vulnerabilityVerdict(r.Context(), packageName, version)
+		if r.Context().Err() != nil {
+			return
+		} else if err != nil && settings().vulnerabilityGate.FailOpen {
+			recordVulnerabilityCheckFailure(true)
+			policyLog.warnf(r, "Failed to check %s@%s for vulnerabilities, serving it anyway: %s", packageName, version, err)
+		} else if err != nil {
+			recordVulnerabilityCheckFailure(false)
+			policyLog.warnf(r, "Failed to check %s@%s for vulnerabilities, refusing it: %s", packageName, version, err)
+			writeJSON(wr, http.StatusServiceUnavailable, map[string]string{"error": fmt.Sprintf("%s@%s can't be checked for vulnerabilities: %s", packageName, version, err)})
+			return
+		} else if blocked {
+			policyLog.warnf(r, "Blocked %s by the vulnerability gate", r.URL.Path)
+			notify(webhookEvent{Event: eventPolicyBlocked, Package: packageName, Version: version, Reason: reason})
+			writeJSON(wr, http.StatusForbidden, map[string]string{"error": reason})
+			return
+		}
+
+		handler(wr, r)
+	}
+}
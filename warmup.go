@@ -0,0 +1,145 @@
+package levee
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+func readPackageList(filename string) ([]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var packages []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			packages = append(packages, line)
+		}
+	}
+
+	return packages, scanner.Err()
+}
+
+func fetchAndCache(requestPath string) ([]byte, error) {
+	req, _ := http.NewRequest(http.MethodGet, requestPath, nil)
+
+	resp, err := fetchPackage(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s responded with %d", requestPath, resp.StatusCode)
+	}
+
+	if err := npm.RewriteResponse(req, resp); err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	entry, err := teeResponse(&body, resp)
+	if err != nil {
+		return nil, err
+	}
+	writePackageInfo(cacheKey(requestPath), resp, entry, nil, cachePolicyFor(requestPath))
+
+	return body.Bytes(), nil
+}
+
+func warmPackage(packageName string) error {
+	if allowed, reason := settings().packagePolicy.verdict(packageName); !allowed {
+		return packageBlockedError(packageName, reason)
+	}
+
+	body, err := fetchAndCache("/" + packageName)
+	if err != nil {
+		return err
+	}
+
+	var metadata struct {
+		DistTags map[string]string `json:"dist-tags"`
+		Versions map[string]struct {
+			Dist struct {
+				Tarball string `json:"tarball"`
+			} `json:"dist"`
+		} `json:"versions"`
+	}
+	if err := json.Unmarshal(body, &metadata); err != nil {
+		return err
+	}
+
+	latest, ok := metadata.Versions[metadata.DistTags["latest"]]
+	if !ok || latest.Dist.Tarball == "" {
+		return nil
+	}
+
+	tarballURL, err := url.Parse(latest.Dist.Tarball)
+	if err != nil {
+		return err
+	}
+
+	return warmTarball(tarballURL.Path)
+}
+
+// warmTarball caches a tarball the way a download would. Tarballs served from
+// the blob store skip the quarantine, which fetchVerifiedTarball applies
+// here before the tarball is stored. The vulnerability gate is applied to
+// every download, cached or not.
+func warmTarball(tarballPath string) error {
+	key := cacheKey(tarballPath)
+	if blob, _, err := blobStore.Get(key); err == nil {
+		blob.Close()
+		return nil
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, tarballPath, nil)
+
+	resp, tarball, err := fetchVerifiedTarball(req)
+	if err != nil {
+		return err
+	}
+	if tarball == nil {
+		resp.Body.Close()
+		return fmt.Errorf("%s responded with %d", tarballPath, resp.StatusCode)
+	}
+	defer tarball.Close()
+
+	return blobStore.Put(key, tarball, blobInfo(resp.Header))
+}
+
+func warmCache(packages []string) {
+	cacheLog.infof(nil, "Warming the cache with %d packages", len(packages))
+
+	for _, packageName := range packages {
+		if err := warmPackage(packageName); err != nil {
+			cacheLog.warnf(nil, "Failed to warm %s: %s", packageName, err)
+			continue
+		}
+		cacheLog.infof(nil, "Warmed %s", packageName)
+	}
+}
+
+func warmPackages(wr http.ResponseWriter, r *http.Request) {
+	var warmRequest struct {
+		Packages []string `json:"packages"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&warmRequest); err != nil || len(warmRequest.Packages) == 0 {
+		writeJSON(wr, http.StatusBadRequest, map[string]string{"error": "a list of packages is required"})
+		return
+	}
+
+	go warmCache(warmRequest.Packages)
+	writeJSON(wr, http.StatusAccepted, map[string]int{"warming": len(warmRequest.Packages)})
+}
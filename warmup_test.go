@@ -0,0 +1,43 @@
+package levee
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWarmTarballQuarantine(t *testing.T) {
+	registry := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/lodash":
+			wr.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(wr, `{"name":"lodash","versions":{"1.0.0":{}},"time":{"1.0.0":%q}}`, time.Now().Format(time.RFC3339))
+		case "/lodash/-/lodash-1.0.0.tgz":
+			wr.Write([]byte("the lodash tarball"))
+		default:
+			http.NotFound(wr, r)
+		}
+	}))
+	defer registry.Close()
+
+	config := Config{ExternalRegistries: []Registry{{URL: registry.URL}}, Quarantine: QuarantineConfig{Period: "72h"}}
+	config.Cache.Blobs.Directory = t.TempDir()
+	server, err := NewServer(config, WithCache(NewMemoryCache(0)), WithLogHandler(slog.NewTextHandler(ioutil.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Shutdown(context.Background())
+
+	err = warmTarball("/lodash/-/lodash-1.0.0.tgz")
+	if _, quarantined := err.(quarantineError); !quarantined {
+		t.Errorf("Warming a quarantined tarball returned %v, expected it to be refused", err)
+	}
+	if _, _, err := blobStore.Get(cacheKey("/lodash/-/lodash-1.0.0.tgz")); err != ErrCacheMiss {
+		t.Errorf("The quarantined tarball was stored")
+	}
+}
@@ -0,0 +1,163 @@
+package levee
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"text/template"
+	"time"
+)
+
+type Webhook struct {
+	URL      string            `yaml:"url"`
+	Events   []string          `yaml:"events"`
+	Template string            `yaml:"template"`
+	Headers  map[string]string `yaml:"headers"`
+
+	template *template.Template
+}
+
+type webhookEvent struct {
+	Event    string `json:"event"`
+	Time     string `json:"time"`
+	Package  string `json:"package,omitempty"`
+	Version  string `json:"version,omitempty"`
+	Registry string `json:"registry,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+const (
+	eventPackageCached     = "package.cached"
+	eventUpstreamUnhealthy = "upstream.unhealthy"
+	eventUpstreamHealthy   = "upstream.healthy"
+	eventPolicyBlocked     = "policy.blocked"
+)
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+var webhookTemplateFuncs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		encoded, err := json.Marshal(value)
+		return string(encoded), err
+	},
+}
+
+func compileWebhooks(hooks []Webhook) ([]Webhook, error) {
+	for i, hook := range hooks {
+		if hook.URL == "" {
+			return nil, fmt.Errorf("webhook %d has no url", i)
+		}
+
+		for _, event := range hook.Events {
+			switch event {
+			case eventPackageCached, eventUpstreamUnhealthy, eventUpstreamHealthy, eventPolicyBlocked:
+			default:
+				return nil, fmt.Errorf("webhook %s subscribes to unknown event %q", hook.URL, event)
+			}
+		}
+
+		if hook.Template != "" {
+			compiled, err := template.New(hook.URL).Funcs(webhookTemplateFuncs).Parse(hook.Template)
+			if err != nil {
+				return nil, fmt.Errorf("invalid template of webhook %s: %s", hook.URL, err)
+			}
+			hooks[i].template = compiled
+		}
+	}
+
+	return hooks, nil
+}
+
+func (hook Webhook) subscribes(event string) bool {
+	if len(hook.Events) == 0 {
+		return true
+	}
+
+	for _, subscribedEvent := range hook.Events {
+		if subscribedEvent == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (hook Webhook) payload(event webhookEvent) ([]byte, error) {
+	if hook.template == nil {
+		return json.Marshal(event)
+	}
+
+	var payload bytes.Buffer
+	err := hook.template.Execute(&payload, event)
+	return payload.Bytes(), err
+}
+
+func (hook Webhook) deliver(event webhookEvent) {
+	payload, err := hook.payload(event)
+	if err != nil {
+		webhooksLog.warnf(nil, "Failed to render the %s payload of webhook %s: %s", event.Event, hook.URL, err)
+		return
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range hook.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		webhooksLog.warnf(nil, "Failed to deliver %s to webhook %s: %s", event.Event, hook.URL, err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		webhooksLog.warnf(nil, "Webhook %s responded to %s with %d", hook.URL, event.Event, resp.StatusCode)
+	}
+}
+
+// webhookWorkers deliver the events, a slow or unreachable webhook thus ties
+// up a few goroutines and a bounded queue instead of one goroutine per event.
+const webhookWorkers = 4
+const webhookQueueSize = 1000
+
+var webhookDeliveries chan func()
+var startWebhookWorkers sync.Once
+
+func queueWebhookDelivery(deliver func()) bool {
+	startWebhookWorkers.Do(func() {
+		webhookDeliveries = make(chan func(), webhookQueueSize)
+		for i := 0; i < webhookWorkers; i++ {
+			go func() {
+				for deliver := range webhookDeliveries {
+					deliver()
+				}
+			}()
+		}
+	})
+
+	select {
+	case webhookDeliveries <- deliver:
+		return true
+	default:
+		return false
+	}
+}
+
+func notify(event webhookEvent) {
+	event.Time = time.Now().UTC().Format(time.RFC3339)
+
+	for _, hook := range settings().webhooks {
+		if !hook.subscribes(event.Event) {
+			continue
+		}
+
+		hook := hook
+		if !queueWebhookDelivery(func() { hook.deliver(event) }) {
+			webhooksLog.warnf(nil, "Dropped %s for webhook %s, too many deliveries are pending", event.Event, hook.URL)
+		}
+	}
+}
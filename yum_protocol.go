@@ -0,0 +1,52 @@
+package levee
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// yumProtocol serves an RPM repository to yum and dnf. The repodata, with
+// repomd.xml and its signature, changes as packages are published and is
+// cached for the metadata TTL, the packages themselves never change and are
+// kept for good.
+type yumProtocol struct {
+	*repository
+}
+
+func newYumProtocol(repo *repository) RegistryProtocol {
+	return yumProtocol{repository: repo}
+}
+
+func (yumProtocol) Name() string {
+	return "yum"
+}
+
+func (protocol yumProtocol) RegisterRoutes(router *mux.Router) {
+	routes := protocol.routes(router, protocol)
+	metadata := protocol.metadataProxy(protocol)
+	files := protocol.artifactProxy(protocol)
+
+	routes.HandleFunc("/{file:.+}", func(wr http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".rpm") && !strings.Contains(r.URL.Path, "/repodata/") {
+			files(wr, r)
+		} else {
+			metadata(wr, r)
+		}
+	}).Methods("GET", "HEAD")
+}
+
+func (protocol yumProtocol) CacheKey(r *http.Request) string {
+	return cacheKey(r.URL.Path)
+}
+
+func (protocol yumProtocol) Fetch(r *http.Request) (*http.Response, error) {
+	return protocol.fetch(r)
+}
+
+// RewriteResponse leaves the responses as they are, the repodata locates
+// packages relative to the repository.
+func (yumProtocol) RewriteResponse(r *http.Request, resp *http.Response) error {
+	return nil
+}